@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	ofsdk "github.com/openfaas-incubator/connector-sdk/types"
+	"github.com/openfaas-incubator/vcenter-connector/pkg/config"
+	"github.com/openfaas-incubator/vcenter-connector/pkg/deadletter"
+	"github.com/openfaas-incubator/vcenter-connector/pkg/topics"
+)
+
+const dlqUsage = `Usage: vcenter-connector dlq list|replay|purge [flags]
+
+Inspects and redrives messages which could not be delivered, see
+-dead-letter-file. The file and gateway settings default to those of the
+connector's -config file and environment variables.
+
+  list    prints the dead letters
+  replay  invokes the functions of the dead letters again and removes those
+          which were delivered
+  purge   removes the dead letters
+
+Flags:
+`
+
+// runDeadLetterCommand runs the dlq subcommand and returns the exit code
+func runDeadLetterCommand(args, environ []string) int {
+	fs := flag.NewFlagSet("dlq", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprint(os.Stderr, dlqUsage)
+		fs.PrintDefaults()
+	}
+
+	if len(args) == 0 {
+		fs.Usage()
+		return 2
+	}
+	action := args[0]
+
+	cfg, err := loadDeadLetterConfig(args[1:], environ)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	var configFile, function, topic string
+	var asJSON bool
+	file, gatewayURL, async, timeout := cfg.Delivery.DeadLetterFile, cfg.Gateway.URL, cfg.Gateway.Async, cfg.Gateway.Timeout
+	fs.StringVar(&configFile, "config", "", "YAML configuration file of the connector, the defaults of -file, -gateway, -async and -timeout are read from it")
+	fs.StringVar(&file, "file", file, "Dead letter file of the connector, see -dead-letter-file")
+	fs.StringVar(&function, "function", "", "Only handle dead letters of this function")
+	fs.StringVar(&topic, "topic", "", "Only handle dead letters on this topic or topic pattern")
+	fs.BoolVar(&asJSON, "json", false, "list: print the dead letters including their message as JSON lines")
+	fs.StringVar(&gatewayURL, "gateway", gatewayURL, "replay: URL for OpenFaaS gateway")
+	fs.BoolVar(&async, "async", async, "replay: invoke functions asynchronously like the connector")
+	fs.DurationVar(&timeout, "timeout", timeout, "replay: timeout of each invocation")
+
+	if err := fs.Parse(args[1:]); err != nil {
+		return 2
+	}
+	if len(file) == 0 {
+		fmt.Fprintln(os.Stderr, "-file is required")
+		return 2
+	}
+
+	store := deadletter.NewFileStore(file)
+	match := func(e deadletter.Entry) bool {
+		return (len(function) == 0 || e.Function == function) &&
+			(len(topic) == 0 || topics.Match(topic, e.Topic))
+	}
+
+	switch action {
+	case "list":
+		err = listDeadLetters(store, match, asJSON)
+	case "replay":
+		ofconfig := ofsdk.ControllerConfig{
+			GatewayURL:              gatewayURL,
+			UpstreamTimeout:         timeout,
+			AsyncFunctionInvocation: async,
+		}
+		err = replayDeadLetters(store, match, &ofconfig)
+	case "purge":
+		err = purgeDeadLetters(store, match)
+	default:
+		fs.Usage()
+		return 2
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// loadDeadLetterConfig reads the configuration file given with -config in
+// args and the environment like the connector, without validating it, as the
+// dlq command only uses the dead letter file and gateway settings
+func loadDeadLetterConfig(args, environ []string) (config.Config, error) {
+	cfg := config.Default()
+	if file := lookupFlag(args, "config"); len(file) > 0 {
+		if err := config.Load(file, &cfg); err != nil {
+			return cfg, err
+		}
+	}
+	err := config.ApplyEnv(&cfg, environ)
+	return cfg, err
+}
+
+func listDeadLetters(store deadletter.Store, match func(deadletter.Entry) bool, asJSON bool) error {
+	entries, err := store.List()
+	if err != nil {
+		return err
+	}
+
+	if asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		for _, e := range entries {
+			if match(e) {
+				if err := enc.Encode(e); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "TIME\tTOPIC\tFUNCTION\tSTATUS\tATTEMPTS\tERROR")
+	for _, e := range entries {
+		if match(e) {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%d\t%s\n", e.Time.Format(time.RFC3339), e.Topic, e.Function, e.Status, e.Attempts, firstLine(e.Error))
+		}
+	}
+	return w.Flush()
+}
+
+// replayDeadLetters invokes the functions of the matching dead letters once.
+// Delivered dead letters are removed, the others are kept with the outcome of
+// the replay
+func replayDeadLetters(store deadletter.Store, match func(deadletter.Entry) bool, config *ofsdk.ControllerConfig) error {
+	entries, err := store.List()
+	if err != nil {
+		return err
+	}
+
+	credentials, err := readGatewayCredentials()
+	if err != nil {
+		return err
+	}
+
+	// a single attempt, failed dead letters can be replayed again
+	controller := topics.NewController(credentials, config, topics.Settings{Retry: topics.RetryPolicy{Attempts: 1}})
+	invoker := controller.(topics.FunctionInvoker)
+
+	var kept []deadletter.Entry
+	var delivered, failed int
+	for _, e := range entries {
+		if !match(e) {
+			kept = append(kept, e)
+			continue
+		}
+
+		res := invoker.InvokeFunction(context.Background(), e.Topic, e.Function, e.Message, e.Header)
+		if res.Error == nil && res.Status >= 200 && res.Status < 300 {
+			delivered++
+			continue
+		}
+
+		failed++
+		f := deadletter.FromResponse(res, time.Now())
+		f.Attempts += e.Attempts
+		fmt.Fprintf(os.Stderr, "function %s for topic %s failed with status %d: %s\n", f.Function, f.Topic, f.Status, firstLine(f.Error))
+		kept = append(kept, f)
+	}
+
+	// dead letters added by the connector during the replay are kept
+	if err := store.Replace(len(entries), kept); err != nil {
+		return err
+	}
+
+	fmt.Printf("replayed %d dead letter(s), %d delivered, %d failed\n", delivered+failed, delivered, failed)
+	if failed > 0 {
+		return fmt.Errorf("%d dead letter(s) could not be delivered", failed)
+	}
+	return nil
+}
+
+func purgeDeadLetters(store deadletter.Store, match func(deadletter.Entry) bool) error {
+	entries, err := store.List()
+	if err != nil {
+		return err
+	}
+
+	var kept []deadletter.Entry
+	for _, e := range entries {
+		if !match(e) {
+			kept = append(kept, e)
+		}
+	}
+
+	if err := store.Replace(len(entries), kept); err != nil {
+		return err
+	}
+
+	fmt.Printf("purged %d dead letter(s)\n", len(entries)-len(kept))
+	return nil
+}
+
+// firstLine returns the first line of s, e.g. of a function's error output
+func firstLine(s string) string {
+	if i := strings.IndexByte(s, '\n'); i >= 0 {
+		return s[:i]
+	}
+	return s
+}
@@ -2,105 +2,185 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"flag"
+	"fmt"
+	"io/ioutil"
 	"log"
+	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 	"syscall"
 	"time"
+	"unicode"
 
+	"github.com/openfaas-incubator/vcenter-connector/pkg/checkpoint"
+	"github.com/openfaas-incubator/vcenter-connector/pkg/config"
+	"github.com/openfaas-incubator/vcenter-connector/pkg/deadletter"
+	"github.com/openfaas-incubator/vcenter-connector/pkg/dedupe"
 	"github.com/openfaas-incubator/vcenter-connector/pkg/events"
+	"github.com/openfaas-incubator/vcenter-connector/pkg/health"
+	"github.com/openfaas-incubator/vcenter-connector/pkg/logging"
+	"github.com/openfaas-incubator/vcenter-connector/pkg/topics"
+	"github.com/openfaas-incubator/vcenter-connector/pkg/tracing"
 
 	ofsdk "github.com/openfaas-incubator/connector-sdk/types"
 	"github.com/openfaas/faas-provider/auth"
-	"github.com/openfaas/openfaas-cloud/sdk"
-)
-
-const (
-	topicDelimiter = ","
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 func main() {
-	var gatewayURL string
-	var vcenterURL string
-	var vcUser string
-	var vcPass string
-	var vcUserSecret string
-	var vcPasswordSecret string
+	if len(os.Args) > 1 && os.Args[1] == "dlq" {
+		os.Exit(runDeadLetterCommand(os.Args[2:], os.Environ()))
+	}
 
-	var insecure bool
+	cfg, opts, err := loadConfig(flag.CommandLine, os.Args[1:], os.Environ())
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	// TODO: add option to configure log verbosity
-	flag.StringVar(&gatewayURL, "gateway", "http://127.0.0.1:8080", "URL for OpenFaaS gateway")
-	flag.StringVar(&vcenterURL, "vcenter", "http://127.0.0.1:8989/sdk", "URL for vCenter")
-	flag.StringVar(&vcUser, "vc-user", "", "User to connect to vCenter")
-	flag.StringVar(&vcPass, "vc-pass", "", "Password to connect to vCenter")
+	if err := setupLogging(cfg.Logging.Level, cfg.Logging.Format); err != nil {
+		log.Fatal(err)
+	}
 
-	flag.StringVar(&vcUserSecret, "vc-user-secret-name", "", "Secret file to use for username")
-	flag.StringVar(&vcPasswordSecret, "vc-pass-secret-name", "", "Secret file to use for password")
+	tracer, err := newTracer(cfg.Tracing)
+	if err != nil {
+		fatal("could not set up tracing", "error", err)
+	}
+	if tracer != nil {
+		tracing.SetDefault(tracer)
+	}
 
-	flag.BoolVar(&insecure, "insecure", false, "use an insecure connection to vCenter (default false)")
-	flag.Parse()
+	streamConfig, err := makeStreamConfig(opts.replayFrom, opts.replayTo)
+	if err != nil {
+		fatal("invalid replay window", "error", err)
+	}
 
-	if len(vcenterURL) == 0 {
-		log.Fatal("vcenterURL not provided")
+	streamConfig.PageSize = int32(cfg.Stream.PageSize)
+	streamConfig.MinBackoff = cfg.Stream.MinBackoff
+	streamConfig.MaxBackoff = cfg.Stream.MaxBackoff
+	streamConfig.Tasks = cfg.Stream.Tasks
+	streamConfig.Dispatch = events.DispatchConfig{
+		Workers:      cfg.Delivery.Workers,
+		QueueSize:    cfg.Delivery.QueueSize,
+		DropWhenFull: cfg.Delivery.DropWhenFull,
+		Format:       events.NewMessageFormat(cfg.Delivery.Format, cfg.Delivery.CloudEventsMode),
 	}
 
-	if len(vcUserSecret) > 0 {
-		val, err := sdk.ReadSecret(vcUserSecret)
-		if err != nil {
-			panic(err.Error())
+	if len(cfg.Stream.Enrich) > 0 {
+		streamConfig.Enrichment = make(map[string][]string)
+		for _, p := range cfg.Stream.Enrich {
+			if err := events.ParseTypeProperty(streamConfig.Enrichment, p); err != nil {
+				fatal("invalid enrichment property", "property", p, "error", err)
+			}
 		}
-		vcUser = val
 	}
+	streamConfig.EnrichmentTTL = cfg.Stream.EnrichTTL
+	streamConfig.IncludeEventData = cfg.Stream.IncludeEventData
 
-	if len(vcPasswordSecret) > 0 {
-		val, err := sdk.ReadSecret(vcPasswordSecret)
-		if err != nil {
-			panic(err.Error())
+	if len(cfg.Stream.WatchProperties) > 0 {
+		streamConfig.Properties = make(map[string][]string)
+		for _, p := range cfg.Stream.WatchProperties {
+			if err := events.ParseTypeProperty(streamConfig.Properties, p); err != nil {
+				fatal("invalid watched property", "property", p, "error", err)
+			}
 		}
-		vcPass = val
 	}
 
-	vcenterClient, err := events.NewVCenterClient(context.Background(), vcUser, vcPass, vcenterURL, insecure)
+	settings, err := cfg.Settings()
 	if err != nil {
-		log.Fatalf("could not connect to vCenter: %v", err)
+		fatal("invalid delivery settings", "error", err)
 	}
 
-	// OpenFaaS credentials for the connector
-	var credentials *auth.BasicAuthCredentials
-	if val, ok := os.LookupEnv("basic_auth"); ok && len(val) > 0 {
-		if val == "true" || val == "1" {
+	// the cache is shared by all endpoints, its keys include the vCenter
+	// instance UUID
+	switch {
+	case len(cfg.Stream.DedupeFile) > 0:
+		streamConfig.Dedupe, err = dedupe.OpenCache(cfg.Stream.DedupeSize, cfg.Stream.DedupeFile)
+		if err != nil {
+			fatal("could not open dedupe file", "file", cfg.Stream.DedupeFile, "error", err)
+		}
+		defer streamConfig.Dedupe.Close()
+	case cfg.Stream.DedupeSize > 0:
+		streamConfig.Dedupe = dedupe.NewCache(cfg.Stream.DedupeSize)
+	}
 
-			reader := auth.ReadBasicAuthFromDisk{}
+	var sessions []*events.Session
+	var streamConfigs []events.StreamConfig
+	for _, e := range cfg.VCenters {
+		e.User, e.Password, err = readCredentials(e)
+		if err != nil {
+			fatal("could not read vCenter credentials", "source", e.URL, "error", err)
+		}
 
-			if val, ok := os.LookupEnv("secret_mount_path"); ok && len(val) > 0 {
-				reader.SecretMountPath = os.Getenv("secret_mount_path")
-			}
+		session, err := events.NewSession(e.Endpoint)
+		if err != nil {
+			fatal("could not create vCenter session", "source", e.URL, "error", err)
+		}
 
-			res, err := reader.Read()
-			if err != nil {
-				log.Fatalf("could not read credentials: %v", err)
+		// an unreachable vCenter, e.g. one with rotated credentials, does not
+		// keep the connector from starting, the stream keeps logging in with
+		// backoff in the background
+		if err := session.Login(context.Background(), false); err != nil {
+			logging.Warn("could not connect to vCenter, retrying", "source", session.Name(), "error", err)
+		}
+
+		sc := streamConfig
+		sc.Roots = e.Roots
+
+		cpFile := e.CheckpointFile
+		if len(cpFile) == 0 && len(cfg.Stream.CheckpointFile) > 0 {
+			cpFile = cfg.Stream.CheckpointFile
+			if len(cfg.VCenters) > 1 {
+				cpFile = endpointCheckpointFile(cfg.Stream.CheckpointFile, session.Name())
 			}
-			credentials = res
 		}
+		if len(cpFile) > 0 {
+			sc.Checkpoint = checkpoint.NewFileStore(cpFile)
+		}
+
+		sessions = append(sessions, session)
+		streamConfigs = append(streamConfigs, sc)
+	}
+
+	credentials, err := readGatewayCredentials()
+	if err != nil {
+		fatal("could not read gateway credentials", "error", err)
 	}
 
 	// OpenFaaS connector SDK controller configuration
 	ofconfig := ofsdk.ControllerConfig{
-		GatewayURL:               gatewayURL,
-		TopicAnnotationDelimiter: topicDelimiter,
-		RebuildInterval:          time.Second * 10,
-		UpstreamTimeout:          time.Second * 15,
-		AsyncFunctionInvocation:  true, // don't block when invoking long-running/heavy functions, higher throughput
-		PrintSync:                true,
+		GatewayURL:              cfg.Gateway.URL,
+		RebuildInterval:         cfg.Gateway.RebuildInterval,
+		UpstreamTimeout:         cfg.Gateway.Timeout,
+		AsyncFunctionInvocation: cfg.Gateway.Async, // don't block when invoking long-running/heavy functions, higher throughput
+		PrintSync:               true,
+	}
+
+	var deadLetters deadletter.Store
+	if len(cfg.Delivery.DeadLetterFile) > 0 {
+		deadLetters = deadletter.NewFileStore(cfg.Delivery.DeadLetterFile)
 	}
 
-	ofcontroller := ofsdk.NewController(credentials, &ofconfig)
-	responseHandler := events.NewEventReceiver()
+	ofcontroller := topics.NewController(credentials, &ofconfig, settings)
+	responseHandler := events.NewEventReceiver(deadLetters)
 	ofcontroller.Subscribe(responseHandler)
 	ofcontroller.BeginMapBuilder()
 
+	if len(cfg.Server.ListenAddr) > 0 {
+		checker := newHealthChecker(ofcontroller, sessions, cfg.Server.ReadyMaxEventAge)
+
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", promhttp.Handler())
+		mux.Handle("/healthz", checker.LivenessHandler())
+		mux.Handle("/readyz", checker.ReadinessHandler())
+		go serveHTTP(cfg.Server.ListenAddr, mux)
+	}
+
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
@@ -109,16 +189,436 @@ func main() {
 	signal.Notify(sigCh, syscall.SIGTERM, os.Interrupt)
 	go func() {
 		s := <-sigCh
-		log.Printf("got signal: %v, cleaning up...", s)
+		logging.Info("received signal, cleaning up", "signal", s.String())
 		cancel()
 		// give subroutines some time to finish their work
 		<-time.Tick(3 * time.Second)
+		shutdownTracer(tracer)
 		os.Exit(0)
 	}()
 
-	// blocks until eventStream returns
-	err = events.Stream(ctx, vcenterClient.Client, ofcontroller)
+	// apply changes of the configuration and secret files while running
+	hupCh := make(chan os.Signal, 1)
+	signal.Notify(hupCh, syscall.SIGHUP)
+	r := newReloader(os.Args[1:], cfg, opts, sessions, ofcontroller, streamConfig.Dispatch.Format, responseHandler)
+	go r.run(ctx, hupCh, cfg.Reload.Interval)
+
+	// stream events from all vCenter endpoints, each blocks until ctx is
+	// cancelled or a one-off replay finished, reconnects to vCenter on errors
+	var wg sync.WaitGroup
+	for i := range sessions {
+		wg.Add(1)
+		go func(session *events.Session, cfg events.StreamConfig) {
+			defer wg.Done()
+
+			err := events.Stream(ctx, session, ofcontroller, cfg)
+			if err != nil {
+				fatal("could not bind events", "source", session.Name(), "error", err)
+			}
+		}(sessions[i], streamConfigs[i])
+	}
+	wg.Wait()
+	shutdownTracer(tracer)
+}
+
+// options are the settings which are only available as flags
+type options struct {
+	configFile   string
+	vcentersFile string
+	replayFrom   string
+	replayTo     string
+}
+
+// loadConfig reads the configuration file and the environment, then registers
+// the flags with fs and parses args. The resulting configuration is validated
+func loadConfig(fs *flag.FlagSet, args, environ []string) (config.Config, options, error) {
+	var opts options
+
+	// the configuration file and environment variables are read before the
+	// flags, so flags which are set override them
+	cfg := config.Default()
+	opts.configFile = lookupFlag(args, "config")
+	if len(opts.configFile) > 0 {
+		if err := config.Load(opts.configFile, &cfg); err != nil {
+			return cfg, opts, err
+		}
+	}
+	if err := config.ApplyEnv(&cfg, environ); err != nil {
+		return cfg, opts, err
+	}
+
+	var vcenter config.VCenter
+
+	fs.StringVar(&opts.configFile, "config", opts.configFile, "YAML configuration file, see README.md. Environment variables and flags override its settings")
+
+	fs.StringVar(&cfg.Logging.Level, "log-level", cfg.Logging.Level, "Log verbosity, one of debug, info, warn or error")
+	fs.StringVar(&cfg.Logging.Format, "log-format", cfg.Logging.Format, "Log format, either logfmt or json")
+	fs.StringVar(&cfg.Gateway.URL, "gateway", cfg.Gateway.URL, "URL for OpenFaaS gateway")
+	fs.StringVar(&vcenter.URL, "vcenter", "http://127.0.0.1:8989/sdk", "URL for vCenter")
+	fs.StringVar(&vcenter.User, "vc-user", "", "User to connect to vCenter")
+	fs.StringVar(&vcenter.Password, "vc-pass", "", "Password to connect to vCenter")
+
+	fs.StringVar(&vcenter.UserSecret, "vc-user-secret-name", "", "Secret file to use for username")
+	fs.StringVar(&vcenter.PasswordSecret, "vc-pass-secret-name", "", "Secret file to use for password")
+
+	fs.StringVar(&opts.vcentersFile, "vcenters", "", "JSON file listing multiple vCenter endpoints to stream events from, replaces -vcenter and the vc-* flags")
+
+	fs.StringVar(&cfg.Stream.CheckpointFile, "checkpoint-file", cfg.Stream.CheckpointFile, "File to persist the last delivered event to, enables replay of missed events on restart")
+
+	fs.IntVar(&cfg.Stream.DedupeSize, "dedupe-size", cfg.Stream.DedupeSize, "Number of recently delivered events remembered to skip duplicates, 0 disables deduplication")
+	fs.StringVar(&cfg.Stream.DedupeFile, "dedupe-file", cfg.Stream.DedupeFile, "File to persist the recently delivered events to, so duplicates are also skipped after a restart")
+
+	fs.StringVar(&opts.replayFrom, "replay-from", "", "Replay events created since this time (RFC3339) before tailing the event stream")
+	fs.StringVar(&opts.replayTo, "replay-to", "", "Replay events created until this time (RFC3339) and exit, requires -replay-from")
+
+	fs.Var(&stringSlice{values: &vcenter.Roots}, "root", "Inventory path or managed object reference (e.g. Datacenter:datacenter-2) to stream events from, can be repeated (default: whole inventory)")
+
+	fs.BoolVar(&cfg.Stream.Tasks, "tasks", cfg.Stream.Tasks, "Publish task lifecycle topics, e.g. task.clone.vm.success, in addition to events")
+	fs.BoolVar(&cfg.Stream.IncludeEventData, "include-event-data", cfg.Stream.IncludeEventData, "Include the complete vSphere event in the data field of the messages")
+	fs.Var(&stringSlice{values: &cfg.Stream.Enrich}, "enrich", "Managed object type and property path to attach to events of such objects (e.g. VirtualMachine:runtime.powerState), can be repeated")
+	fs.DurationVar(&cfg.Stream.EnrichTTL, "enrich-ttl", cfg.Stream.EnrichTTL, "Time properties retrieved for enrichment are cached")
+	fs.Var(&stringSlice{values: &cfg.Stream.WatchProperties}, "watch-property", "Managed object type and property path to publish changes of (e.g. VirtualMachine:guest.ipAddress), can be repeated")
+
+	fs.IntVar(&cfg.Stream.PageSize, "page-size", cfg.Stream.PageSize, "Number of events read from vCenter per page")
+	fs.IntVar(&cfg.Delivery.Workers, "workers", cfg.Delivery.Workers, "Number of concurrent function invocations, events of the same object are always delivered in order")
+	fs.IntVar(&cfg.Delivery.QueueSize, "queue-size", cfg.Delivery.QueueSize, "Maximum number of events waiting for invocation")
+	fs.BoolVar(&cfg.Delivery.DropWhenFull, "drop-when-full", cfg.Delivery.DropWhenFull, "Drop events when the invocation queue is full instead of pausing the event stream")
+	fs.StringVar(&cfg.Delivery.Format, "format", cfg.Delivery.Format, "Message format, either json or cloudevents")
+	fs.StringVar(&cfg.Delivery.CloudEventsMode, "cloudevents-mode", cfg.Delivery.CloudEventsMode, "HTTP content mode of CloudEvents, either structured or binary")
+
+	fs.IntVar(&cfg.Delivery.Retry.Attempts, "retry-attempts", cfg.Delivery.Retry.Attempts, "Maximum number of invocations per message and function, 1 disables retries")
+	fs.Var((*statusCodes)(&cfg.Delivery.Retry.Status), "retry-status", "Comma-delimited HTTP status codes of failed invocations which are retried")
+	fs.DurationVar(&cfg.Delivery.Retry.Backoff, "retry-backoff", cfg.Delivery.Retry.Backoff, "Delay before the first retry, doubled with each retry")
+	fs.DurationVar(&cfg.Delivery.Retry.MaxBackoff, "retry-max-backoff", cfg.Delivery.Retry.MaxBackoff, "Maximum delay between retries")
+	fs.StringVar(&cfg.Delivery.DeadLetterFile, "dead-letter-file", cfg.Delivery.DeadLetterFile, "File to append messages to which could not be delivered after all retries, see the dlq command")
+
+	fs.StringVar(&cfg.Server.ListenAddr, "listen-addr", cfg.Server.ListenAddr, "Address to serve metrics on at /metrics and health on at /healthz and /readyz, empty to disable")
+	fs.DurationVar(&cfg.Server.ReadyMaxEventAge, "ready-max-event-age", cfg.Server.ReadyMaxEventAge, "Report not ready if the event stream of a vCenter Server was not up to date for this long, 0 disables the check")
+
+	fs.StringVar(&cfg.Tracing.Exporter, "trace-exporter", cfg.Tracing.Exporter, "Export trace spans of events and function invocations, either stdout or otlp, empty disables tracing")
+	fs.StringVar(&cfg.Tracing.Endpoint, "trace-endpoint", cfg.Tracing.Endpoint, "OTLP/HTTP endpoint to export trace spans to, see -trace-exporter")
+	fs.Float64Var(&cfg.Tracing.SampleRatio, "trace-sample-ratio", cfg.Tracing.SampleRatio, "Ratio of events between 0 and 1 whose traces are exported, the functions they invoke follow the decision")
+
+	fs.DurationVar(&cfg.Reload.Interval, "reload-interval", cfg.Reload.Interval, "Interval the configuration and secret files are checked for changes at, 0 disables watching them. SIGHUP always reloads")
+
+	fs.BoolVar(&vcenter.Insecure, "insecure", false, "use an insecure connection to vCenter (default false)")
+	if err := fs.Parse(args); err != nil {
+		return cfg, opts, err
+	}
+
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	if len(opts.vcentersFile) > 0 {
+		endpoints, err := readEndpoints(opts.vcentersFile)
+		if err != nil {
+			return cfg, opts, err
+		}
+		cfg.VCenters = endpoints
+	} else if err := applyVCenterFlags(&cfg, vcenter, set); err != nil {
+		return cfg, opts, err
+	}
+
+	return cfg, opts, cfg.Validate()
+}
+
+// newHealthChecker returns a checker reporting the state of the gateway, the
+// topic map and each vCenter session
+func newHealthChecker(controller ofsdk.Controller, sessions []*events.Session, maxEventAge time.Duration) *health.Checker {
+	checker := health.NewChecker(5 * time.Second)
+
+	if hc, ok := controller.(topics.HealthChecker); ok {
+		checker.Add("gateway", hc.Ping)
+		checker.Add("topics", func(ctx context.Context) error {
+			if !hc.Synced() {
+				return fmt.Errorf("topic map not synced yet")
+			}
+			return nil
+		})
+	}
+
+	for _, s := range sessions {
+		s := s
+		checker.Add("vcenter/"+s.Name(), func(ctx context.Context) error {
+			return s.Check(ctx, maxEventAge)
+		})
+	}
+	return checker
+}
+
+// serveHTTP serves the connector's HTTP endpoints, the connector exits if the
+// address cannot be listened on
+func serveHTTP(addr string, handler http.Handler) {
+	logging.Info("serving HTTP", "addr", addr)
+	if err := http.ListenAndServe(addr, handler); err != nil {
+		fatal("could not serve HTTP", "addr", addr, "error", err)
+	}
+}
+
+// readGatewayCredentials reads the OpenFaaS credentials for the connector if
+// basic auth is enabled
+func readGatewayCredentials() (*auth.BasicAuthCredentials, error) {
+	if val, ok := os.LookupEnv("basic_auth"); !ok || (val != "true" && val != "1") {
+		return nil, nil
+	}
+
+	reader := auth.ReadBasicAuthFromDisk{}
+
+	if val, ok := os.LookupEnv("secret_mount_path"); ok && len(val) > 0 {
+		reader.SecretMountPath = os.Getenv("secret_mount_path")
+	}
+
+	credentials, err := reader.Read()
 	if err != nil {
-		log.Fatalf("could not bind events: %v", err)
+		return nil, fmt.Errorf("could not read credentials: %v", err)
+	}
+	return credentials, nil
+}
+
+// makeStreamConfig validates the replay flags and returns the resulting
+// configuration for the event stream
+func makeStreamConfig(replayFrom, replayTo string) (events.StreamConfig, error) {
+	cfg := events.StreamConfig{
+		MinBackoff: time.Second,
+		MaxBackoff: 2 * time.Minute,
+	}
+
+	if len(replayTo) > 0 && len(replayFrom) == 0 {
+		return cfg, fmt.Errorf("-replay-to requires -replay-from")
+	}
+
+	if len(replayFrom) > 0 {
+		from, err := time.Parse(time.RFC3339, replayFrom)
+		if err != nil {
+			return cfg, fmt.Errorf("invalid -replay-from: %v", err)
+		}
+		cfg.ReplayFrom = from
+	}
+
+	if len(replayTo) > 0 {
+		to, err := time.Parse(time.RFC3339, replayTo)
+		if err != nil {
+			return cfg, fmt.Errorf("invalid -replay-to: %v", err)
+		}
+		if !to.After(cfg.ReplayFrom) {
+			return cfg, fmt.Errorf("-replay-to must be after -replay-from")
+		}
+		cfg.ReplayTo = to
+	}
+
+	return cfg, nil
+}
+
+// stringSlice is a flag.Value collecting the values of a repeated flag. The
+// values of the flag replace those of the configuration file
+type stringSlice struct {
+	values *[]string
+	set    bool
+}
+
+func (s *stringSlice) String() string {
+	if s.values == nil {
+		return ""
+	}
+	return strings.Join(*s.values, ",")
+}
+
+func (s *stringSlice) Set(value string) error {
+	if !s.set {
+		*s.values = nil
+		s.set = true
+	}
+	*s.values = append(*s.values, value)
+	return nil
+}
+
+// statusCodes is a flag.Value parsing comma-delimited HTTP status codes
+type statusCodes []int
+
+func (s *statusCodes) String() string {
+	codes := make([]string, len(*s))
+	for i, code := range *s {
+		codes[i] = strconv.Itoa(code)
+	}
+	return strings.Join(codes, ",")
+}
+
+func (s *statusCodes) Set(value string) error {
+	codes, err := topics.ParseStatusCodes(value)
+	if err != nil {
+		return err
+	}
+	*s = codes
+	return nil
+}
+
+// lookupFlag returns the value of the flag in args, e.g. to read the
+// configuration file before the flags are parsed
+func lookupFlag(args []string, name string) string {
+	for i, arg := range args {
+		if arg == "--" {
+			break
+		}
+		arg = strings.TrimPrefix(strings.TrimPrefix(arg, "-"), "-")
+		if arg == name && i+1 < len(args) {
+			return args[i+1]
+		}
+		if strings.HasPrefix(arg, name+"=") {
+			return strings.TrimPrefix(arg, name+"=")
+		}
+	}
+	return ""
+}
+
+// vcenterFlags are the flags configuring a single vCenter Server
+var vcenterFlags = []string{"vcenter", "vc-user", "vc-pass", "vc-user-secret-name", "vc-pass-secret-name", "insecure", "root"}
+
+// applyVCenterFlags applies the flags of a single vCenter Server. Without
+// vCenter Servers in the configuration file the flags configure one, with
+// the default of -vcenter, otherwise the flags which are set override the
+// settings of the only configured vCenter Server
+func applyVCenterFlags(cfg *config.Config, v config.VCenter, set map[string]bool) error {
+	if len(cfg.VCenters) == 0 {
+		if len(v.URL) == 0 {
+			return fmt.Errorf("vcenterURL not provided")
+		}
+		cfg.VCenters = []config.VCenter{v}
+		return nil
+	}
+
+	var used []string
+	for _, name := range vcenterFlags {
+		if set[name] {
+			used = append(used, "-"+name)
+		}
+	}
+	if len(used) == 0 {
+		return nil
+	}
+	if len(cfg.VCenters) > 1 {
+		return fmt.Errorf("%s cannot be used with multiple vCenter Servers in the config file", strings.Join(used, ", "))
+	}
+
+	e := &cfg.VCenters[0]
+	if set["vcenter"] {
+		e.URL = v.URL
+	}
+	if set["vc-user"] || set["vc-user-secret-name"] {
+		e.User, e.UserSecret = v.User, v.UserSecret
+	}
+	if set["vc-pass"] || set["vc-pass-secret-name"] {
+		e.Password, e.PasswordSecret = v.Password, v.PasswordSecret
+	}
+	if set["insecure"] {
+		e.Insecure = v.Insecure
+	}
+	if set["root"] {
+		e.Roots = v.Roots
+	}
+	return nil
+}
+
+// readEndpoints reads and validates the vCenter endpoints file
+func readEndpoints(file string) ([]config.VCenter, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("could not read vCenter endpoints: %v", err)
+	}
+
+	var config struct {
+		VCenters []config.VCenter `json:"vcenters"`
+	}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("could not parse vCenter endpoints %s: %v", file, err)
+	}
+
+	if len(config.VCenters) == 0 {
+		return nil, fmt.Errorf("no vCenter endpoints found in %s", file)
+	}
+
+	names := make(map[string]bool)
+	for i, e := range config.VCenters {
+		if len(e.URL) == 0 {
+			return nil, fmt.Errorf("vCenter endpoint %d in %s: url not provided", i, file)
+		}
+
+		name := e.Name
+		if len(name) == 0 {
+			name = e.URL
+		}
+		if names[name] {
+			return nil, fmt.Errorf("vCenter endpoint %d in %s: duplicate endpoint %s", i, file, name)
+		}
+		names[name] = true
+	}
+
+	return config.VCenters, nil
+}
+
+// endpointCheckpointFile derives a checkpoint file per endpoint from the
+// -checkpoint-file flag, e.g. "checkpoint.json" becomes
+// "checkpoint-vc01.json" for endpoint "vc01"
+func endpointCheckpointFile(file, name string) string {
+	safe := strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || r == '.' || r == '-' || r == '_' {
+			return r
+		}
+		return '_'
+	}, name)
+
+	ext := filepath.Ext(file)
+	return strings.TrimSuffix(file, ext) + "-" + safe + ext
+}
+
+// setupLogging replaces the default logger and routes the standard logger
+// through it
+func setupLogging(level, format string) error {
+	l, err := logging.ParseLevel(level)
+	if err != nil {
+		return fmt.Errorf("invalid -log-level: %v", err)
+	}
+	logger, err := logging.New(os.Stderr, l, format)
+	if err != nil {
+		return fmt.Errorf("invalid -log-format: %v", err)
+	}
+
+	logging.SetDefault(logger)
+	log.SetFlags(0)
+	log.SetOutput(logger.Writer())
+	return nil
+}
+
+// fatal logs an error and exits the connector, for failures once logging is
+// set up
+func fatal(msg string, kv ...interface{}) {
+	logging.Error(msg, kv...)
+	os.Exit(1)
+}
+
+// newTracer returns a tracer for the configured exporter, nil if tracing is
+// disabled
+func newTracer(cfg config.Tracing) (*tracing.Tracer, error) {
+	sampler := tracing.RatioSampler(cfg.SampleRatio)
+	switch cfg.Exporter {
+	case "":
+		return nil, nil
+	case tracing.ExporterStdout:
+		return tracing.NewTracer(tracing.NewWriterExporter(os.Stdout), sampler), nil
+	case tracing.ExporterOTLP:
+		if len(cfg.Endpoint) == 0 {
+			return nil, fmt.Errorf("-trace-endpoint is required for the otlp exporter")
+		}
+		exporter := tracing.NewOTLPExporter(cfg.Endpoint, tracing.Resource("vcenter-connector", ""), nil, 10*time.Second)
+		return tracing.NewTracer(exporter, sampler), nil
+	}
+	return nil, fmt.Errorf("unknown -trace-exporter %q", cfg.Exporter)
+}
+
+// shutdownTracer exports the remaining spans, if tracing is enabled
+func shutdownTracer(t *tracing.Tracer) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := t.Shutdown(ctx); err != nil {
+		logging.Error("error shutting down tracing", "error", err)
 	}
 }
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/openfaas-incubator/vcenter-connector/pkg/config"
+	"github.com/openfaas-incubator/vcenter-connector/pkg/events"
+)
+
+func TestEndpointCheckpointFile(t *testing.T) {
+	var testCases = []struct {
+		file string
+		name string
+		want string
+	}{
+		{"/var/lib/connector/checkpoint.json", "vc01", "/var/lib/connector/checkpoint-vc01.json"},
+		{"/var/lib/connector/checkpoint", "vc01", "/var/lib/connector/checkpoint-vc01"},
+		{"checkpoint.json", "vc01.example.com:443", "checkpoint-vc01.example.com_443.json"},
+	}
+
+	for _, test := range testCases {
+		if got := endpointCheckpointFile(test.file, test.name); got != test.want {
+			t.Errorf("%s: wanted: %v, got: %v", test.name, test.want, got)
+		}
+	}
+}
+
+func TestLookupFlag(t *testing.T) {
+	var testCases = []struct {
+		args []string
+		want string
+	}{
+		{[]string{"-config", "connector.yaml", "-tasks"}, "connector.yaml"},
+		{[]string{"-tasks", "--config=connector.yaml"}, "connector.yaml"},
+		{[]string{"-gateway", "http://gw:8080"}, ""},
+		{[]string{"--", "-config", "connector.yaml"}, ""},
+		{[]string{"-config"}, ""},
+	}
+
+	for _, test := range testCases {
+		if got := lookupFlag(test.args, "config"); got != test.want {
+			t.Errorf("%v: wanted: %v, got: %v", test.args, test.want, got)
+		}
+	}
+}
+
+func TestApplyVCenterFlags(t *testing.T) {
+	flags := config.VCenter{
+		Endpoint: events.Endpoint{URL: "https://vc02/sdk", User: "admin", Insecure: true},
+		Roots:    []string{"dc1"},
+	}
+	configured := config.VCenter{
+		Endpoint:       events.Endpoint{Name: "vc01", URL: "https://vc01/sdk"},
+		UserSecret:     "/secrets/user",
+		PasswordSecret: "/secrets/pass",
+	}
+
+	var testCases = []struct {
+		name       string
+		configured []config.VCenter
+		set        []string
+		want       []config.VCenter
+		wantErr    bool
+	}{
+		{"flags only", nil, nil, []config.VCenter{flags}, false},
+		{"config only", []config.VCenter{configured}, nil, []config.VCenter{configured}, false},
+		{"override", []config.VCenter{configured}, []string{"vc-user", "insecure"}, []config.VCenter{{
+			Endpoint:       events.Endpoint{Name: "vc01", URL: "https://vc01/sdk", User: "admin", Insecure: true},
+			PasswordSecret: "/secrets/pass",
+		}}, false},
+		{"multiple", []config.VCenter{configured, flags}, []string{"root"}, nil, true},
+	}
+
+	for _, test := range testCases {
+		cfg := config.Default()
+		cfg.VCenters = test.configured
+
+		set := make(map[string]bool)
+		for _, name := range test.set {
+			set[name] = true
+		}
+
+		err := applyVCenterFlags(&cfg, flags, set)
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s: wanted error: %v, got: %v", test.name, test.wantErr, err)
+			continue
+		}
+		if err == nil && !reflect.DeepEqual(test.want, cfg.VCenters) {
+			t.Errorf("%s: wanted: %+v, got: %+v", test.name, test.want, cfg.VCenters)
+		}
+	}
+}
+
+func TestLoadDeadLetterConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dlq")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "connector.yaml")
+	data := []byte("version: 1\ngateway:\n  url: http://gateway.openfaas:8080\n  async: false\ndelivery:\n  deadLetterFile: /var/lib/dead-letters.jsonl\n")
+	if err := ioutil.WriteFile(file, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	var testCases = []struct {
+		name        string
+		args        []string
+		environ     []string
+		wantFile    string
+		wantGateway string
+		wantAsync   bool
+		wantTimeout time.Duration
+	}{
+		{"defaults", []string{"-function", "tag-vm"}, nil, "", "http://127.0.0.1:8080", true, 15 * time.Second},
+		{"config file", []string{"-config", file}, nil, "/var/lib/dead-letters.jsonl", "http://gateway.openfaas:8080", false, 15 * time.Second},
+		{"environment", []string{"-config=" + file}, []string{"VCENTER_CONNECTOR_GATEWAY_TIMEOUT=1m"}, "/var/lib/dead-letters.jsonl", "http://gateway.openfaas:8080", false, time.Minute},
+	}
+
+	for _, test := range testCases {
+		cfg, err := loadDeadLetterConfig(test.args, test.environ)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+			continue
+		}
+		if cfg.Delivery.DeadLetterFile != test.wantFile {
+			t.Errorf("%s: file: wanted: %v, got: %v", test.name, test.wantFile, cfg.Delivery.DeadLetterFile)
+		}
+		if cfg.Gateway.URL != test.wantGateway {
+			t.Errorf("%s: gateway: wanted: %v, got: %v", test.name, test.wantGateway, cfg.Gateway.URL)
+		}
+		if cfg.Gateway.Async != test.wantAsync {
+			t.Errorf("%s: async: wanted: %v, got: %v", test.name, test.wantAsync, cfg.Gateway.Async)
+		}
+		if cfg.Gateway.Timeout != test.wantTimeout {
+			t.Errorf("%s: timeout: wanted: %v, got: %v", test.name, test.wantTimeout, cfg.Gateway.Timeout)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package checkpoint
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Checkpoint records the position of the last vCenter event which was
+// successfully handed over to the OpenFaaS controller. On startup the gap
+// between the checkpoint and "now" is replayed from the vCenter event history
+type Checkpoint struct {
+	LastEventKey         int32     `json:"lastEventKey"`
+	LastEventCreatedTime time.Time `json:"lastEventCreatedTime"`
+}
+
+// Store persists and retrieves a Checkpoint. Implementations must be safe for
+// concurrent use
+type Store interface {
+	// Load returns the last saved Checkpoint or nil if none was saved yet
+	Load() (*Checkpoint, error)
+	// Save persists the given Checkpoint, replacing any previous one
+	Save(cp Checkpoint) error
+}
+
+// FileStore is a Store which keeps the Checkpoint as JSON in a local file
+type FileStore struct {
+	path string
+	lock sync.Mutex
+}
+
+// NewFileStore returns a FileStore writing to path. The file and its parent
+// directory are created on the first Save
+func NewFileStore(path string) *FileStore {
+	return &FileStore{
+		path: path,
+	}
+}
+
+// Load reads the Checkpoint from disk, a missing file is not an error
+func (f *FileStore) Load() (*Checkpoint, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	data, err := ioutil.ReadFile(f.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, errors.Wrap(err, "error reading checkpoint file")
+	}
+
+	var cp Checkpoint
+	if err := json.Unmarshal(data, &cp); err != nil {
+		return nil, errors.Wrapf(err, "error parsing checkpoint file %s", f.path)
+	}
+	return &cp, nil
+}
+
+// Save writes the Checkpoint to a temporary file first and renames it
+// afterwards so a crash never leaves a truncated checkpoint behind
+func (f *FileStore) Save(cp Checkpoint) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	data, err := json.Marshal(cp)
+	if err != nil {
+		return errors.Wrap(err, "error marshaling checkpoint")
+	}
+
+	dir := filepath.Dir(f.path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return errors.Wrap(err, "error creating checkpoint directory")
+	}
+
+	tmp, err := ioutil.TempFile(dir, filepath.Base(f.path)+".tmp")
+	if err != nil {
+		return errors.Wrap(err, "error creating temporary checkpoint file")
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return errors.Wrap(err, "error writing checkpoint")
+	}
+	if err := tmp.Close(); err != nil {
+		return errors.Wrap(err, "error writing checkpoint")
+	}
+
+	if err := os.Rename(tmp.Name(), f.path); err != nil {
+		return errors.Wrap(err, "error replacing checkpoint file")
+	}
+	return nil
+}
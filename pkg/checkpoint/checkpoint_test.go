@@ -0,0 +1,45 @@
+package checkpoint
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestFileStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "checkpoint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store := NewFileStore(filepath.Join(dir, "state", "checkpoint.json"))
+
+	// assert that a missing checkpoint file is not an error
+	cp, err := store.Load()
+	if err != nil {
+		t.Fatalf("load without checkpoint: %v", err)
+	}
+	if cp != nil {
+		t.Errorf("load without checkpoint: wanted: nil, got: %v", cp)
+	}
+
+	want := Checkpoint{
+		LastEventKey:         1234,
+		LastEventCreatedTime: time.Date(2019, 11, 4, 10, 0, 0, 0, time.UTC),
+	}
+	if err := store.Save(want); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+
+	cp, err = store.Load()
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if eq := reflect.DeepEqual(&want, cp); !eq {
+		t.Errorf("load: wanted: %v, got: %v", want, cp)
+	}
+}
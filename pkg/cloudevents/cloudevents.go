@@ -0,0 +1,91 @@
+package cloudevents
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// SpecVersion is the version of the CloudEvents specification implemented
+const SpecVersion = "1.0"
+
+// HTTP content modes, see
+// https://github.com/cloudevents/spec/blob/v1.0/http-protocol-binding.md
+const (
+	// ContentModeStructured sends the event attributes and data as a single
+	// JSON document
+	ContentModeStructured = "structured"
+	// ContentModeBinary sends the data as body and the attributes as ce-*
+	// headers
+	ContentModeBinary = "binary"
+)
+
+// contentTypeStructured is the media type of a structured JSON CloudEvent
+const contentTypeStructured = "application/cloudevents+json"
+
+// Event is a CloudEvent with JSON data
+type Event struct {
+	ID              string          `json:"id"`
+	Source          string          `json:"source"`
+	SpecVersion     string          `json:"specversion"`
+	Type            string          `json:"type"`
+	DataContentType string          `json:"datacontenttype,omitempty"`
+	Subject         string          `json:"subject,omitempty"`
+	Time            *time.Time      `json:"time,omitempty"`
+	Data            json.RawMessage `json:"data,omitempty"`
+}
+
+// New returns an Event with the given attributes and JSON data
+func New(id, source, eventType, subject string, t time.Time, data []byte) Event {
+	e := Event{
+		ID:              id,
+		Source:          source,
+		SpecVersion:     SpecVersion,
+		Type:            eventType,
+		DataContentType: "application/json",
+		Subject:         subject,
+		Data:            data,
+	}
+	if !t.IsZero() {
+		utc := t.UTC()
+		e.Time = &utc
+	}
+	return e
+}
+
+// Encode returns the HTTP headers and body of the event in the given content
+// mode
+func (e Event) Encode(mode string) (http.Header, []byte, error) {
+	switch mode {
+	case ContentModeStructured:
+		body, err := json.Marshal(e)
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "error marshaling cloudevent")
+		}
+
+		header := make(http.Header)
+		header.Set("Content-Type", contentTypeStructured)
+		return header, body, nil
+
+	case ContentModeBinary:
+		header := make(http.Header)
+		header.Set("ce-id", e.ID)
+		header.Set("ce-source", e.Source)
+		header.Set("ce-specversion", e.SpecVersion)
+		header.Set("ce-type", e.Type)
+		if len(e.Subject) > 0 {
+			header.Set("ce-subject", e.Subject)
+		}
+		if e.Time != nil {
+			header.Set("ce-time", e.Time.Format(time.RFC3339Nano))
+		}
+		if len(e.DataContentType) > 0 {
+			header.Set("Content-Type", e.DataContentType)
+		}
+		return header, e.Data, nil
+	}
+
+	return nil, nil, errors.Errorf("unknown content mode %q", mode)
+}
@@ -0,0 +1,72 @@
+package cloudevents
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestEncode(t *testing.T) {
+	created := time.Date(2019, 11, 4, 10, 0, 0, 0, time.UTC)
+	data := []byte(`{"topic":"vm.powered.on"}`)
+	e := New("42", "https://vc01.example.com/sdk", "vm.powered.on", "VirtualMachine:vm-42", created, data)
+
+	// structured mode carries the attributes and the data in the body
+	header, body, err := e.Encode(ContentModeStructured)
+	if err != nil {
+		t.Fatalf("structured: %v", err)
+	}
+	if got := header.Get("Content-Type"); got != "application/cloudevents+json" {
+		t.Errorf("structured content type: wanted: %v, got: %v", "application/cloudevents+json", got)
+	}
+
+	var got map[string]interface{}
+	if err := json.Unmarshal(body, &got); err != nil {
+		t.Fatalf("structured: %v", err)
+	}
+	want := map[string]interface{}{
+		"id":              "42",
+		"source":          "https://vc01.example.com/sdk",
+		"specversion":     "1.0",
+		"type":            "vm.powered.on",
+		"datacontenttype": "application/json",
+		"subject":         "VirtualMachine:vm-42",
+		"time":            "2019-11-04T10:00:00Z",
+		"data":            map[string]interface{}{"topic": "vm.powered.on"},
+	}
+	if eq := reflect.DeepEqual(want, got); !eq {
+		t.Errorf("structured body: wanted: %v, got: %v", want, got)
+	}
+
+	// binary mode carries the attributes as headers and the data as body
+	header, body, err = e.Encode(ContentModeBinary)
+	if err != nil {
+		t.Fatalf("binary: %v", err)
+	}
+	if string(body) != string(data) {
+		t.Errorf("binary body: wanted: %s, got: %s", data, body)
+	}
+
+	var testCases = []struct {
+		header string
+		want   string
+	}{
+		{"ce-id", "42"},
+		{"ce-source", "https://vc01.example.com/sdk"},
+		{"ce-specversion", "1.0"},
+		{"ce-type", "vm.powered.on"},
+		{"ce-subject", "VirtualMachine:vm-42"},
+		{"ce-time", "2019-11-04T10:00:00Z"},
+		{"Content-Type", "application/json"},
+	}
+	for _, test := range testCases {
+		if got := header.Get(test.header); got != test.want {
+			t.Errorf("binary header %s: wanted: %v, got: %v", test.header, test.want, got)
+		}
+	}
+
+	if _, _, err := e.Encode("batch"); err == nil {
+		t.Errorf("unknown mode: wanted error, got: nil")
+	}
+}
@@ -0,0 +1,620 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/openfaas-incubator/vcenter-connector/pkg/cloudevents"
+	"github.com/openfaas-incubator/vcenter-connector/pkg/events"
+	"github.com/openfaas-incubator/vcenter-connector/pkg/filter"
+	"github.com/openfaas-incubator/vcenter-connector/pkg/logging"
+	"github.com/openfaas-incubator/vcenter-connector/pkg/topics"
+	"github.com/openfaas-incubator/vcenter-connector/pkg/tracing"
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+// Version is the version of the configuration file format
+const Version = 1
+
+// EnvPrefix is the prefix of the environment variables overriding the
+// configuration, e.g. VCENTER_CONNECTOR_GATEWAY_URL for gateway.url
+const EnvPrefix = "VCENTER_CONNECTOR_"
+
+// Config holds all settings of the connector
+type Config struct {
+	// Version is the version of the file format, see Version
+	Version int `yaml:"version"`
+
+	Gateway  Gateway   `yaml:"gateway"`
+	VCenters []VCenter `yaml:"vcenters"`
+	Stream   Stream    `yaml:"stream"`
+	Delivery Delivery  `yaml:"delivery"`
+
+	// Filters maps function names to the filter expression of functions
+	// without a vcenter.filter annotation, see topics.Settings
+	Filters map[string]string `yaml:"filters"`
+
+	Server  Server  `yaml:"server"`
+	Logging Logging `yaml:"logging"`
+	Tracing Tracing `yaml:"tracing"`
+	Reload  Reload  `yaml:"reload"`
+}
+
+// Gateway configures the connection to the OpenFaaS gateway
+type Gateway struct {
+	URL string `yaml:"url"`
+	// Timeout is the timeout of function invocations
+	Timeout time.Duration `yaml:"timeout"`
+	// Async invokes functions asynchronously, so long-running functions do
+	// not block the connector
+	Async bool `yaml:"async"`
+	// RebuildInterval is the interval the subscriptions are read at
+	RebuildInterval time.Duration `yaml:"rebuildInterval"`
+	// TopicDelimiter separates the topics of the topic annotation
+	TopicDelimiter string `yaml:"topicDelimiter"`
+}
+
+// VCenter is a vCenter Server to stream events from. It is also the format of
+// the entries of the -vcenters file
+type VCenter struct {
+	// Endpoint holds the name, URL, credentials and TLS settings
+	events.Endpoint `yaml:",inline"`
+
+	// UserSecret and PasswordSecret name secrets to read the credentials from,
+	// files in the secret_mount_path directory, see -vc-user-secret-name and
+	// -vc-pass-secret-name
+	UserSecret     string `json:"userSecret" yaml:"userSecret"`
+	PasswordSecret string `json:"passwordSecret" yaml:"passwordSecret"`
+
+	// Roots and CheckpointFile are the per endpoint equivalents of -root and
+	// -checkpoint-file
+	Roots          []string `json:"roots" yaml:"roots"`
+	CheckpointFile string   `json:"checkpointFile" yaml:"checkpointFile"`
+}
+
+// Stream configures how events are read from vCenter
+type Stream struct {
+	PageSize         int           `yaml:"pageSize"`
+	CheckpointFile   string        `yaml:"checkpointFile"`
+	DedupeSize       int           `yaml:"dedupeSize"`
+	DedupeFile       string        `yaml:"dedupeFile"`
+	Tasks            bool          `yaml:"tasks"`
+	IncludeEventData bool          `yaml:"includeEventData"`
+	Enrich           []string      `yaml:"enrich"`
+	EnrichTTL        time.Duration `yaml:"enrichTTL"`
+	WatchProperties  []string      `yaml:"watchProperties"`
+	// MinBackoff and MaxBackoff bound the delay between reconnects
+	MinBackoff time.Duration `yaml:"minBackoff"`
+	MaxBackoff time.Duration `yaml:"maxBackoff"`
+}
+
+// Delivery configures how messages are handed over to functions
+type Delivery struct {
+	Workers         int    `yaml:"workers"`
+	QueueSize       int    `yaml:"queueSize"`
+	DropWhenFull    bool   `yaml:"dropWhenFull"`
+	Format          string `yaml:"format"`
+	CloudEventsMode string `yaml:"cloudEventsMode"`
+	Retry           Retry  `yaml:"retry"`
+	DeadLetterFile  string `yaml:"deadLetterFile"`
+}
+
+// Retry is the default retry policy, see topics.RetryPolicy
+type Retry struct {
+	Attempts   int           `yaml:"attempts"`
+	Status     []int         `yaml:"status"`
+	Backoff    time.Duration `yaml:"backoff"`
+	MaxBackoff time.Duration `yaml:"maxBackoff"`
+}
+
+// Server configures the HTTP server for metrics and health
+type Server struct {
+	ListenAddr       string        `yaml:"listenAddr"`
+	ReadyMaxEventAge time.Duration `yaml:"readyMaxEventAge"`
+}
+
+// Logging configures the log output
+type Logging struct {
+	Level  string `yaml:"level"`
+	Format string `yaml:"format"`
+}
+
+// Tracing configures the export of trace spans
+type Tracing struct {
+	Exporter string `yaml:"exporter"`
+	Endpoint string `yaml:"endpoint"`
+	// SampleRatio is the ratio of events whose traces are exported, between
+	// 0 and 1
+	SampleRatio float64 `yaml:"sampleRatio"`
+}
+
+// Reload configures how changes of the configuration and secret files are
+// picked up
+type Reload struct {
+	// Interval is the interval the files are checked for changes at, 0
+	// disables watching them
+	Interval time.Duration `yaml:"interval"`
+}
+
+// Default returns the default configuration, without vCenter Servers
+func Default() Config {
+	return Config{
+		Version: Version,
+		Gateway: Gateway{
+			URL:             "http://127.0.0.1:8080",
+			Timeout:         15 * time.Second,
+			Async:           true,
+			RebuildInterval: 10 * time.Second,
+			TopicDelimiter:  ",",
+		},
+		Stream: Stream{
+			PageSize:   1,
+			DedupeSize: 10000,
+			EnrichTTL:  30 * time.Second,
+			MinBackoff: time.Second,
+			MaxBackoff: 2 * time.Minute,
+		},
+		Delivery: Delivery{
+			Workers:         4,
+			QueueSize:       1000,
+			Format:          events.FormatJSON,
+			CloudEventsMode: cloudevents.ContentModeStructured,
+			Retry: Retry{
+				Attempts:   3,
+				Status:     []int{429, 502, 503, 504},
+				Backoff:    time.Second,
+				MaxBackoff: 30 * time.Second,
+			},
+		},
+		Server: Server{
+			ListenAddr:       ":8081",
+			ReadyMaxEventAge: 15 * time.Minute,
+		},
+		Logging: Logging{
+			Level:  "info",
+			Format: logging.FormatLogfmt,
+		},
+		Tracing: Tracing{
+			Endpoint:    tracing.DefaultOTLPEndpoint,
+			SampleRatio: 1,
+		},
+		Reload: Reload{
+			Interval: 10 * time.Second,
+		},
+	}
+}
+
+// Load reads the configuration file onto cfg, settings missing in the file
+// keep their value
+func Load(file string, cfg *Config) error {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return errors.Wrap(err, "could not read config file")
+	}
+	return errors.Wrapf(Parse(data, cfg), "could not parse config file %s", file)
+}
+
+// Parse parses the YAML configuration onto cfg. Unknown and duplicate keys
+// are an error
+func Parse(data []byte, cfg *Config) error {
+	// check the version first, a newer format must not be read partially
+	var header struct {
+		Version *int                   `yaml:"version"`
+		Filters map[string]interface{} `yaml:"filters"`
+	}
+	if err := yaml.Unmarshal(data, &header); err != nil {
+		return err
+	}
+	if header.Version == nil {
+		return errors.New("version is required")
+	}
+	if *header.Version != Version {
+		return errors.Errorf("unsupported version %d, expected %d", *header.Version, Version)
+	}
+
+	// lists and maps of the file, e.g. the vCenter Servers, replace those of
+	// cfg rather than being merged
+	c := *cfg
+	if header.Filters != nil {
+		c.Filters = nil
+	}
+	if err := yaml.UnmarshalStrict(data, &c); err != nil {
+		return err
+	}
+	*cfg = c
+	return nil
+}
+
+// ApplyEnv overrides the configuration with the environment variables named
+// after the keys with EnvPrefix, e.g. VCENTER_CONNECTOR_DELIVERY_RETRY_ATTEMPTS
+// for delivery.retry.attempts. Lists are comma-delimited. Settings of vCenter
+// Servers use their index, e.g. VCENTER_CONNECTOR_VCENTERS_0_PASSWORD.
+// Filters are set with VCENTER_CONNECTOR_FILTERS_<FUNCTION>, where the
+// function name is upper case with - and . replaced by _. Names of functions
+// without a filter in cfg are lower case with _ replaced by -. Kubernetes
+// service links of a service named vcenter-connector, e.g.
+// VCENTER_CONNECTOR_SERVICE_HOST, are skipped and other unknown variables are
+// logged and ignored
+func ApplyEnv(cfg *Config, environ []string) error {
+	env := make(map[string]string)
+	for _, kv := range environ {
+		if i := strings.IndexByte(kv, '='); i > 0 && strings.HasPrefix(kv, EnvPrefix) && !isServiceLink(kv[:i]) {
+			env[kv[:i]] = kv[i+1:]
+		}
+	}
+	if len(env) == 0 {
+		return nil
+	}
+
+	known := make(map[string]bool)
+	if err := applyEnv(reflect.ValueOf(cfg).Elem(), strings.TrimSuffix(EnvPrefix, "_"), env, known); err != nil {
+		return err
+	}
+
+	prefix := EnvPrefix + "FILTERS_"
+	for name, value := range env {
+		if known[name] || !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		fn := strings.TrimPrefix(name, prefix)
+		for key := range cfg.Filters {
+			if envName(key) == fn {
+				fn = key
+				break
+			}
+		}
+		if cfg.Filters == nil {
+			cfg.Filters = make(map[string]string)
+		}
+		if fn == strings.TrimPrefix(name, prefix) {
+			fn = strings.Replace(strings.ToLower(fn), "_", "-", -1)
+		}
+		cfg.Filters[fn] = value
+		known[name] = true
+	}
+
+	var unknown []string
+	for name := range env {
+		if !known[name] {
+			unknown = append(unknown, name)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		logging.Warn("ignoring unknown environment variables", "variables", strings.Join(unknown, ","))
+	}
+	return nil
+}
+
+// isServiceLink returns true if the environment variable is one Kubernetes
+// sets for a service named like EnvPrefix, e.g.
+// VCENTER_CONNECTOR_SERVICE_PORT or VCENTER_CONNECTOR_PORT_8081_TCP_ADDR
+func isServiceLink(name string) bool {
+	name = strings.TrimPrefix(name, EnvPrefix)
+	return name == "SERVICE_HOST" || name == "SERVICE_PORT" || strings.HasPrefix(name, "SERVICE_PORT_") ||
+		name == "PORT" || strings.HasPrefix(name, "PORT_")
+}
+
+func applyEnv(v reflect.Value, name string, env map[string]string, known map[string]bool) error {
+	switch {
+	case v.Kind() == reflect.Struct:
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if f.Anonymous && f.Type.Kind() == reflect.Struct {
+				if err := applyEnv(v.Field(i), name, env, known); err != nil {
+					return err
+				}
+				continue
+			}
+			if key := fieldKey(f); len(key) > 0 {
+				if err := applyEnv(v.Field(i), name+"_"+envName(key), env, known); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+
+	case v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Struct:
+		for i := 0; i < v.Len(); i++ {
+			if err := applyEnv(v.Index(i), fmt.Sprintf("%s_%d", name, i), env, known); err != nil {
+				return err
+			}
+		}
+		return nil
+
+	case v.Kind() == reflect.Map:
+		// see ApplyEnv
+		return nil
+	}
+
+	value, ok := env[name]
+	if !ok {
+		return nil
+	}
+	known[name] = true
+
+	if v.Kind() == reflect.Slice {
+		var items []string
+		for _, s := range strings.Split(value, ",") {
+			if s = strings.TrimSpace(s); len(s) > 0 {
+				items = append(items, s)
+			}
+		}
+		s := reflect.MakeSlice(v.Type(), len(items), len(items))
+		for i, item := range items {
+			if err := setScalar(s.Index(i), item); err != nil {
+				return errors.Wrap(err, name)
+			}
+		}
+		v.Set(s)
+		return nil
+	}
+	return errors.Wrap(setScalar(v, value), name)
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// setScalar parses the value of an environment variable into v
+func setScalar(v reflect.Value, value string) error {
+	if v.Type() == durationType {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return errors.Errorf("invalid duration %q", value)
+		}
+		v.SetInt(int64(d))
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(value)
+	case reflect.Bool:
+		switch value {
+		case "true", "True", "TRUE":
+			v.SetBool(true)
+		case "false", "False", "FALSE":
+			v.SetBool(false)
+		default:
+			return errors.Errorf("invalid boolean %q", value)
+		}
+	case reflect.Int, reflect.Int32, reflect.Int64:
+		i, err := strconv.ParseInt(value, 10, v.Type().Bits())
+		if err != nil {
+			return errors.Errorf("invalid integer %q", value)
+		}
+		v.SetInt(i)
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return errors.Errorf("invalid number %q", value)
+		}
+		v.SetFloat(f)
+	default:
+		return errors.Errorf("unsupported type %s", v.Type())
+	}
+	return nil
+}
+
+// structFields returns the settable fields of a struct by their key in the
+// configuration file. Embedded structs are inlined
+func structFields(v reflect.Value) map[string]reflect.Value {
+	fields := make(map[string]reflect.Value)
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.Anonymous && f.Type.Kind() == reflect.Struct {
+			for k, fv := range structFields(v.Field(i)) {
+				fields[k] = fv
+			}
+			continue
+		}
+		if key := fieldKey(f); len(key) > 0 {
+			fields[key] = v.Field(i)
+		}
+	}
+	return fields
+}
+
+// fieldKey returns the key of the field like yaml.v2, the name of its yaml
+// tag or else its lower case name. It is empty for fields which are skipped
+func fieldKey(f reflect.StructField) string {
+	if len(f.PkgPath) > 0 {
+		// unexported
+		return ""
+	}
+	name := strings.Split(f.Tag.Get("yaml"), ",")[0]
+	if name == "-" {
+		return ""
+	}
+	if len(name) == 0 {
+		return strings.ToLower(f.Name)
+	}
+	return name
+}
+
+func join(path, key string) string {
+	if len(path) == 0 {
+		return key
+	}
+	return path + "." + key
+}
+
+// envName converts a key to the name used in environment variables, e.g.
+// "rebuildInterval" to "REBUILD_INTERVAL"
+func envName(key string) string {
+	var b strings.Builder
+	for i, r := range key {
+		switch {
+		case r == '-' || r == '.':
+			b.WriteRune('_')
+		case unicode.IsUpper(r) && i > 0 && !unicode.IsUpper(rune(key[i-1])):
+			b.WriteRune('_')
+			b.WriteRune(r)
+		default:
+			b.WriteRune(unicode.ToUpper(r))
+		}
+	}
+	return b.String()
+}
+
+// Validate checks the configuration and reports all problems at once
+func (c *Config) Validate() error {
+	var problems []string
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			problems = append(problems, fmt.Sprintf(format, args...))
+		}
+	}
+
+	check(c.Version == Version, "version: unsupported version %d, expected %d", c.Version, Version)
+
+	u, err := url.Parse(c.Gateway.URL)
+	check(err == nil && (u.Scheme == "http" || u.Scheme == "https") && len(u.Host) > 0, "gateway.url: invalid URL %q", c.Gateway.URL)
+	check(c.Gateway.Timeout > 0, "gateway.timeout: must be positive")
+	check(c.Gateway.RebuildInterval > 0, "gateway.rebuildInterval: must be positive")
+	check(len(c.Gateway.TopicDelimiter) > 0, "gateway.topicDelimiter: must not be empty")
+
+	check(len(c.VCenters) > 0, "vcenters: at least one vCenter Server is required")
+	names := make(map[string]bool)
+	for i, v := range c.VCenters {
+		u, err := url.Parse(v.URL)
+		check(err == nil && len(u.Host) > 0, "vcenters[%d].url: invalid URL %q", i, v.URL)
+
+		name := v.Name
+		if len(name) == 0 {
+			name = v.URL
+		}
+		check(!names[name], "vcenters[%d]: duplicate vCenter Server %s", i, name)
+		names[name] = true
+
+		check(len(v.User) == 0 || len(v.UserSecret) == 0, "vcenters[%d]: user and userSecret are mutually exclusive", i)
+		check(len(v.Password) == 0 || len(v.PasswordSecret) == 0, "vcenters[%d]: password and passwordSecret are mutually exclusive", i)
+		check(!v.Insecure || len(v.CAFile) == 0, "vcenters[%d]: insecure and caFile are mutually exclusive", i)
+	}
+
+	s := c.Stream
+	check(s.PageSize >= 1, "stream.pageSize: must be at least 1")
+	check(s.DedupeSize >= 0, "stream.dedupeSize: must not be negative")
+	check(s.DedupeSize > 0 || len(s.DedupeFile) == 0, "stream.dedupeFile: requires stream.dedupeSize greater than 0")
+	check(s.EnrichTTL >= 0, "stream.enrichTTL: must not be negative")
+	check(s.MinBackoff > 0 && s.MaxBackoff >= s.MinBackoff, "stream.minBackoff, stream.maxBackoff: must be positive with maxBackoff at least minBackoff")
+	for i, p := range s.Enrich {
+		err := events.ParseTypeProperty(make(map[string][]string), p)
+		check(err == nil, "stream.enrich[%d]: %v", i, err)
+	}
+	for i, p := range s.WatchProperties {
+		err := events.ParseTypeProperty(make(map[string][]string), p)
+		check(err == nil, "stream.watchProperties[%d]: %v", i, err)
+	}
+
+	d := c.Delivery
+	check(d.Workers >= 1, "delivery.workers: must be at least 1")
+	check(d.QueueSize >= 1, "delivery.queueSize: must be at least 1")
+	check(d.Format == events.FormatJSON || d.Format == events.FormatCloudEvents, "delivery.format: must be %s or %s", events.FormatJSON, events.FormatCloudEvents)
+	check(d.CloudEventsMode == cloudevents.ContentModeStructured || d.CloudEventsMode == cloudevents.ContentModeBinary,
+		"delivery.cloudEventsMode: must be %s or %s", cloudevents.ContentModeStructured, cloudevents.ContentModeBinary)
+	check(d.Retry.Attempts >= 0, "delivery.retry.attempts: must not be negative")
+	for i, code := range d.Retry.Status {
+		check(code >= 100 && code <= 599, "delivery.retry.status[%d]: invalid status code %d", i, code)
+	}
+	check(d.Retry.Backoff >= 0 && d.Retry.MaxBackoff >= 0, "delivery.retry: backoffs must not be negative")
+
+	fns := make([]string, 0, len(c.Filters))
+	for fn := range c.Filters {
+		fns = append(fns, fn)
+	}
+	sort.Strings(fns)
+	for _, fn := range fns {
+		_, err := filter.Parse(c.Filters[fn])
+		check(err == nil, "filters.%s: %v", fn, err)
+	}
+
+	_, err = logging.ParseLevel(c.Logging.Level)
+	check(err == nil, "logging.level: %v", err)
+	check(c.Logging.Format == logging.FormatLogfmt || c.Logging.Format == logging.FormatJSON, "logging.format: must be %s or %s", logging.FormatLogfmt, logging.FormatJSON)
+
+	switch c.Tracing.Exporter {
+	case "", tracing.ExporterStdout:
+	case tracing.ExporterOTLP:
+		u, err := url.Parse(c.Tracing.Endpoint)
+		check(err == nil && len(u.Host) > 0, "tracing.endpoint: invalid URL %q", c.Tracing.Endpoint)
+	default:
+		check(false, "tracing.exporter: must be empty, %s or %s", tracing.ExporterStdout, tracing.ExporterOTLP)
+	}
+	check(c.Tracing.SampleRatio >= 0 && c.Tracing.SampleRatio <= 1, "tracing.sampleRatio: must be between 0 and 1")
+
+	check(c.Reload.Interval >= 0, "reload.interval: must not be negative")
+
+	if len(problems) > 0 {
+		return errors.Errorf("invalid configuration:\n  %s", strings.Join(problems, "\n  "))
+	}
+	return nil
+}
+
+// Settings returns the delivery defaults of the controller
+func (c *Config) Settings() (topics.Settings, error) {
+	s := topics.Settings{
+		TopicDelimiter: c.Gateway.TopicDelimiter,
+		Retry: topics.RetryPolicy{
+			Attempts:   c.Delivery.Retry.Attempts,
+			Status:     c.Delivery.Retry.Status,
+			Backoff:    c.Delivery.Retry.Backoff,
+			MaxBackoff: c.Delivery.Retry.MaxBackoff,
+		},
+		Timeout: c.Gateway.Timeout,
+	}
+
+	if len(c.Filters) > 0 {
+		s.Filters = make(map[string]*filter.Expr, len(c.Filters))
+		for fn, expr := range c.Filters {
+			f, err := filter.Parse(expr)
+			if err != nil {
+				return s, errors.Wrapf(err, "invalid filter of %s", fn)
+			}
+			s.Filters[fn] = f
+		}
+	}
+	return s, nil
+}
+
+// Diff returns the keys of the settings which differ between a and b, e.g.
+// gateway.url or vcenters[0].passwordSecret. Lists of vCenter Servers are
+// compared per entry if their length is the same
+func Diff(a, b Config) []string {
+	var keys []string
+	diff(reflect.ValueOf(a), reflect.ValueOf(b), "", &keys)
+	return keys
+}
+
+func diff(a, b reflect.Value, path string, keys *[]string) {
+	switch {
+	case a.Kind() == reflect.Struct:
+		fields := structFields(a)
+		other := structFields(b)
+		names := make([]string, 0, len(fields))
+		for key := range fields {
+			names = append(names, key)
+		}
+		sort.Strings(names)
+		for _, key := range names {
+			diff(fields[key], other[key], join(path, key), keys)
+		}
+	case a.Kind() == reflect.Slice && a.Type().Elem().Kind() == reflect.Struct && a.Len() == b.Len():
+		for i := 0; i < a.Len(); i++ {
+			diff(a.Index(i), b.Index(i), fmt.Sprintf("%s[%d]", path, i), keys)
+		}
+	case (a.Kind() == reflect.Slice || a.Kind() == reflect.Map) && a.Len() == 0 && b.Len() == 0:
+		// nil and empty are the same
+	case !reflect.DeepEqual(a.Interface(), b.Interface()):
+		*keys = append(*keys, path)
+	}
+}
@@ -0,0 +1,336 @@
+package config
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/openfaas-incubator/vcenter-connector/pkg/events"
+)
+
+const example = `version: 1
+gateway:
+  url: http://gateway.openfaas:8080
+  timeout: 30s
+  async: false
+vcenters:
+  - name: vc01
+    url: https://vc01.local/sdk
+    userSecret: vc01-username
+    passwordSecret: vc01-password
+    caFile: /etc/vcenter/ca.pem
+    roots: [Datacenter:datacenter-2]
+stream:
+  pageSize: 100
+  enrich:
+    - VirtualMachine:runtime.powerState
+delivery:
+  workers: 8
+  retry:
+    status: [502, 503]
+filters:
+  power-alert: category == "error"
+`
+
+func TestParse(t *testing.T) {
+	cfg := Default()
+	if err := Parse([]byte(example), &cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	want := Default()
+	want.Gateway.URL = "http://gateway.openfaas:8080"
+	want.Gateway.Timeout = 30 * time.Second
+	want.Gateway.Async = false
+	want.VCenters = []VCenter{{
+		Endpoint: events.Endpoint{
+			Name:   "vc01",
+			URL:    "https://vc01.local/sdk",
+			CAFile: "/etc/vcenter/ca.pem",
+		},
+		UserSecret:     "vc01-username",
+		PasswordSecret: "vc01-password",
+		Roots:          []string{"Datacenter:datacenter-2"},
+	}}
+	want.Stream.PageSize = 100
+	want.Stream.Enrich = []string{"VirtualMachine:runtime.powerState"}
+	want.Delivery.Workers = 8
+	want.Delivery.Retry.Status = []int{502, 503}
+	want.Filters = map[string]string{"power-alert": `category == "error"`}
+
+	if !reflect.DeepEqual(want, cfg) {
+		t.Errorf("wanted: %+v, got: %+v", want, cfg)
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("validate: unexpected error: %v", err)
+	}
+}
+
+func TestParseVersion(t *testing.T) {
+	var testCases = []struct {
+		name string
+		src  string
+		want string
+	}{
+		{"missing", "gateway:\n  url: http://gw:8080\n", "version is required"},
+		{"empty", "# nothing\n", "version is required"},
+		{"newer", "version: 2\n", "unsupported version 2, expected 1"},
+	}
+
+	for _, test := range testCases {
+		cfg := Default()
+		err := Parse([]byte(test.src), &cfg)
+		if err == nil || err.Error() != test.want {
+			t.Errorf("%s: wanted error: %s, got: %v", test.name, test.want, err)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	var testCases = []struct {
+		name string
+		src  string
+		want string
+	}{
+		{"unknown key", "version: 1\ngateway:\n  ulr: http://gw:8080\n", "line 3: field ulr not found"},
+		{"duplicate key", "version: 1\nlogging:\n  level: info\n  level: debug\n", "line 4: field level already set"},
+		{"invalid value", "version: 1\ndelivery:\n  workers: many\n", "line 3: cannot unmarshal !!str `many` into int"},
+		{"invalid duration", "version: 1\ngateway:\n  timeout: 30 seconds\n", "line 3: cannot unmarshal !!str `30 seconds` into time.Duration"},
+	}
+
+	for _, test := range testCases {
+		cfg := Default()
+		err := Parse([]byte(test.src), &cfg)
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%s: wanted error: %s, got: %v", test.name, test.want, err)
+		}
+	}
+}
+
+func TestParseReplacesLists(t *testing.T) {
+	cfg := Default()
+	cfg.VCenters = []VCenter{{Endpoint: events.Endpoint{URL: "https://vc01/sdk"}}, {Endpoint: events.Endpoint{URL: "https://vc02/sdk"}}}
+	cfg.Filters = map[string]string{"fn1": `category == "info"`}
+
+	src := "version: 1\nvcenters:\n  - url: https://vc03/sdk\nfilters:\n  fn2: category == \"error\"\n"
+	if err := Parse([]byte(src), &cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	wantVCenters := []VCenter{{Endpoint: events.Endpoint{URL: "https://vc03/sdk"}}}
+	if !reflect.DeepEqual(wantVCenters, cfg.VCenters) {
+		t.Errorf("vcenters: wanted: %+v, got: %+v", wantVCenters, cfg.VCenters)
+	}
+	wantFilters := map[string]string{"fn2": `category == "error"`}
+	if !reflect.DeepEqual(wantFilters, cfg.Filters) {
+		t.Errorf("filters: wanted: %v, got: %v", wantFilters, cfg.Filters)
+	}
+}
+
+func TestApplyEnv(t *testing.T) {
+	cfg := Default()
+	cfg.VCenters = []VCenter{{Endpoint: events.Endpoint{URL: "https://vc01/sdk"}}}
+	cfg.Filters = map[string]string{"power-alert": `category == "info"`}
+
+	err := ApplyEnv(&cfg, []string{
+		"HOME=/root",
+		"VCENTER_CONNECTOR_SERVICE_HOST=10.0.0.1",
+		"VCENTER_CONNECTOR_SERVICE_PORT=8081",
+		"VCENTER_CONNECTOR_SERVICE_PORT_HTTP=8081",
+		"VCENTER_CONNECTOR_PORT=tcp://10.0.0.1:8081",
+		"VCENTER_CONNECTOR_PORT_8081_TCP_ADDR=10.0.0.1",
+		"VCENTER_CONNECTOR_GATEWAY_ULR=http://gw",
+		"VCENTER_CONNECTOR_GATEWAY_URL=http://gw:8080",
+		"VCENTER_CONNECTOR_GATEWAY_REBUILD_INTERVAL=1m",
+		"VCENTER_CONNECTOR_DELIVERY_RETRY_STATUS=500, 502",
+		"VCENTER_CONNECTOR_STREAM_ENRICH_TTL=5s",
+		"VCENTER_CONNECTOR_VCENTERS_0_PASSWORD=secret",
+		"VCENTER_CONNECTOR_VCENTERS_0_INSECURE=true",
+		"VCENTER_CONNECTOR_FILTERS_POWER_ALERT=category == \"error\"",
+		"VCENTER_CONNECTOR_FILTERS_TAG_VM=category == \"warning\"",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := Default()
+	want.Gateway.URL = "http://gw:8080"
+	want.Gateway.RebuildInterval = time.Minute
+	want.Delivery.Retry.Status = []int{500, 502}
+	want.Stream.EnrichTTL = 5 * time.Second
+	want.VCenters = []VCenter{{Endpoint: events.Endpoint{URL: "https://vc01/sdk", Password: "secret", Insecure: true}}}
+	want.Filters = map[string]string{"power-alert": `category == "error"`, "tag-vm": `category == "warning"`}
+
+	if !reflect.DeepEqual(want, cfg) {
+		t.Errorf("wanted: %+v, got: %+v", want, cfg)
+	}
+
+	var errorCases = []struct {
+		name string
+		env  string
+		want string
+	}{
+		{"invalid", "VCENTER_CONNECTOR_DELIVERY_WORKERS=many", `VCENTER_CONNECTOR_DELIVERY_WORKERS: invalid integer "many"`},
+	}
+	for _, test := range errorCases {
+		cfg := Default()
+		err := ApplyEnv(&cfg, []string{test.env})
+		if err == nil || err.Error() != test.want {
+			t.Errorf("%s: wanted error: %s, got: %v", test.name, test.want, err)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	valid := func() Config {
+		cfg := Default()
+		cfg.VCenters = []VCenter{{Endpoint: events.Endpoint{URL: "https://vc01/sdk"}}}
+		return cfg
+	}
+
+	var testCases = []struct {
+		name   string
+		modify func(*Config)
+		want   []string
+	}{
+		{"valid", func(*Config) {}, nil},
+		{"no vCenter", func(c *Config) { c.VCenters = nil }, []string{"vcenters: at least one"}},
+		{"vCenters", func(c *Config) {
+			c.VCenters = append(c.VCenters, VCenter{
+				Endpoint:   events.Endpoint{URL: "https://vc01/sdk", User: "admin", Insecure: true, CAFile: "ca.pem"},
+				UserSecret: "user",
+			})
+		}, []string{
+			"vcenters[1]: duplicate vCenter Server https://vc01/sdk",
+			"vcenters[1]: user and userSecret are mutually exclusive",
+			"vcenters[1]: insecure and caFile are mutually exclusive",
+		}},
+		{"gateway", func(c *Config) { c.Gateway.URL = "gateway:8080"; c.Gateway.Timeout = 0 }, []string{
+			`gateway.url: invalid URL "gateway:8080"`,
+			"gateway.timeout: must be positive",
+		}},
+		{"topic delimiter", func(c *Config) { c.Gateway.TopicDelimiter = "" }, []string{"gateway.topicDelimiter: must not be empty"}},
+		{"stream", func(c *Config) {
+			c.Stream.PageSize = 0
+			c.Stream.DedupeSize = 0
+			c.Stream.DedupeFile = "dedupe.json"
+			c.Stream.Enrich = []string{"runtime.powerState"}
+		}, []string{
+			"stream.pageSize: must be at least 1",
+			"stream.dedupeFile: requires stream.dedupeSize greater than 0",
+			`stream.enrich[0]: invalid property "runtime.powerState"`,
+		}},
+		{"delivery", func(c *Config) {
+			c.Delivery.Format = "xml"
+			c.Delivery.Retry.Status = []int{42}
+		}, []string{
+			"delivery.format: must be json or cloudevents",
+			"delivery.retry.status[0]: invalid status code 42",
+		}},
+		{"filters", func(c *Config) { c.Filters = map[string]string{"fn": `objectName ~ "x"`} }, []string{"filters.fn: "}},
+		{"logging and tracing", func(c *Config) {
+			c.Logging.Level = "verbose"
+			c.Tracing.Exporter = "zipkin"
+		}, []string{
+			`logging.level: unknown log level "verbose"`,
+			"tracing.exporter: must be empty, stdout or otlp",
+		}},
+	}
+
+	for _, test := range testCases {
+		cfg := valid()
+		test.modify(&cfg)
+		err := cfg.Validate()
+
+		if len(test.want) == 0 {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %v", test.name, err)
+			}
+			continue
+		}
+		if err == nil {
+			t.Errorf("%s: wanted errors: %v, got: nil", test.name, test.want)
+			continue
+		}
+		for _, want := range test.want {
+			if !strings.Contains(err.Error(), want) {
+				t.Errorf("%s: wanted error: %s, got: %v", test.name, want, err)
+			}
+		}
+	}
+}
+
+func TestEnvName(t *testing.T) {
+	var testCases = []struct {
+		key  string
+		want string
+	}{
+		{"url", "URL"},
+		{"rebuildInterval", "REBUILD_INTERVAL"},
+		{"enrichTTL", "ENRICH_TTL"},
+		{"caFile", "CA_FILE"},
+		{"tag-vm.openfaas-fn", "TAG_VM_OPENFAAS_FN"},
+	}
+
+	for _, test := range testCases {
+		if got := envName(test.key); got != test.want {
+			t.Errorf("%s: wanted: %v, got: %v", test.key, test.want, got)
+		}
+	}
+}
+
+func TestExampleFile(t *testing.T) {
+	cfg := Default()
+	if err := Load("../../yaml/connector.yaml", &cfg); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Error(err)
+	}
+
+	// the example documents the defaults
+	want := Default()
+	want.VCenters = cfg.VCenters
+	want.Filters = cfg.Filters
+	if !reflect.DeepEqual(want, cfg) {
+		t.Errorf("wanted: %+v, got: %+v", want, cfg)
+	}
+}
+
+func TestDiff(t *testing.T) {
+	base := func() Config {
+		cfg := Default()
+		cfg.VCenters = []VCenter{{Endpoint: events.Endpoint{URL: "https://vc01/sdk"}, PasswordSecret: "/secrets/pass"}}
+		return cfg
+	}
+
+	var testCases = []struct {
+		name   string
+		modify func(*Config)
+		want   []string
+	}{
+		{"same", func(*Config) {}, nil},
+		{"empty filters", func(c *Config) { c.Filters = map[string]string{} }, nil},
+		{"settings", func(c *Config) {
+			c.Gateway.URL = "http://gw:8080"
+			c.Delivery.Retry.Status = []int{503}
+			c.Filters = map[string]string{"fn": `category == "error"`}
+		}, []string{"delivery.retry.status", "filters", "gateway.url"}},
+		{"vCenter", func(c *Config) {
+			c.VCenters[0].Password = "secret"
+			c.VCenters[0].PasswordSecret = ""
+		}, []string{"vcenters[0].password", "vcenters[0].passwordSecret"}},
+		{"vCenter added", func(c *Config) {
+			c.VCenters = append(c.VCenters, VCenter{Endpoint: events.Endpoint{URL: "https://vc02/sdk"}})
+		}, []string{"vcenters"}},
+	}
+
+	for _, test := range testCases {
+		cfg := base()
+		test.modify(&cfg)
+		if got := Diff(base(), cfg); !reflect.DeepEqual(test.want, got) {
+			t.Errorf("%s: wanted: %v, got: %v", test.name, test.want, got)
+		}
+	}
+}
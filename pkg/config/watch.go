@@ -0,0 +1,62 @@
+package config
+
+import (
+	"crypto/sha256"
+	"io/ioutil"
+	"sort"
+)
+
+// Watcher detects changes of the content of files, e.g. of the configuration
+// file or of secrets which Kubernetes updates in place by swapping symlinks.
+// It is not safe for concurrent use
+type Watcher struct {
+	sums map[string]fileSum
+}
+
+// fileSum is the checksum of a file, the zero value for a missing file
+type fileSum struct {
+	exists bool
+	sum    [sha256.Size]byte
+}
+
+// NewWatcher returns a Watcher for the files, their current content is the
+// baseline of Changed
+func NewWatcher(files ...string) *Watcher {
+	w := &Watcher{}
+	w.SetFiles(files...)
+	return w
+}
+
+// SetFiles replaces the watched files, their current content is the new
+// baseline. Empty names are ignored
+func (w *Watcher) SetFiles(files ...string) {
+	w.sums = make(map[string]fileSum, len(files))
+	for _, file := range files {
+		if len(file) > 0 {
+			w.sums[file] = checksum(file)
+		}
+	}
+}
+
+// Changed returns the files whose content changed, or which were created or
+// removed, since the previous call
+func (w *Watcher) Changed() []string {
+	var changed []string
+	for file, previous := range w.sums {
+		current := checksum(file)
+		if current != previous {
+			changed = append(changed, file)
+			w.sums[file] = current
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+func checksum(file string) fileSum {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return fileSum{}
+	}
+	return fileSum{exists: true, sum: sha256.Sum256(data)}
+}
@@ -0,0 +1,55 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestWatcher(t *testing.T) {
+	dir, err := ioutil.TempDir("", "watch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	password := filepath.Join(dir, "password")
+	user := filepath.Join(dir, "user")
+	if err := ioutil.WriteFile(password, []byte("old"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	w := NewWatcher(password, user, "")
+
+	var testCases = []struct {
+		name   string
+		modify func() error
+		want   []string
+	}{
+		{"unchanged", func() error { return nil }, nil},
+		{"same content", func() error { return ioutil.WriteFile(password, []byte("old"), 0600) }, nil},
+		{"changed", func() error { return ioutil.WriteFile(password, []byte("new"), 0600) }, []string{password}},
+		{"created", func() error { return ioutil.WriteFile(user, []byte("admin"), 0600) }, []string{user}},
+		{"removed", func() error { return os.Remove(user) }, []string{user}},
+	}
+
+	for _, test := range testCases {
+		if err := test.modify(); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if got := w.Changed(); !reflect.DeepEqual(test.want, got) {
+			t.Errorf("%s: wanted: %v, got: %v", test.name, test.want, got)
+		}
+	}
+
+	// assert that replaced files are the new baseline
+	w.SetFiles(user)
+	if err := ioutil.WriteFile(password, []byte("newer"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if got := w.Changed(); got != nil {
+		t.Errorf("unwatched: wanted: nil, got: %v", got)
+	}
+}
@@ -0,0 +1,232 @@
+package deadletter
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	ofsdk "github.com/openfaas-incubator/connector-sdk/types"
+	"github.com/openfaas-incubator/vcenter-connector/pkg/topics"
+	"github.com/pkg/errors"
+)
+
+// Entry is a message which could not be delivered to a function
+type Entry struct {
+	// Time is when the last attempt failed
+	Time     time.Time `json:"time"`
+	Topic    string    `json:"topic"`
+	Function string    `json:"function"`
+	// Message and Header are the body and additional HTTP headers of the
+	// invocation
+	Message json.RawMessage `json:"message"`
+	Header  http.Header     `json:"header,omitempty"`
+	// Status is the HTTP status of the last attempt, 0 if the gateway was not
+	// reached
+	Status   int    `json:"status"`
+	Error    string `json:"error,omitempty"`
+	Attempts int    `json:"attempts"`
+}
+
+// FromResponse returns the entry for the failed invocation of the response
+func FromResponse(res ofsdk.InvokerResponse, now time.Time) Entry {
+	message, header := topics.Invocation(res.Context)
+
+	e := Entry{
+		Time:     now,
+		Topic:    res.Topic,
+		Function: res.Function,
+		Message:  message,
+		Header:   header,
+		Status:   res.Status,
+		Attempts: topics.Attempts(res.Context),
+	}
+	if res.Error != nil {
+		e.Error = res.Error.Error()
+	} else if res.Body != nil {
+		e.Error = string(*res.Body)
+	}
+	return e
+}
+
+// Store persists undeliverable messages. Implementations must be safe for
+// concurrent use
+type Store interface {
+	// Append adds an entry
+	Append(e Entry) error
+	// List returns all entries in the order they were added
+	List() ([]Entry, error)
+	// Replace replaces the first n entries, i.e. those returned by a previous
+	// List, with entries, e.g. to remove redriven entries. Entries added
+	// since are kept
+	Replace(n int, entries []Entry) error
+}
+
+// FileStore is a Store which appends entries as JSON lines to a local file.
+// Processes sharing the file, i.e. a running connector and the dlq command,
+// serialize their access with an advisory lock on the file with the suffix
+// ".lock"
+type FileStore struct {
+	path string
+	lock sync.Mutex
+}
+
+// NewFileStore returns a FileStore writing to path. The file and its parent
+// directory are created on the first Append
+func NewFileStore(path string) *FileStore {
+	return &FileStore{
+		path: path,
+	}
+}
+
+// Append appends the entry to the file while holding the lock, so it is
+// neither interleaved with other entries nor lost if another process
+// replaces the file at the same time
+func (f *FileStore) Append(e Entry) error {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return errors.Wrap(err, "error marshaling dead letter")
+	}
+
+	unlock, err := f.lockFile()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return errors.Wrap(err, "error opening dead letter file")
+	}
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		file.Close()
+		return errors.Wrap(err, "error writing dead letter")
+	}
+	return errors.Wrap(file.Close(), "error writing dead letter")
+}
+
+// List reads all entries from the file, a missing file is not an error
+func (f *FileStore) List() ([]Entry, error) {
+	if _, err := os.Stat(f.path); os.IsNotExist(err) {
+		return nil, nil
+	}
+
+	unlock, err := f.lockFile()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	return f.read()
+}
+
+// Replace writes the entries followed by the ones appended since the first n
+// to a temporary file and renames it afterwards, so a crash never leaves a
+// truncated file behind. The lock is held throughout, so no entry appended
+// meanwhile is lost
+func (f *FileStore) Replace(n int, entries []Entry) error {
+	unlock, err := f.lockFile()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	current, err := f.read()
+	if err != nil {
+		return err
+	}
+	if n > len(current) {
+		return errors.Errorf("dead letter file %s was replaced meanwhile, it holds %d instead of at least %d entries", f.path, len(current), n)
+	}
+	entries = append(entries[:len(entries):len(entries)], current[n:]...)
+
+	var buf bytes.Buffer
+	for _, e := range entries {
+		line, err := json.Marshal(e)
+		if err != nil {
+			return errors.Wrap(err, "error marshaling dead letter")
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+
+	dir := filepath.Dir(f.path)
+	tmp, err := ioutil.TempFile(dir, filepath.Base(f.path)+".tmp")
+	if err != nil {
+		return errors.Wrap(err, "error creating temporary dead letter file")
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(buf.Bytes()); err != nil {
+		tmp.Close()
+		return errors.Wrap(err, "error writing dead letters")
+	}
+	if err := tmp.Close(); err != nil {
+		return errors.Wrap(err, "error writing dead letters")
+	}
+
+	if err := os.Rename(tmp.Name(), f.path); err != nil {
+		return errors.Wrap(err, "error replacing dead letter file")
+	}
+	return nil
+}
+
+// read parses the entries of the file, the lock must be held
+func (f *FileStore) read() ([]Entry, error) {
+	data, err := ioutil.ReadFile(f.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, errors.Wrap(err, "error reading dead letter file")
+	}
+
+	var entries []Entry
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(nil, len(data)+1)
+	for n := 1; scanner.Scan(); n++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var e Entry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return nil, errors.Wrapf(err, "error parsing dead letter file %s, line %d", f.path, n)
+		}
+		entries = append(entries, e)
+	}
+	return entries, errors.Wrap(scanner.Err(), "error reading dead letter file")
+}
+
+// lockFile creates the directory of the file if missing and takes the lock
+// within this process and across processes. The returned function releases
+// the lock
+func (f *FileStore) lockFile() (func(), error) {
+	f.lock.Lock()
+
+	if err := os.MkdirAll(filepath.Dir(f.path), 0755); err != nil {
+		f.lock.Unlock()
+		return nil, errors.Wrap(err, "error creating dead letter directory")
+	}
+
+	lf, err := os.OpenFile(f.path+".lock", os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		f.lock.Unlock()
+		return nil, errors.Wrap(err, "error opening dead letter lock file")
+	}
+	if err := lockExclusive(lf); err != nil {
+		lf.Close()
+		f.lock.Unlock()
+		return nil, errors.Wrap(err, "error locking dead letter file")
+	}
+
+	return func() {
+		// closing the file releases the lock
+		lf.Close()
+		f.lock.Unlock()
+	}, nil
+}
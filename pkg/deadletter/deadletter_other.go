@@ -0,0 +1,13 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package deadletter
+
+import "os"
+
+// lockExclusive does nothing on platforms without flock, the file is then
+// only locked within the process, so the dlq command must not run next to
+// the connector on the same file
+func lockExclusive(f *os.File) error {
+	return nil
+}
@@ -0,0 +1,148 @@
+package deadletter
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	ofsdk "github.com/openfaas-incubator/connector-sdk/types"
+)
+
+func TestFileStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "deadletter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store := NewFileStore(filepath.Join(dir, "state", "dead-letters.jsonl"))
+
+	// assert that a missing file is not an error
+	entries, err := store.List()
+	if err != nil || entries != nil {
+		t.Fatalf("missing file: wanted: no entries, got: %v, %v", entries, err)
+	}
+
+	now := time.Date(2019, 6, 1, 12, 0, 0, 0, time.UTC)
+	want := []Entry{
+		{Time: now, Topic: "vm.powered.on", Function: "tag-vm", Message: []byte(`{"objectName":"vm-1"}`), Status: 502, Attempts: 3},
+		{Time: now, Topic: "vm.powered.off", Function: "audit", Message: []byte(`{"objectName":"vm-2"}`), Error: "connection refused", Attempts: 1},
+	}
+	for _, e := range want {
+		if err := store.Append(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got, err := store.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(want, got) {
+		t.Errorf("append: wanted: %v, got: %v", want, got)
+	}
+
+	// assert that replacing removes the other entries
+	if err := store.Replace(len(want), want[1:]); err != nil {
+		t.Fatal(err)
+	}
+	got, err = store.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(want[1:], got) {
+		t.Errorf("replace: wanted: %v, got: %v", want[1:], got)
+	}
+
+	// assert that entries are appended to the replaced file
+	if err := store.Append(want[0]); err != nil {
+		t.Fatal(err)
+	}
+	got, err = store.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 {
+		t.Errorf("append after replace: wanted: 2 entries, got: %v", got)
+	}
+}
+
+func TestFileStoreReplaceKeepsAppended(t *testing.T) {
+	dir, err := ioutil.TempDir("", "deadletter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "dead-letters.jsonl")
+	dlq := NewFileStore(path)
+	// the running connector has a store of its own
+	connector := NewFileStore(path)
+
+	now := time.Date(2019, 6, 1, 12, 0, 0, 0, time.UTC)
+	first := Entry{Time: now, Topic: "vm.powered.on", Function: "tag-vm", Message: []byte(`{}`), Status: 502, Attempts: 3}
+	failed := Entry{Time: now, Topic: "vm.powered.on", Function: "tag-vm", Message: []byte(`{}`), Status: 503, Attempts: 4}
+	appended := Entry{Time: now, Topic: "vm.powered.off", Function: "audit", Message: []byte(`{}`), Status: 502, Attempts: 3}
+
+	if err := connector.Append(first); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := dlq.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// assert that an entry appended while replaying survives the replace
+	if err := connector.Append(appended); err != nil {
+		t.Fatal(err)
+	}
+	if err := dlq.Replace(len(entries), []Entry{failed}); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := dlq.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []Entry{failed, appended}; !reflect.DeepEqual(want, got) {
+		t.Errorf("wanted: %v, got: %v", want, got)
+	}
+
+	// assert that a file replaced meanwhile is not overwritten
+	if err := dlq.Replace(3, nil); err == nil {
+		t.Errorf("replaced meanwhile: wanted error")
+	}
+}
+
+func TestFromResponse(t *testing.T) {
+	now := time.Now()
+	body := []byte("function not ready\nretry later")
+
+	var testCases = []struct {
+		name string
+		res  ofsdk.InvokerResponse
+		want Entry
+	}{
+		{
+			"error",
+			ofsdk.InvokerResponse{Context: context.Background(), Topic: "vm.powered.on", Function: "tag-vm", Status: 503, Error: errors.New("connection refused")},
+			Entry{Time: now, Topic: "vm.powered.on", Function: "tag-vm", Status: 503, Error: "connection refused"},
+		},
+		{
+			"status",
+			ofsdk.InvokerResponse{Context: context.Background(), Topic: "vm.powered.on", Function: "tag-vm", Status: 502, Body: &body},
+			Entry{Time: now, Topic: "vm.powered.on", Function: "tag-vm", Status: 502, Error: string(body)},
+		},
+	}
+
+	for _, test := range testCases {
+		if got := FromResponse(test.res, now); !reflect.DeepEqual(test.want, got) {
+			t.Errorf("%s: wanted: %+v, got: %+v", test.name, test.want, got)
+		}
+	}
+}
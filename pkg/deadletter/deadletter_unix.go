@@ -0,0 +1,15 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package deadletter
+
+import (
+	"os"
+	"syscall"
+)
+
+// lockExclusive takes an advisory lock on the file, which is released when
+// the file is closed
+func lockExclusive(f *os.File) error {
+	return syscall.Flock(int(f.Fd()), syscall.LOCK_EX)
+}
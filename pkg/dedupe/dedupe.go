@@ -0,0 +1,216 @@
+package dedupe
+
+import (
+	"bufio"
+	"container/list"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// Key identifies a vCenter event. Event keys are only unique per vCenter
+// Server, so the source is part of the key
+type Key struct {
+	Source   string `json:"source"`
+	EventKey int32  `json:"key"`
+	ChainID  int32  `json:"chainId"`
+}
+
+// Cache remembers the most recently seen keys up to a fixed size, the least
+// recently added keys are evicted first. If a file is configured every added
+// key is appended to it, so the cache survives restarts. Cache is safe for
+// concurrent use
+type Cache struct {
+	size int
+
+	lock  sync.Mutex
+	order *list.List
+	index map[Key]*list.Element
+
+	path     string
+	file     *os.File
+	appended int
+}
+
+// NewCache returns an in-memory Cache holding up to size keys
+func NewCache(size int) *Cache {
+	if size < 1 {
+		size = 1
+	}
+
+	return &Cache{
+		size:  size,
+		order: list.New(),
+		index: make(map[Key]*list.Element),
+	}
+}
+
+// OpenCache returns a Cache holding up to size keys which is loaded from and
+// persisted to the file at path. The file and its parent directory are
+// created if missing
+func OpenCache(size int, path string) (*Cache, error) {
+	c := NewCache(size)
+	c.path = path
+
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+
+	// start with a compacted file so it does not grow across restarts
+	if err := c.compact(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Add records the key and returns true, unless the key was already seen in
+// which case false is returned
+func (c *Cache) Add(k Key) (bool, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if _, ok := c.index[k]; ok {
+		return false, nil
+	}
+	c.insert(k)
+
+	if c.file == nil {
+		return true, nil
+	}
+
+	data, err := json.Marshal(k)
+	if err != nil {
+		return true, errors.Wrap(err, "error marshaling dedupe key")
+	}
+	if _, err := c.file.Write(append(data, '\n')); err != nil {
+		return true, errors.Wrap(err, "error writing dedupe file")
+	}
+
+	// the file holds evicted keys as well, rewrite it once it holds twice as
+	// many keys as the cache
+	c.appended++
+	if c.appended >= c.size {
+		return true, c.compact()
+	}
+	return true, nil
+}
+
+// Contains returns true if the key was already seen, it does not record the
+// key
+func (c *Cache) Contains(k Key) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	_, ok := c.index[k]
+	return ok
+}
+
+// Len returns the number of keys in the cache
+func (c *Cache) Len() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.order.Len()
+}
+
+// Close closes the backing file, if any
+func (c *Cache) Close() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.file == nil {
+		return nil
+	}
+	err := c.file.Close()
+	c.file = nil
+	return err
+}
+
+func (c *Cache) insert(k Key) {
+	c.index[k] = c.order.PushBack(k)
+	for c.order.Len() > c.size {
+		oldest := c.order.Front()
+		c.order.Remove(oldest)
+		delete(c.index, oldest.Value.(Key))
+	}
+}
+
+// load reads the keys from the file in the order they were added, a missing
+// file is not an error
+func (c *Cache) load() error {
+	f, err := os.Open(c.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return errors.Wrap(err, "error reading dedupe file")
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var k Key
+		if err := json.Unmarshal(scanner.Bytes(), &k); err != nil {
+			// a crash may leave a truncated last line behind
+			continue
+		}
+		if _, ok := c.index[k]; !ok {
+			c.insert(k)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return errors.Wrapf(err, "error reading dedupe file %s", c.path)
+	}
+	return nil
+}
+
+// compact replaces the file with one holding only the cached keys and opens
+// it for appending
+func (c *Cache) compact() error {
+	if c.file != nil {
+		c.file.Close()
+		c.file = nil
+	}
+
+	dir := filepath.Dir(c.path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return errors.Wrap(err, "error creating dedupe directory")
+	}
+
+	tmp, err := ioutil.TempFile(dir, filepath.Base(c.path)+".tmp")
+	if err != nil {
+		return errors.Wrap(err, "error creating temporary dedupe file")
+	}
+	defer os.Remove(tmp.Name())
+
+	w := bufio.NewWriter(tmp)
+	enc := json.NewEncoder(w)
+	for e := c.order.Front(); e != nil; e = e.Next() {
+		if err := enc.Encode(e.Value.(Key)); err != nil {
+			tmp.Close()
+			return errors.Wrap(err, "error writing dedupe file")
+		}
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return errors.Wrap(err, "error writing dedupe file")
+	}
+	if err := tmp.Close(); err != nil {
+		return errors.Wrap(err, "error writing dedupe file")
+	}
+
+	if err := os.Rename(tmp.Name(), c.path); err != nil {
+		return errors.Wrap(err, "error replacing dedupe file")
+	}
+
+	f, err := os.OpenFile(c.path, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return errors.Wrap(err, "error opening dedupe file")
+	}
+	c.file = f
+	c.appended = 0
+	return nil
+}
@@ -0,0 +1,97 @@
+package dedupe
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCacheEviction(t *testing.T) {
+	c := NewCache(2)
+
+	var testCases = []struct {
+		name string
+		key  Key
+		want bool
+	}{
+		{"first event", Key{Source: "vc1", EventKey: 1}, true},
+		{"duplicate event", Key{Source: "vc1", EventKey: 1}, false},
+		{"same key other source", Key{Source: "vc2", EventKey: 1}, true},
+		{"same key other chain", Key{Source: "vc1", EventKey: 1, ChainID: 7}, true},
+		{"evicted event", Key{Source: "vc1", EventKey: 1}, true},
+	}
+
+	for _, test := range testCases {
+		got, err := c.Add(test.key)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if got != test.want {
+			t.Errorf("%s: wanted: %v, got: %v", test.name, test.want, got)
+		}
+	}
+
+	if got := c.Len(); got != 2 {
+		t.Errorf("len: wanted: %v, got: %v", 2, got)
+	}
+}
+
+func TestCacheContains(t *testing.T) {
+	c := NewCache(2)
+	k := Key{Source: "vc1", EventKey: 1}
+
+	if c.Contains(k) {
+		t.Errorf("before add: wanted: %v, got: %v", false, true)
+	}
+	// contains must not record the key
+	if added, err := c.Add(k); err != nil || !added {
+		t.Errorf("add: wanted: %v, got: %v, %v", true, added, err)
+	}
+	if !c.Contains(k) {
+		t.Errorf("after add: wanted: %v, got: %v", true, false)
+	}
+}
+
+func TestCachePersistence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dedupe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "state", "dedupe.jsonl")
+
+	c, err := OpenCache(3, path)
+	if err != nil {
+		t.Fatalf("open without file: %v", err)
+	}
+	// add enough keys to trigger a compaction of the file
+	for i := int32(1); i <= 5; i++ {
+		if _, err := c.Add(Key{Source: "vc1", EventKey: i}); err != nil {
+			t.Fatalf("add %d: %v", i, err)
+		}
+	}
+	if err := c.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	c, err = OpenCache(3, path)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer c.Close()
+
+	// the newest keys must have survived, adding evicted keys again evicts
+	// the oldest ones so check from newest to oldest
+	for i := int32(5); i >= 1; i-- {
+		want := i <= 2
+		got, err := c.Add(Key{Source: "vc1", EventKey: i})
+		if err != nil {
+			t.Fatalf("add %d: %v", i, err)
+		}
+		if got != want {
+			t.Errorf("reopened key %d: wanted: %v, got: %v", i, want, got)
+		}
+	}
+}
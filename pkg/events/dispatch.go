@@ -0,0 +1,375 @@
+package events
+
+import (
+	"context"
+	"hash/fnv"
+	"net/http"
+	"sync"
+	"time"
+
+	ofsdk "github.com/openfaas-incubator/connector-sdk/types"
+	"github.com/openfaas-incubator/vcenter-connector/pkg/cloudevents"
+	"github.com/openfaas-incubator/vcenter-connector/pkg/dedupe"
+	"github.com/openfaas-incubator/vcenter-connector/pkg/logging"
+	"github.com/openfaas-incubator/vcenter-connector/pkg/metrics"
+	"github.com/openfaas-incubator/vcenter-connector/pkg/topics"
+	"github.com/openfaas-incubator/vcenter-connector/pkg/tracing"
+	"github.com/pkg/errors"
+	vtypes "github.com/vmware/govmomi/vim25/types"
+)
+
+// Message formats
+const (
+	// FormatJSON sends the JSON message as is
+	FormatJSON = "json"
+	// FormatCloudEvents wraps the JSON message in a CloudEvent
+	FormatCloudEvents = "cloudevents"
+)
+
+// DispatchConfig configures how events are handed over to the OpenFaaS
+// controller
+type DispatchConfig struct {
+	// Workers is the number of concurrent function invocations
+	Workers int
+
+	// QueueSize is the maximum number of events waiting to be handed over
+	QueueSize int
+
+	// DropWhenFull drops events when the queue is full instead of blocking the
+	// event stream until space is available
+	DropWhenFull bool
+
+	// Format is the format of the messages, FormatJSON if nil. It can be
+	// changed while streaming
+	Format *MessageFormat
+}
+
+// validate checks the format of the messages is supported by the controller
+func (cfg DispatchConfig) validate(controller ofsdk.Controller) error {
+	format, cloudEventsMode := cfg.Format.Get()
+	return ValidateFormat(controller, format, cloudEventsMode)
+}
+
+// ValidateFormat checks the message format and the HTTP content mode of
+// CloudEvents are supported by the controller
+func ValidateFormat(controller ofsdk.Controller, format, cloudEventsMode string) error {
+	switch format {
+	case "", FormatJSON:
+		return nil
+	case FormatCloudEvents:
+	default:
+		return errors.Errorf("unknown message format %q", format)
+	}
+
+	switch cloudEventsMode {
+	case cloudevents.ContentModeStructured:
+		return nil
+	case cloudevents.ContentModeBinary:
+		if _, ok := controller.(topics.HeaderInvoker); !ok {
+			return errors.New("binary cloudevents require a controller which supports headers")
+		}
+		return nil
+	}
+	return errors.Errorf("unknown cloudevents content mode %q", cloudEventsMode)
+}
+
+// MessageFormat is the format of the messages handed over to functions. It is
+// safe for concurrent use, so it can be replaced while streaming
+type MessageFormat struct {
+	lock            sync.RWMutex
+	format          string
+	cloudEventsMode string
+}
+
+// NewMessageFormat returns the format, FormatJSON if format is empty. The
+// cloudEventsMode is the HTTP content mode of CloudEvents, i.e.
+// cloudevents.ContentModeStructured or cloudevents.ContentModeBinary
+func NewMessageFormat(format, cloudEventsMode string) *MessageFormat {
+	f := &MessageFormat{}
+	f.Set(format, cloudEventsMode)
+	return f
+}
+
+// Set replaces the format, messages being handed over keep the previous one
+func (f *MessageFormat) Set(format, cloudEventsMode string) {
+	if len(format) == 0 {
+		format = FormatJSON
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.format, f.cloudEventsMode = format, cloudEventsMode
+}
+
+// Get returns the format and the HTTP content mode of CloudEvents, FormatJSON
+// for a nil format
+func (f *MessageFormat) Get() (string, string) {
+	if f == nil {
+		return FormatJSON, ""
+	}
+
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+	return f.format, f.cloudEventsMode
+}
+
+// dispatcher decouples reading events from vCenter from invoking functions.
+// Events are queued in a bounded queue per worker. Events for the same
+// managed object are always queued for the same worker and thus delivered in
+// order
+type dispatcher struct {
+	controller   ofsdk.Controller
+	tracker      *tracker
+	queues       []chan job
+	dropWhenFull bool
+	format       *MessageFormat
+	wg           sync.WaitGroup
+
+	// dedupe remembers the events handed over to the controller, it may be
+	// nil. pending holds the keys of the events queued but not handed over
+	// yet
+	dedupe      *dedupe.Cache
+	pendingLock sync.Mutex
+	pending     map[dedupe.Key]int
+}
+
+// messageMeta describes a message for formats which carry metadata besides
+// the message itself, i.e. CloudEvents
+type messageMeta struct {
+	// id identifies the message among all messages of the source
+	id string
+	// source is the URL of the vCenter Server
+	source string
+	// time is when the event occurred
+	time time.Time
+	// log carries the fields of the message, e.g. the event key, the default
+	// logger with the topic is used if nil
+	log *logging.Logger
+	// span is the span of the handling of the event, the parent of the
+	// invocation spans. It ends once the message was handed over or dropped.
+	// It may be nil
+	span tracing.Span
+	// build returns the message to hand over instead of the dispatched one.
+	// It is called by the worker, so retrieving data for the message, e.g.
+	// for enrichment, does not block the event stream. It may be nil
+	build func(ctx context.Context) ([]byte, error)
+	// dedupeKey is recorded in the dedupe cache of the dispatcher once the
+	// message was handed over. It may be nil
+	dedupeKey *dedupe.Key
+}
+
+// job is an event ready to be handed over to the controller
+type job struct {
+	topic   string
+	message []byte
+	// payload is the message before it was encoded, nil if it was not
+	payload []byte
+	// header holds additional HTTP headers for the invocation, if any
+	header http.Header
+	// ref is the managed object the message refers to, if any
+	ref  *vtypes.ManagedObjectReference
+	meta messageMeta
+	// position tracks the event for checkpointing, nil for messages which are
+	// not checkpointed, e.g. task updates
+	position *position
+}
+
+// newDispatcher starts the configured number of workers. Events handed over
+// are recorded in the dedupe cache, which may be nil
+func newDispatcher(controller ofsdk.Controller, t *tracker, cache *dedupe.Cache, cfg DispatchConfig) *dispatcher {
+	workers := cfg.Workers
+	if workers < 1 {
+		workers = 1
+	}
+
+	// distribute the queue capacity across the workers
+	size := cfg.QueueSize / workers
+	if size < 1 {
+		size = 1
+	}
+
+	d := dispatcher{
+		controller:   controller,
+		tracker:      t,
+		queues:       make([]chan job, workers),
+		dropWhenFull: cfg.DropWhenFull,
+		format:       cfg.Format,
+		dedupe:       cache,
+		pending:      make(map[dedupe.Key]int),
+	}
+
+	metrics.QueueCapacity.Add(float64(size * workers))
+
+	for i := range d.queues {
+		d.queues[i] = make(chan job, size)
+		d.wg.Add(1)
+		go d.work(d.queues[i])
+	}
+
+	return &d
+}
+
+// dispatch queues the message for the worker responsible for ref. If the
+// queue is full it either blocks or drops the message, depending on the
+// configuration. It returns false if the message was dropped
+func (d *dispatcher) dispatch(ref *vtypes.ManagedObjectReference, topic string, message []byte, meta messageMeta, p *position) bool {
+	j := job{
+		topic:    topic,
+		message:  message,
+		ref:      ref,
+		meta:     meta,
+		position: p,
+	}
+	if j.meta.log == nil {
+		j.meta.log = logging.With("topic", topic)
+	}
+	if j.meta.dedupeKey != nil {
+		d.pendingLock.Lock()
+		d.pending[*j.meta.dedupeKey]++
+		d.pendingLock.Unlock()
+	}
+
+	queue := d.queues[d.shard(ref)]
+
+	select {
+	case queue <- j:
+		metrics.QueueDepth.Add(1)
+		return true
+	default:
+	}
+
+	if d.dropWhenFull {
+		metrics.QueueFull.WithLabelValues("dropped").Inc()
+		metrics.EventsDropped.WithLabelValues("queue_full").Inc()
+		j.meta.log.Warn("dispatch queue full, dropping message")
+		d.finish(j, false)
+		return false
+	}
+
+	metrics.QueueFull.WithLabelValues("blocked").Inc()
+	start := time.Now()
+	queue <- j
+	metrics.QueueDepth.Add(1)
+	metrics.QueueBlockedSeconds.Add(time.Since(start).Seconds())
+	return true
+}
+
+// shard returns the index of the queue for the managed object, events without
+// a managed object all go to the first queue
+func (d *dispatcher) shard(ref *vtypes.ManagedObjectReference) int {
+	if ref == nil {
+		return 0
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(ref.String()))
+	return int(h.Sum32() % uint32(len(d.queues)))
+}
+
+// work hands over the events of a queue to the controller until it is closed
+func (d *dispatcher) work(queue chan job) {
+	defer d.wg.Done()
+
+	for j := range queue {
+		metrics.QueueDepth.Add(-1)
+
+		ctx := logging.NewContext(context.Background(), j.meta.log)
+		ctx = tracing.ContextWithSpan(ctx, j.meta.span)
+		if err := d.prepare(ctx, &j); err != nil {
+			j.meta.log.Error("error encoding message", "error", err)
+			d.finish(j, false)
+			continue
+		}
+
+		j.meta.log.Debug("handing over message")
+		if j.payload != nil {
+			// filters apply to the message rather than its encoding
+			ctx = topics.WithPayload(ctx, j.payload)
+		}
+
+		if invoker, ok := d.controller.(topics.HeaderInvoker); ok && j.header != nil {
+			invoker.InvokeWithHeaders(ctx, j.topic, &j.message, j.header)
+		} else {
+			d.controller.InvokeWithContext(ctx, j.topic, &j.message)
+		}
+		d.finish(j, true)
+	}
+}
+
+// prepare builds the message of the job, if it has a builder, and encodes it
+// in the configured format
+func (d *dispatcher) prepare(ctx context.Context, j *job) error {
+	if j.meta.build != nil {
+		message, err := j.meta.build(ctx)
+		if err != nil {
+			j.meta.log.Warn("error building message, handing it over as dispatched", "error", err)
+		} else {
+			j.message = message
+		}
+	}
+
+	format, cloudEventsMode := d.format.Get()
+	if format != FormatCloudEvents {
+		return nil
+	}
+
+	var subject string
+	if j.ref != nil {
+		subject = j.ref.String()
+	}
+
+	var err error
+	ce := cloudevents.New(j.meta.id, j.meta.source, j.topic, subject, j.meta.time, j.message)
+	j.payload = j.message
+	j.header, j.message, err = ce.Encode(cloudEventsMode)
+	return err
+}
+
+// duplicate returns true if the event was handed over already or is queued
+func (d *dispatcher) duplicate(k dedupe.Key) bool {
+	d.pendingLock.Lock()
+	defer d.pendingLock.Unlock()
+	return d.pending[k] > 0 || (d.dedupe != nil && d.dedupe.Contains(k))
+}
+
+// finish ends the span of the job, records its event in the dedupe cache if
+// it was handed over and marks it as done so the checkpoint can move past it.
+// Recording the event only after the hand-over keeps an event which was
+// queued when the connector stopped from being skipped as a duplicate when it
+// is replayed
+func (d *dispatcher) finish(j job, handedOver bool) {
+	if j.meta.span != nil {
+		j.meta.span.End()
+	}
+
+	if k := j.meta.dedupeKey; k != nil {
+		if handedOver && d.dedupe != nil {
+			if _, err := d.dedupe.Add(*k); err != nil {
+				j.meta.log.Warn("error recording event for deduplication", "error", err)
+			}
+		}
+		d.pendingLock.Lock()
+		if d.pending[*k]--; d.pending[*k] <= 0 {
+			delete(d.pending, *k)
+		}
+		d.pendingLock.Unlock()
+	}
+
+	if j.position == nil {
+		return
+	}
+
+	if err := d.tracker.done(j.position); err != nil {
+		j.meta.log.Error("error saving checkpoint", "error", err)
+	}
+}
+
+// close stops accepting events and waits until all queued events were handed
+// over to the controller
+func (d *dispatcher) close() {
+	for _, queue := range d.queues {
+		close(queue)
+		metrics.QueueCapacity.Add(-float64(cap(queue)))
+	}
+	d.wg.Wait()
+}
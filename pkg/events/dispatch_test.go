@@ -0,0 +1,204 @@
+package events
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"testing"
+
+	ofsdk "github.com/openfaas-incubator/connector-sdk/types"
+	"github.com/openfaas-incubator/vcenter-connector/pkg/tracing"
+	"github.com/pkg/errors"
+	vtypes "github.com/vmware/govmomi/vim25/types"
+)
+
+// recordingController records the invoked messages per topic
+type recordingController struct {
+	lock     sync.Mutex
+	messages map[string][]string
+}
+
+func (c *recordingController) Subscribe(subscriber ofsdk.ResponseSubscriber) {}
+
+func (c *recordingController) Invoke(topic string, message *[]byte) {
+	c.InvokeWithContext(context.Background(), topic, message)
+}
+
+func (c *recordingController) InvokeWithContext(ctx context.Context, topic string, message *[]byte) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.messages[topic] = append(c.messages[topic], string(*message))
+}
+
+func (c *recordingController) BeginMapBuilder() {}
+
+func (c *recordingController) Topics() []string { return nil }
+
+func TestDispatcherOrderPerObject(t *testing.T) {
+	controller := &recordingController{messages: make(map[string][]string)}
+	tr, err := newTracker(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := newDispatcher(controller, tr, nil, DispatchConfig{Workers: 4, QueueSize: 8})
+
+	refs := []vtypes.ManagedObjectReference{
+		{Type: "VirtualMachine", Value: "vm-1"},
+		{Type: "VirtualMachine", Value: "vm-2"},
+		{Type: "HostSystem", Value: "host-1"},
+	}
+
+	want := make(map[string][]string)
+	key := int32(0)
+	for i := 0; i < 50; i++ {
+		for _, ref := range refs {
+			key++
+			ref := ref
+			msg := string('a' + rune(i%26))
+			d.dispatch(&ref, ref.Value, []byte(msg), messageMeta{}, tr.queue(&vtypes.Event{Key: key}))
+			want[ref.Value] = append(want[ref.Value], msg)
+		}
+	}
+	d.close()
+
+	// assert that events of the same object were delivered in order
+	if eq := reflect.DeepEqual(want, controller.messages); !eq {
+		t.Errorf("wanted: %v, got: %v", want, controller.messages)
+	}
+
+	// assert that the position moved past all events
+	if cp := tr.current(); cp == nil || cp.LastEventKey != key {
+		t.Errorf("position: wanted: %d, got: %v", key, cp)
+	}
+}
+
+func TestDispatcherBuild(t *testing.T) {
+	controller := &recordingController{messages: make(map[string][]string)}
+	tr, err := newTracker(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := newDispatcher(controller, tr, nil, DispatchConfig{})
+
+	build := func(message string, err error) func(context.Context) ([]byte, error) {
+		return func(context.Context) ([]byte, error) {
+			return []byte(message), err
+		}
+	}
+	d.dispatch(nil, "built", []byte("dispatched"), messageMeta{build: build("built", nil)}, nil)
+	d.dispatch(nil, "failed", []byte("dispatched"), messageMeta{build: build("", errors.New("timeout"))}, nil)
+	d.dispatch(nil, "plain", []byte("dispatched"), messageMeta{}, nil)
+	d.close()
+
+	want := map[string][]string{
+		"built":  {"built"},
+		"failed": {"dispatched"},
+		"plain":  {"dispatched"},
+	}
+	if eq := reflect.DeepEqual(want, controller.messages); !eq {
+		t.Errorf("wanted: %v, got: %v", want, controller.messages)
+	}
+}
+
+// endRecordingSpan is a span recording whether it ended
+type endRecordingSpan struct {
+	tracing.Span
+	lock  sync.Mutex
+	ended bool
+}
+
+func (s *endRecordingSpan) End() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.ended = true
+}
+
+func (s *endRecordingSpan) hasEnded() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.ended
+}
+
+// spanController records whether the span of the context had ended when a
+// function was invoked
+type spanController struct {
+	recordingController
+	endedAtInvoke bool
+}
+
+func (c *spanController) InvokeWithContext(ctx context.Context, topic string, message *[]byte) {
+	c.endedAtInvoke = tracing.FromContext(ctx).(*endRecordingSpan).hasEnded()
+}
+
+func TestDispatcherEndsSpan(t *testing.T) {
+	controller := &spanController{}
+	tr, err := newTracker(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := newDispatcher(controller, tr, nil, DispatchConfig{})
+	span := &endRecordingSpan{}
+	d.dispatch(nil, "topic", []byte("message"), messageMeta{span: span}, nil)
+	d.close()
+
+	// the span of the event covers the invocation of the functions
+	if controller.endedAtInvoke || !span.hasEnded() {
+		t.Errorf("wanted: span ended after the invocation, got: ended at invocation: %v, ended: %v", controller.endedAtInvoke, span.hasEnded())
+	}
+}
+
+func TestDispatcherFormatChange(t *testing.T) {
+	format := NewMessageFormat(FormatJSON, "")
+	d := dispatcher{format: format}
+
+	json := job{topic: "vm.powered.on", message: []byte(`{"key":1}`)}
+	if err := d.prepare(context.Background(), &json); err != nil {
+		t.Fatal(err)
+	}
+	if json.header != nil || string(json.message) != `{"key":1}` {
+		t.Errorf("json: wanted: message as is, got: %s %v", json.message, json.header)
+	}
+
+	// messages prepared after the change use the new format
+	format.Set(FormatCloudEvents, "binary")
+	ce := job{topic: "vm.powered.on", message: []byte(`{"key":2}`), meta: messageMeta{id: "2", source: "https://vc01/sdk"}}
+	if err := d.prepare(context.Background(), &ce); err != nil {
+		t.Fatal(err)
+	}
+	if ce.header.Get("ce-type") != "vm.powered.on" || string(ce.payload) != `{"key":2}` {
+		t.Errorf("cloudevents: wanted: binary cloudevent, got: %s %v", ce.message, ce.header)
+	}
+}
+
+func TestValidateFormat(t *testing.T) {
+	controller := &recordingController{}
+
+	var testCases = []struct {
+		name            string
+		format          string
+		cloudEventsMode string
+		wantErr         bool
+	}{
+		{"default format", "", "", false},
+		{"structured cloudevents", FormatCloudEvents, "structured", false},
+		{"binary cloudevents without header support", FormatCloudEvents, "binary", true},
+		{"unknown format", "xml", "", true},
+		{"unknown content mode", FormatCloudEvents, "batch", true},
+	}
+
+	for _, test := range testCases {
+		err := ValidateFormat(controller, test.format, test.cloudEventsMode)
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s: wanted error: %v, got: %v", test.name, test.wantErr, err)
+		}
+	}
+
+	// the configured format is validated
+	cfg := DispatchConfig{Format: NewMessageFormat(FormatCloudEvents, "binary")}
+	if err := cfg.validate(controller); err == nil {
+		t.Errorf("dispatch config: wanted error, got: nil")
+	}
+}
@@ -0,0 +1,129 @@
+package events
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/openfaas-incubator/vcenter-connector/pkg/tracing"
+	"github.com/pkg/errors"
+	"github.com/vmware/govmomi/property"
+	vtypes "github.com/vmware/govmomi/vim25/types"
+)
+
+// enrichmentCache keeps the properties retrieved for enrichment for a short
+// time, so a burst of events for the same object results in a single
+// request to vCenter. It outlives reconnects of the stream
+type enrichmentCache struct {
+	ttl time.Duration
+
+	lock    sync.Mutex
+	entries map[vtypes.ManagedObjectReference]enrichmentEntry
+}
+
+type enrichmentEntry struct {
+	values  map[string]interface{}
+	expires time.Time
+}
+
+func newEnrichmentCache(ttl time.Duration) *enrichmentCache {
+	return &enrichmentCache{
+		ttl:     ttl,
+		entries: make(map[vtypes.ManagedObjectReference]enrichmentEntry),
+	}
+}
+
+// get returns the cached values for ref, if not expired
+func (c *enrichmentCache) get(ref vtypes.ManagedObjectReference, now time.Time) (map[string]interface{}, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	e, ok := c.entries[ref]
+	if !ok {
+		return nil, false
+	}
+	if !now.Before(e.expires) {
+		delete(c.entries, ref)
+		return nil, false
+	}
+	return e.values, true
+}
+
+// put caches the values for ref and evicts all expired entries
+func (c *enrichmentCache) put(ref vtypes.ManagedObjectReference, values map[string]interface{}, now time.Time) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for k, e := range c.entries {
+		if !now.Before(e.expires) {
+			delete(c.entries, k)
+		}
+	}
+
+	if c.ttl > 0 {
+		c.entries[ref] = enrichmentEntry{
+			values:  values,
+			expires: now.Add(c.ttl),
+		}
+	}
+}
+
+// enricher retrieves the configured properties of the managed object an event
+// refers to, e.g. "VirtualMachine": {"runtime.powerState"}
+type enricher struct {
+	pc    *property.Collector
+	rules map[string][]string
+	cache *enrichmentCache
+}
+
+// enriches returns true if properties are configured for the type of the
+// object
+func (e *enricher) enriches(ref *vtypes.ManagedObjectReference) bool {
+	if e == nil || ref == nil {
+		return false
+	}
+	_, ok := e.rules[ref.Type]
+	return ok
+}
+
+// enrich returns the configured properties of the object by property path.
+// Nil is returned if no properties are configured for the type of the object.
+// Properties which are not set are omitted
+func (e *enricher) enrich(ctx context.Context, ref *vtypes.ManagedObjectReference) (map[string]interface{}, error) {
+	if e == nil || ref == nil {
+		return nil, nil
+	}
+
+	paths, ok := e.rules[ref.Type]
+	if !ok {
+		return nil, nil
+	}
+
+	ctx, span := tracing.Start(ctx, "enrich", tracing.KindInternal, "vcenter.moref", ref.String())
+	defer span.End()
+
+	now := time.Now()
+	if values, ok := e.cache.get(*ref, now); ok {
+		span.SetAttributes("vcenter.enrichment.cached", true)
+		return values, nil
+	}
+	span.SetAttributes("vcenter.enrichment.cached", false)
+
+	var content []vtypes.ObjectContent
+	err := e.pc.Retrieve(ctx, []vtypes.ManagedObjectReference{*ref}, paths, &content)
+	if err != nil {
+		err = errors.Wrapf(err, "error retrieving properties of %s", ref)
+		span.SetError(err)
+		return nil, err
+	}
+
+	values := make(map[string]interface{})
+	for _, c := range content {
+		for _, p := range c.PropSet {
+			values[p.Name] = p.Val
+		}
+	}
+
+	e.cache.put(*ref, values, now)
+	return values, nil
+}
@@ -3,19 +3,25 @@ package events
 import (
 	"context"
 	"encoding/json"
-	"log"
-	"net/url"
+	"fmt"
 	"reflect"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 	"unicode"
 
 	ofsdk "github.com/openfaas-incubator/connector-sdk/types"
+	"github.com/openfaas-incubator/vcenter-connector/pkg/checkpoint"
+	"github.com/openfaas-incubator/vcenter-connector/pkg/deadletter"
+	"github.com/openfaas-incubator/vcenter-connector/pkg/dedupe"
+	"github.com/openfaas-incubator/vcenter-connector/pkg/logging"
+	"github.com/openfaas-incubator/vcenter-connector/pkg/metrics"
+	"github.com/openfaas-incubator/vcenter-connector/pkg/topics"
+	"github.com/openfaas-incubator/vcenter-connector/pkg/tracing"
 	"github.com/pkg/errors"
-	"github.com/vmware/govmomi"
 	"github.com/vmware/govmomi/event"
-	"github.com/vmware/govmomi/vim25"
-	"github.com/vmware/govmomi/vim25/soap"
+	"github.com/vmware/govmomi/property"
 	vtypes "github.com/vmware/govmomi/vim25/types"
 )
 
@@ -29,125 +35,604 @@ import (
 type OutboundEvent struct {
 	Topic    string `json:"topic,omitempty"`
 	Category string `json:"category,omitempty"`
-	Source   string `json:"source"`
+	// EventType is the name of the vSphere event type, e.g.
+	// "VmPoweredOnEvent", and describes the structure of Data
+	EventType string `json:"eventType"`
+	Source    string `json:"source"`
+	// SourceInstanceUUID is the instance UUID of the vCenter Server, which is
+	// unique even if several vCenter Servers are reached through the same host
+	SourceInstanceUUID string `json:"sourceInstanceUuid,omitempty"`
 
 	UserName               string                         `json:"userName,omitempty"`
 	CreatedTime            time.Time                      `json:"createdTime,omitempty"`
 	ObjectName             string                         `json:"objectName,omitempty"`
 	ManagedObjectReference *vtypes.ManagedObjectReference `json:"managedObjectReference,omitempty"`
+
+	// Datacenter, ComputeResource, Host, VM, Datastore, Network and Dvs are
+	// the entities the event refers to, if any. ObjectName and
+	// ManagedObjectReference name the most specific of them
+	Datacenter      *EntityRef `json:"datacenter,omitempty"`
+	ComputeResource *EntityRef `json:"computeResource,omitempty"`
+	Host            *EntityRef `json:"host,omitempty"`
+	VM              *EntityRef `json:"vm,omitempty"`
+	Datastore       *EntityRef `json:"datastore,omitempty"`
+	Network         *EntityRef `json:"network,omitempty"`
+	Dvs             *EntityRef `json:"dvs,omitempty"`
+
+	// EventTypeID and Arguments are only set for an EventEx or ExtendedEvent,
+	// e.g. "com.vmware.vc.HA.DasHostFailedEvent", and the key/value arguments
+	// of the event
+	EventTypeID string                 `json:"eventTypeId,omitempty"`
+	Arguments   map[string]interface{} `json:"arguments,omitempty"`
+
+	// Enrichment holds the configured properties of the managed object by
+	// property path, e.g. "runtime.powerState"
+	Enrichment map[string]interface{} `json:"enrichment,omitempty"`
+
+	// Data is the complete vSphere event, only included if enabled
+	Data vtypes.BaseEvent `json:"data,omitempty"`
+}
+
+// EntityRef is an inventory object an event refers to
+type EntityRef struct {
+	Name                   string                        `json:"name"`
+	ManagedObjectReference vtypes.ManagedObjectReference `json:"managedObjectReference"`
 }
 
 // EventReceiver implements ResponseSubscriber to validate function invocation
 // and return status
-type EventReceiver struct{}
+type EventReceiver struct {
+	lock        sync.RWMutex
+	deadLetters deadletter.Store
+}
 
-// Response prints status information for each function invokation
+// Response prints status information for each function invokation. Failed
+// invocations are added to the dead letter store, if any
 func (e *EventReceiver) Response(res ofsdk.InvokerResponse) {
-	if res.Error != nil {
-		log.Printf("function %s for topic %s returned status %d with error: %v", res.Function, res.Topic, res.Status, res.Error)
+	attempts := topics.Attempts(res.Context)
+
+	// responses without a function were never sent
+	if len(res.Function) > 0 {
+		status := strconv.Itoa(res.Status)
+		if res.Status == 0 {
+			status = "error"
+		}
+		metrics.Invocations.WithLabelValues(res.Function, status).Inc()
+	}
+
+	l := logging.FromContext(res.Context).With("topic", res.Topic, "function", res.Function, "attempts", attempts, "status", res.Status)
+
+	switch {
+	case res.Error != nil:
+		l.Error("function invocation failed", "error", res.Error)
+	case res.Status < 200 || res.Status >= 300:
+		l.Error("function invocation failed")
+	default:
+		l.Info("function invoked")
+		return
+	}
+
+	deadLetters := e.store()
+	if deadLetters == nil || len(res.Function) == 0 {
+		return
+	}
+
+	if err := deadLetters.Append(deadletter.FromResponse(res, time.Now())); err != nil {
+		l.Error("error adding message to dead letters", "error", err)
+		return
 	}
-	log.Printf("successfully invoked function %s for topic %s", res.Function, res.Topic)
+	metrics.DeadLetters.WithLabelValues(res.Function).Inc()
 }
 
 // NewEventReceiver returns an EventReceiver which implements the
 // ResponseSubscriber interface to print status information for each function
-// invokation
-func NewEventReceiver() *EventReceiver {
-	return &EventReceiver{}
+// invokation. deadLetters may be nil
+func NewEventReceiver(deadLetters deadletter.Store) *EventReceiver {
+	return &EventReceiver{deadLetters: deadLetters}
+}
+
+// SetDeadLetters replaces the dead letter store, nil stops adding failed
+// invocations
+func (e *EventReceiver) SetDeadLetters(deadLetters deadletter.Store) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.deadLetters = deadLetters
 }
 
-// NewVCenterClient returns a govmomi.Client to connect to vCenter
-func NewVCenterClient(ctx context.Context, user string, pass string, vcenterURL string, insecure bool) (*govmomi.Client, error) {
-	u, err := soap.ParseURL(vcenterURL)
+// store returns the dead letter store, nil if there is none
+func (e *EventReceiver) store() deadletter.Store {
+	e.lock.RLock()
+	defer e.lock.RUnlock()
+	return e.deadLetters
+}
+
+// StreamConfig configures the event stream
+type StreamConfig struct {
+	// Checkpoint persists the last handled event and is used to replay events
+	// missed while the connector was not running, may be nil
+	Checkpoint checkpoint.Store
+
+	// ReplayFrom, if set, replays all events created since then from the event
+	// history instead of resuming from the checkpoint
+	ReplayFrom time.Time
+
+	// ReplayTo, if set together with ReplayFrom, limits the replay to events
+	// created until then. Stream returns after the replay instead of tailing
+	ReplayTo time.Time
+
+	// Roots limits the stream to events of these inventory containers and
+	// their children, given as inventory paths or managed object references.
+	// Events for the whole inventory are streamed if empty
+	Roots []string
+
+	// PageSize is the number of events read from vCenter per page
+	PageSize int32
+
+	// Tasks enables publishing task lifecycle topics, e.g.
+	// "task.clone.vm.success", from the vCenter TaskManager
+	Tasks bool
+
+	// Properties maps managed object types to property paths which are
+	// watched for changes, e.g. "VirtualMachine": {"guest.ipAddress"}, which
+	// are published as "property.virtualmachine.guest.ipaddress.changed"
+	Properties map[string][]string
+
+	// Dedupe remembers the events handed over to the controller so an event
+	// delivered again, e.g. by overlapping collectors or after a reconnect, is
+	// skipped. It may be shared by the streams of multiple vCenter Servers and
+	// may be nil. Events of an explicit replay window are always delivered
+	Dedupe *dedupe.Cache
+
+	// Enrichment maps managed object types to property paths which are
+	// retrieved for the object of an event and attached to the message, e.g.
+	// "VirtualMachine": {"guest.ipAddress", "runtime.host"}
+	Enrichment map[string][]string
+
+	// EnrichmentTTL is the time retrieved properties are cached
+	EnrichmentTTL time.Duration
+
+	// IncludeEventData includes the complete vSphere event in the data field
+	// of the messages
+	IncludeEventData bool
+
+	// Dispatch configures the hand over of events to the controller
+	Dispatch DispatchConfig
+
+	// MinBackoff and MaxBackoff bound the delay between attempts to
+	// re-establish the vCenter session after the event stream failed
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+}
+
+// Stream is the main logic, blocking to receive and handle events from vCenter.
+// Before tailing the stream, events are replayed from the event history either
+// for the configured replay window or since the stored checkpoint. When the
+// stream fails, e.g. because the session expired or vCenter restarted, Stream
+// logs in again with exponential backoff and resumes after the last handled
+// event. It only returns when ctx is cancelled or a one-off replay finished
+func Stream(ctx context.Context, s *Session, controller ofsdk.Controller, cfg StreamConfig) error {
+	tail := cfg.ReplayTo.IsZero()
+
+	store := cfg.Checkpoint
+	if !tail {
+		// a one-off replay must not move the checkpoint of a running connector
+		// backwards
+		store = nil
+	}
+
+	t, err := newTracker(store)
 	if err != nil {
-		return nil, errors.Wrap(err, "error parsing URL")
+		return err
+	}
+
+	if err := cfg.Dispatch.validate(controller); err != nil {
+		return err
+	}
+
+	// hand over all queued events before returning
+	d := newDispatcher(controller, t, cfg.Dedupe, cfg.Dispatch)
+	defer d.close()
+
+	window := !cfg.ReplayFrom.IsZero()
+	if window {
+		// deliberately deliver events again which were handled before
+		t.reset()
 	}
 
-	u.User = url.UserPassword(user, pass)
-	return govmomi.NewClient(ctx, u, insecure)
+	// cached properties for enrichment survive reconnects
+	cache := newEnrichmentCache(cfg.EnrichmentTTL)
+
+	b := backoff{min: cfg.MinBackoff, max: cfg.MaxBackoff}
+	reconnect := false
+	for {
+		if s.Client() == nil || reconnect {
+			err = s.Login(ctx, reconnect)
+		}
+
+		if err == nil {
+			started := time.Now()
+			err = stream(ctx, s, controller, d, cfg, t, cache, window)
+			if err == nil {
+				return nil
+			}
+
+			// the replay window is only read once, afterwards resume from the
+			// last handled event
+			window = false
+
+			// a stream which was running for a while is not considered a
+			// failing attempt
+			if time.Since(started) > cfg.MaxBackoff {
+				b.reset()
+			}
+		}
+
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		// an expired session is renewed on the existing connection, anything
+		// else, e.g. a dropped connection, requires a new client
+		reconnect = !isNotAuthenticated(err)
+		if !reconnect {
+			err = s.Login(ctx, false)
+			if err == nil {
+				logging.Info("vCenter session expired, logged in again", "vcenter", s.Name())
+				continue
+			}
+			reconnect = true
+		}
+
+		s.failed(err)
+		delay := b.next()
+		logging.Error("event stream failed, reconnecting", "vcenter", s.Name(), "delay", delay, "error", err)
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(delay):
+		}
+	}
 }
 
-// Stream is the main logic, blocking to receive and handle events from vCenter
-func Stream(ctx context.Context, c *vim25.Client, controller ofsdk.Controller) error {
+// stream replays and tails events from vCenter using the client of the logged
+// in session until an error occurs or ctx is cancelled. If window is set, the
+// configured replay window is read instead of the events since the last
+// handled one
+func stream(ctx context.Context, s *Session, controller ofsdk.Controller, d *dispatcher, cfg StreamConfig, t *tracker, cache *enrichmentCache, window bool) error {
+	c := s.Client().Client
+
 	// create event manager to consume events from vCenter
 	m := event.NewManager(c)
 
-	// get events for all types (i.e. RootFolder)
-	managedTypes := []vtypes.ManagedObjectReference{c.ServiceContent.RootFolder}
-	eventsPerPage := int32(1)
-	tail := true
+	// get events for the configured inventory containers, defaults to all
+	// types (i.e. RootFolder)
+	managedTypes, err := resolveRoots(ctx, c, cfg.Roots)
+	if err != nil {
+		return err
+	}
+	eventsPerPage := cfg.PageSize
+	tail := cfg.ReplayTo.IsZero()
 	force := true
-	source := c.URL().Host
+	u := *c.URL()
+	u.User = nil
+	source := eventSource{
+		url:          u.String(),
+		host:         u.Host,
+		instanceUUID: c.ServiceContent.About.InstanceUuid,
+		session:      s,
+	}
+
+	var e *enricher
+	if len(cfg.Enrichment) > 0 {
+		e = &enricher{
+			pc:    property.DefaultCollector(c),
+			rules: cfg.Enrichment,
+			cache: cache,
+		}
+	}
 
-	recv := makeRecv(controller, m, source)
+	recv := makeRecv(ctx, d, m, source, t, e, cfg, false)
+	t.resume()
 
-	err := m.Events(ctx, managedTypes, eventsPerPage, tail, force, recv)
+	// only request the event types functions are subscribed to
+	waitForTopics(ctx, controller, topicSyncTimeout)
+	typeIDs, err := retrieveEventTypes(ctx, c)
 	if err != nil {
-		return errors.Wrap(err, "error connecting to event-stream")
+		logging.Warn("could not retrieve event types, filtering only standard events on the server", "source", source.host, "error", err)
+	}
+	known := newKnownEventTypes(typeIDs)
+	kinds, none := subscribedEventTypeIDs(controller, known, source.host)
+
+	var begin, end *time.Time
+	switch {
+	case window:
+		begin = &cfg.ReplayFrom
+		if !tail {
+			end = &cfg.ReplayTo
+		}
+		logging.Info("replaying events", "source", source.host, "from", cfg.ReplayFrom, "to", formatReplayEnd(end))
+	case t.current() != nil:
+		last := t.current()
+		begin = &last.LastEventCreatedTime
+		logging.Info("replaying events since checkpoint", "source", source.host, "eventKey", last.LastEventKey, "created", last.LastEventCreatedTime)
+	}
+
+	if begin != nil && !none {
+		replayRecv := recv
+		if window {
+			// an explicit replay redelivers events which were already handed
+			// over to the controller
+			replayRecv = makeRecv(ctx, d, m, source, t, e, cfg, true)
+		}
+		err = replay(ctx, m, managedTypes, begin, end, kinds, eventsPerPage, replayRecv)
+		if err != nil {
+			return errors.Wrap(err, "error replaying events")
+		}
+		t.resume()
+	}
+
+	if !tail {
+		logging.Info("replay finished", "source", source.host)
+		return nil
 	}
-	return nil
+
+	tailEvents := func(ctx context.Context) error {
+		for {
+			// the collectors are rebuilt when the subscribed event types change
+			streamCtx, cancel := context.WithCancel(ctx)
+			go watchKinds(streamCtx, controller, known, kinds, none, cancel)
+
+			var err error
+			if none {
+				// without event topics no collector is created until a
+				// function subscribes to one
+				logging.Info("only task and property topics subscribed, not streaming events", "source", source.host)
+				idleHeartbeat(streamCtx, s, heartbeatInterval)
+			} else {
+				logging.Info("streaming events", "source", source.host, "eventTypes", formatKinds(kinds), "roots", fmt.Sprint(managedTypes))
+				go heartbeat(streamCtx, m, managedTypes, kinds, s, heartbeatInterval)
+				err = m.Events(streamCtx, managedTypes, eventsPerPage, tail, force, recv, kinds...)
+			}
+			rebuild := streamCtx.Err() != nil && ctx.Err() == nil
+			cancel()
+
+			if !rebuild {
+				if err != nil {
+					return errors.Wrap(err, "error connecting to event-stream")
+				}
+				return nil
+			}
+
+			kinds, none = subscribedEventTypeIDs(controller, known, source.host)
+			logging.Info("subscribed topics changed, rebuilding event collectors", "source", source.host)
+
+			// catch up on events created while the collectors were rebuilt
+			if last := t.current(); last != nil && !none {
+				err = replay(ctx, m, managedTypes, &last.LastEventCreatedTime, nil, kinds, eventsPerPage, recv)
+				if err != nil {
+					return errors.Wrap(err, "error replaying events")
+				}
+			}
+			t.resume()
+		}
+	}
+
+	streams := []func(context.Context) error{tailEvents}
+	if cfg.Tasks {
+		streams = append(streams, func(ctx context.Context) error {
+			return streamTasks(ctx, c, d, source, managedTypes)
+		})
+	}
+	if len(cfg.Properties) > 0 {
+		streams = append(streams, func(ctx context.Context) error {
+			return streamProperties(ctx, c, d, source, managedTypes, cfg.Properties)
+		})
+	}
+
+	// tasks and property changes are streamed alongside events, if any of
+	// them fails all are restarted
+	return runAll(ctx, streams...)
+}
+
+// eventCategorizer returns the category of an event, i.e. *event.Manager
+type eventCategorizer interface {
+	EventCategory(ctx context.Context, event vtypes.BaseEvent) (string, error)
 }
 
 // makeRecv returns a event handler function called by the event manager on each
-// event
-func makeRecv(controller ofsdk.Controller, m *event.Manager, source string) func(managedObjectReference vtypes.ManagedObjectReference, baseEvent []vtypes.BaseEvent) error {
+// event. Events found in the dedupe cache of cfg, if any, or queued already
+// are skipped unless redeliver is set. The dispatcher, which must share the
+// dedupe cache, only records an event once it was handed over, so events
+// which failed, were dropped or were still queued when the connector stopped
+// are delivered when replayed. Events are enriched by the workers of the
+// dispatcher with ctx, the context of the stream. The enricher may be nil
+func makeRecv(ctx context.Context, d *dispatcher, m eventCategorizer, source eventSource, t *tracker, e *enricher, cfg StreamConfig, redeliver bool) func(managedObjectReference vtypes.ManagedObjectReference, baseEvent []vtypes.BaseEvent) error {
 	return func(managedObjectReference vtypes.ManagedObjectReference, baseEvent []vtypes.BaseEvent) error {
-		log.Printf("Object %v", managedObjectReference)
+		logging.Debug("received events", "source", source.host, "moref", managedObjectReference, "count", len(baseEvent))
+		// the events in a page are unordered, sort them so the checkpoint only
+		// moves forward
+		event.Sort(baseEvent)
+
+		var newest int32
+		if len(baseEvent) > 0 {
+			newest = baseEvent[len(baseEvent)-1].GetEvent().Key
+		}
+		source.session.pageReceived(time.Now(), newest)
 
-		for i, event := range baseEvent {
-			log.Printf("Event [%d] %v", i, event)
+		for _, event := range baseEvent {
+			_, ref := getObjectNameAndMoref(event)
+			l := logging.With("source", source.host, "eventKey", event.GetEvent().Key, "moref", ref)
+			if l.Enabled(logging.LevelDebug) {
+				l.Debug("received event", "event", fmt.Sprintf("%+v", event))
+			}
 
-			topic, message, err := handleEvent(event, m, source)
-			if err != nil {
-				log.Printf("error handling event: %s", err.Error())
+			metrics.StreamLag.WithLabelValues(source.host).Set(time.Since(event.GetEvent().CreatedTime).Seconds())
+
+			// every event is counted, those skipped or failing below are
+			// counted as dropped as well. The category is empty if it cannot
+			// be retrieved
+			topic := eventTopic(event)
+			category, categoryErr := m.EventCategory(ctx, event)
+			metrics.EventsReceived.WithLabelValues(topic, category).Inc()
+
+			if t.delivered(event) {
+				metrics.EventsDropped.WithLabelValues("already_delivered").Inc()
+				l.Debug("skipping event", "reason", "already delivered")
+				continue
+			}
+
+			if cfg.Dedupe != nil && !redeliver && d.duplicate(source.dedupeKey(event)) {
+				metrics.EventsDeduplicated.Inc()
+				metrics.EventsDropped.WithLabelValues("duplicate").Inc()
+				l.Info("skipping event", "reason", "duplicate")
 				continue
 			}
-			binaryMsg := []byte(message)
-			log.Printf("Message on topic: %s", topic)
-			controller.Invoke(topic, &binaryMsg)
 
+			// the span covers the handling of the event until the functions
+			// were invoked, which are its children. The dispatcher ends it
+			_, span := tracing.Start(context.Background(), "vcenter.event", tracing.KindInternal,
+				"vcenter.source", source.host,
+				"vcenter.event_type", eventTypeOf(event),
+				"vcenter.event_key", event.GetEvent().Key,
+			)
+
+			err := errors.Wrap(categoryErr, "error retrieving event category")
+			var outbound OutboundEvent
+			var message []byte
+			if err == nil {
+				outbound = newOutboundEvent(event, topic, category, source, cfg.IncludeEventData)
+				message, err = outbound.marshal()
+			}
+			if err != nil {
+				metrics.HandleEventErrors.Inc()
+				metrics.EventsDropped.WithLabelValues("error").Inc()
+				l.Error("error handling event", "error", err)
+				span.SetError(err)
+				span.End()
+				continue
+			}
+			span.SetAttributes("vcenter.topic", topic)
+			l = l.With("topic", topic)
+			l.Debug("message", "payload", message)
+
+			// queue the event for invocation, events of the same object are
+			// delivered in order
+			meta := messageMeta{
+				id:     strconv.Itoa(int(event.GetEvent().Key)),
+				source: source.url,
+				time:   event.GetEvent().CreatedTime,
+				log:    l,
+				span:   span,
+			}
+			if e.enriches(ref) {
+				meta.build = enrichMessage(ctx, e, ref, outbound)
+			}
+			if cfg.Dedupe != nil {
+				k := source.dedupeKey(event)
+				meta.dedupeKey = &k
+			}
+			d.dispatch(ref, topic, message, meta, t.queue(event))
 		}
 		return nil
 	}
 }
 
-func handleEvent(event vtypes.BaseEvent, m *event.Manager, source string) (string, string, error) {
-	// Sanity check to avoid nil pointer exception
-	if event == nil {
-		return "", "", errors.New("event must not be nil")
+// eventSource identifies the vCenter Server events originate from
+type eventSource struct {
+	url          string
+	host         string
+	instanceUUID string
+	// session records the receipt of events, may be nil
+	session *Session
+}
+
+// dedupeKey returns the key identifying the event across all vCenter Servers
+func (s eventSource) dedupeKey(e vtypes.BaseEvent) dedupe.Key {
+	id := s.instanceUUID
+	if len(id) == 0 {
+		id = s.host
 	}
 
-	// Get the type of the event, e.g. "VmPoweredOnEvent" which we'll use for subscribed topic matching
+	return dedupe.Key{
+		Source:   id,
+		EventKey: e.GetEvent().Key,
+		ChainID:  e.GetEvent().ChainId,
+	}
+}
+
+// eventTopic returns the topic of the event, e.g. "vm.powered.on"
+func eventTopic(event vtypes.BaseEvent) string {
+	// an EventEx or ExtendedEvent is matched on its event type ID instead,
+	// e.g. "com.vmware.vc.HA.DasHostFailedEvent"
+	if typeID, _ := getEventTypeIDAndArguments(event); len(typeID) > 0 {
+		return convertEventTypeIDToTopic(typeID)
+	}
+	// the type of the event, e.g. "VmPoweredOnEvent"
+	return convertToTopic(reflect.TypeOf(event).Elem().Name())
+}
+
+// newOutboundEvent converts the event into the message for the functions
+// subscribed to its topic
+func newOutboundEvent(event vtypes.BaseEvent, topic, category string, source eventSource, includeData bool) OutboundEvent {
 	eventType := reflect.TypeOf(event).Elem().Name()
-	topic := convertToTopic(eventType)
+	typeID, args := getEventTypeIDAndArguments(event)
 
-	// Retrieve user name and category from the event
+	// Retrieve user name and creation time from the event
 	user := event.GetEvent().UserName
 	createdTime := event.GetEvent().CreatedTime
-	category, err := m.EventCategory(context.Background(), event)
-	if err != nil {
-		return "", "", errors.Wrap(err, "error retrieving event category")
-	}
 
 	// Get the ManagedObjectReference by converting the event into a concrete event
 	// If we don't find a MoRef in the event, *ref will be nil and not marshaled in the OutboundEvent making it easy for the subscribed function to validate the JSON payload
 	name, ref := getObjectNameAndMoref(event)
 
-	message, err := json.Marshal(OutboundEvent{
+	outbound := OutboundEvent{
 		Topic:                  topic,
 		Category:               category,
+		EventType:              eventType,
 		UserName:               user,
 		CreatedTime:            createdTime,
 		ObjectName:             name,
 		ManagedObjectReference: ref,
-		Source:                 source,
-	})
+		Source:                 source.host,
+		SourceInstanceUUID:     source.instanceUUID,
+		EventTypeID:            typeID,
+		Arguments:              args,
+	}
+	setEntities(&outbound, event.GetEvent())
+	if includeData {
+		outbound.Data = event
+	}
+
+	return outbound
+}
+
+// marshal returns the JSON message of the event
+func (o OutboundEvent) marshal() ([]byte, error) {
+	message, err := json.Marshal(o)
 	if err != nil {
-		return "", "", errors.Wrap(err, "error marshaling outboundevent")
+		return nil, errors.Wrap(err, "error marshaling outboundevent")
 	}
+	return message, nil
+}
 
-	log.Printf("message: %s", string(message))
-	return topic, string(message), nil
+// enrichMessage returns a message builder which adds the properties retrieved
+// by the enricher to the event. The event is delivered without enrichment if
+// the properties cannot be retrieved, e.g. because the object was deleted
+func enrichMessage(streamCtx context.Context, e *enricher, ref *vtypes.ManagedObjectReference, outbound OutboundEvent) func(ctx context.Context) ([]byte, error) {
+	return func(ctx context.Context) ([]byte, error) {
+		// retrieving is cancelled with the stream, the client of a stopped
+		// stream is logged out
+		l := logging.FromContext(ctx)
+		ctx = logging.NewContext(tracing.ContextWithSpan(streamCtx, tracing.FromContext(ctx)), l)
+
+		enrichment, err := e.enrich(ctx, ref)
+		if err != nil {
+			l.Warn("error enriching event", "error", err)
+		}
+		outbound.Enrichment = enrichment
+		return outbound.marshal()
+	}
 }
 
 // getMoref extracts the ManagedObjectReference, if any, by converting the BaseEvent to a concrete event
@@ -192,11 +677,162 @@ func getObjectNameAndMoref(event vtypes.BaseEvent) (string, *vtypes.ManagedObjec
 		e := baseEvent.GetVmEvent()
 		objName = e.Vm.Name
 		ref = &e.Vm.Vm
+
+	// Cluster
+	case vtypes.BaseClusterEvent:
+		e := baseEvent.GetClusterEvent()
+		if e.ComputeResource != nil {
+			objName = e.ComputeResource.Name
+			ref = &e.ComputeResource.ComputeResource
+		}
+
+	// Datacenter
+	case vtypes.BaseDatacenterEvent:
+		e := baseEvent.GetDatacenterEvent()
+		if e.Datacenter != nil {
+			objName = e.Datacenter.Name
+			ref = &e.Datacenter.Datacenter
+		}
+
+	// Distributed Switch
+	case vtypes.BaseDvsEvent:
+		e := baseEvent.GetDvsEvent()
+		if e.Dvs != nil {
+			objName = e.Dvs.Name
+			ref = &e.Dvs.Dvs
+		}
+
+	// Distributed Port Group
+	case vtypes.BaseDVPortgroupEvent:
+		e := baseEvent.GetDVPortgroupEvent()
+		if e.Net != nil {
+			objName = e.Net.Name
+			ref = &e.Net.Network
+		}
+
+	// Extended events name their object explicitly if they carry no entity
+	case *vtypes.EventEx:
+		objName, ref = getMostSpecificEntity(&baseEvent.Event)
+		if ref == nil && len(baseEvent.ObjectType) > 0 && len(baseEvent.ObjectId) > 0 {
+			objName = baseEvent.ObjectName
+			ref = &vtypes.ManagedObjectReference{Type: baseEvent.ObjectType, Value: baseEvent.ObjectId}
+		}
+
+	case *vtypes.ExtendedEvent:
+		objName, ref = getMostSpecificEntity(&baseEvent.Event)
+		if ref == nil && len(baseEvent.ManagedObject.Type) > 0 {
+			ref = &baseEvent.ManagedObject
+		}
+
+	// any other event, e.g. a GeneralEvent, refers to the most specific entity
+	// argument it carries, if any
+	default:
+		objName, ref = getMostSpecificEntity(event.GetEvent())
 	}
 
 	return objName, ref
 }
 
+// getMostSpecificEntity returns the name and ManagedObjectReference of the most
+// specific entity argument of the event, e.g. the VM rather than its host
+func getMostSpecificEntity(e *vtypes.Event) (string, *vtypes.ManagedObjectReference) {
+	switch {
+	case e.Vm != nil:
+		return e.Vm.Name, &e.Vm.Vm
+	case e.Host != nil:
+		return e.Host.Name, &e.Host.Host
+	case e.Ds != nil:
+		return e.Ds.Name, &e.Ds.Datastore
+	case e.Net != nil:
+		return e.Net.Name, &e.Net.Network
+	case e.Dvs != nil:
+		return e.Dvs.Name, &e.Dvs.Dvs
+	case e.ComputeResource != nil:
+		return e.ComputeResource.Name, &e.ComputeResource.ComputeResource
+	case e.Datacenter != nil:
+		return e.Datacenter.Name, &e.Datacenter.Datacenter
+	}
+	return "", nil
+}
+
+// setEntities copies all entity arguments of the event to the outbound event
+func setEntities(out *OutboundEvent, e *vtypes.Event) {
+	if e.Datacenter != nil {
+		out.Datacenter = &EntityRef{Name: e.Datacenter.Name, ManagedObjectReference: e.Datacenter.Datacenter}
+	}
+	if e.ComputeResource != nil {
+		out.ComputeResource = &EntityRef{Name: e.ComputeResource.Name, ManagedObjectReference: e.ComputeResource.ComputeResource}
+	}
+	if e.Host != nil {
+		out.Host = &EntityRef{Name: e.Host.Name, ManagedObjectReference: e.Host.Host}
+	}
+	if e.Vm != nil {
+		out.VM = &EntityRef{Name: e.Vm.Name, ManagedObjectReference: e.Vm.Vm}
+	}
+	if e.Ds != nil {
+		out.Datastore = &EntityRef{Name: e.Ds.Name, ManagedObjectReference: e.Ds.Datastore}
+	}
+	if e.Net != nil {
+		out.Network = &EntityRef{Name: e.Net.Name, ManagedObjectReference: e.Net.Network}
+	}
+	if e.Dvs != nil {
+		out.Dvs = &EntityRef{Name: e.Dvs.Name, ManagedObjectReference: e.Dvs.Dvs}
+	}
+}
+
+// eventTypeOf returns the event type ID of an EventEx or ExtendedEvent and the
+// type name of all other events, e.g. "VmPoweredOnEvent"
+func eventTypeOf(event vtypes.BaseEvent) string {
+	if event == nil {
+		return ""
+	}
+	if typeID, _ := getEventTypeIDAndArguments(event); len(typeID) > 0 {
+		return typeID
+	}
+	return reflect.TypeOf(event).Elem().Name()
+}
+
+// getEventTypeIDAndArguments returns the event type ID and arguments of an
+// EventEx or ExtendedEvent, for all other events the type ID is empty
+func getEventTypeIDAndArguments(event vtypes.BaseEvent) (string, map[string]interface{}) {
+	args := make(map[string]interface{})
+
+	switch e := event.(type) {
+	case *vtypes.EventEx:
+		for _, arg := range e.Arguments {
+			args[arg.Key] = arg.Value
+		}
+		return e.EventTypeId, args
+
+	case *vtypes.ExtendedEvent:
+		for _, pair := range e.Data {
+			args[pair.Key] = pair.Value
+		}
+		return e.EventTypeId, args
+	}
+
+	return "", nil
+}
+
+// convertEventTypeIDToTopic converts the event type ID of an EventEx or
+// ExtendedEvent to an OpenFaaS subscriber topic, e.g.
+// "com.vmware.vc.HA.DasHostFailedEvent" to "com.vmware.vc.ha.das.host.failed"
+func convertEventTypeIDToTopic(typeID string) string {
+	segments := strings.Split(typeID, ".")
+
+	var parts []string
+	for i, segment := range segments {
+		if i == len(segments)-1 && segment != "Event" {
+			segment = strings.TrimSuffix(segment, "Event")
+		}
+		if len(segment) > 0 {
+			parts = append(parts, camelCaseToLowerSeparated(segment, "."))
+		}
+	}
+
+	return strings.Join(parts, ".")
+}
+
 // convertToTopic converts an event type to an OpenFaaS subscriber topic, e.g.
 // "VmPoweredOnEvent" to "vm.powered.on"
 func convertToTopic(eventType string) string {
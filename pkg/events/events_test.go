@@ -1,9 +1,18 @@
 package events
 
 import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
 	"reflect"
 	"testing"
+	"time"
 
+	ofsdk "github.com/openfaas-incubator/connector-sdk/types"
+	"github.com/openfaas-incubator/vcenter-connector/pkg/deadletter"
+	"github.com/openfaas-incubator/vcenter-connector/pkg/dedupe"
+	"github.com/openfaas-incubator/vcenter-connector/pkg/logging"
+	"github.com/pkg/errors"
 	vtypes "github.com/vmware/govmomi/vim25/types"
 )
 
@@ -34,6 +43,51 @@ var (
 		},
 	}
 
+	clusterEvent = &vtypes.ClusterReconfiguredEvent{
+		ClusterEvent: vtypes.ClusterEvent{
+			Event: vtypes.Event{
+				Datacenter: &vtypes.DatacenterEventArgument{
+					EntityEventArgument: vtypes.EntityEventArgument{Name: "DC0"},
+					Datacenter:          vtypes.ManagedObjectReference{Type: "Datacenter", Value: "datacenter-2"},
+				},
+				ComputeResource: &vtypes.ComputeResourceEventArgument{
+					EntityEventArgument: vtypes.EntityEventArgument{Name: "Cluster0"},
+					ComputeResource:     vtypes.ManagedObjectReference{Type: "ClusterComputeResource", Value: "domain-c7"},
+				},
+			},
+		},
+	}
+
+	dvsEvent = &vtypes.DvsCreatedEvent{
+		DvsEvent: vtypes.DvsEvent{
+			Event: vtypes.Event{
+				Dvs: &vtypes.DvsEventArgument{
+					EntityEventArgument: vtypes.EntityEventArgument{Name: "DSwitch0"},
+					Dvs:                 vtypes.ManagedObjectReference{Type: "VmwareDistributedVirtualSwitch", Value: "dvs-21"},
+				},
+			},
+		},
+	}
+
+	generalEvent = &vtypes.GeneralHostInfoEvent{
+		GeneralEvent: vtypes.GeneralEvent{
+			Event: vtypes.Event{
+				ComputeResource: clusterEvent.ComputeResource,
+				Host: &vtypes.HostEventArgument{
+					EntityEventArgument: vtypes.EntityEventArgument{Name: "esx-01"},
+					Host:                vtypes.ManagedObjectReference{Type: "HostSystem", Value: "host-21"},
+				},
+			},
+		},
+	}
+
+	eventEx = &vtypes.EventEx{
+		EventTypeId: "com.vmware.cl.CreateLibraryEvent",
+		ObjectId:    "a3b2c1",
+		ObjectType:  "com.vmware.content.Library",
+		ObjectName:  "templates",
+	}
+
 	unsupportedEvent = &vtypes.LicenseEvent{
 		Event: vtypes.Event{},
 	}
@@ -49,6 +103,11 @@ func TestGetObjectNameAndMoRef(t *testing.T) {
 	}{
 		{"valid VM Event", vmEvent, &vmEvent.Vm.Vm, "Windows10-1234"},
 		{"valid ResourcePool Event", resourcePoolEvent, &resourcePoolEvent.ResourcePool.ResourcePool, "Management-RP-1234"},
+		{"valid Cluster Event", clusterEvent, &clusterEvent.ComputeResource.ComputeResource, "Cluster0"},
+		{"valid Dvs Event", dvsEvent, &dvsEvent.Dvs.Dvs, "DSwitch0"},
+		// assert that the most specific entity is used for other events
+		{"General Event with host and cluster", generalEvent, &generalEvent.Host.Host, "esx-01"},
+		{"EventEx without entity", eventEx, &vtypes.ManagedObjectReference{Type: "com.vmware.content.Library", Value: "a3b2c1"}, "templates"},
 		// assert that ManagedObjectReference and ObjectName will be nil for events we don't support (yet), so it won't be marshaled in the outbound JSON
 		{"unsupported Event", unsupportedEvent, nil, ""},
 	}
@@ -67,3 +126,562 @@ func TestGetObjectNameAndMoRef(t *testing.T) {
 		}
 	}
 }
+
+func TestSetEntities(t *testing.T) {
+	var testCases = []struct {
+		name  string
+		event vtypes.BaseEvent
+		want  OutboundEvent
+	}{
+		{"cluster event", clusterEvent, OutboundEvent{
+			Datacenter:      &EntityRef{Name: "DC0", ManagedObjectReference: clusterEvent.Datacenter.Datacenter},
+			ComputeResource: &EntityRef{Name: "Cluster0", ManagedObjectReference: clusterEvent.ComputeResource.ComputeResource},
+		}},
+		{"vm event", vmEvent, OutboundEvent{
+			VM: &EntityRef{Name: "Windows10-1234", ManagedObjectReference: vmEvent.Vm.Vm},
+		}},
+		{"event without entities", unsupportedEvent, OutboundEvent{}},
+	}
+
+	for _, test := range testCases {
+		var got OutboundEvent
+		setEntities(&got, test.event.GetEvent())
+		if eq := reflect.DeepEqual(test.want, got); !eq {
+			t.Errorf("%s: wanted: %+v, got: %+v", test.name, test.want, got)
+		}
+	}
+}
+
+func TestTrackerDelivered(t *testing.T) {
+	tr, err := newTracker(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	older := &vtypes.VmEvent{Event: vtypes.Event{Key: 10}}
+	last := &vtypes.VmEvent{Event: vtypes.Event{Key: 11}}
+	newer := &vtypes.VmEvent{Event: vtypes.Event{Key: 12}}
+
+	// assert that nothing is skipped without a checkpoint
+	if tr.delivered(older) {
+		t.Errorf("without checkpoint: event %d reported as delivered", older.Key)
+	}
+
+	tr.queue(last)
+
+	// assert that queued events are only skipped after the stream restarted
+	if tr.delivered(older) {
+		t.Errorf("before resume: event %d reported as delivered", older.Key)
+	}
+	tr.resume()
+
+	var testCases = []struct {
+		name  string
+		event vtypes.BaseEvent
+		want  bool
+	}{
+		{"older Event", older, true},
+		{"last Event", last, true},
+		{"newer Event", newer, false},
+	}
+
+	for _, test := range testCases {
+		if got := tr.delivered(test.event); got != test.want {
+			t.Errorf("%s: wanted: %v, got: %v", test.name, test.want, got)
+		}
+	}
+}
+
+func TestTrackerDone(t *testing.T) {
+	tr, err := newTracker(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first := tr.queue(&vtypes.VmEvent{Event: vtypes.Event{Key: 1}})
+	second := tr.queue(&vtypes.VmEvent{Event: vtypes.Event{Key: 2}})
+	third := tr.queue(&vtypes.VmEvent{Event: vtypes.Event{Key: 3}})
+
+	var testCases = []struct {
+		name string
+		done *position
+		want int32
+	}{
+		// assert that the position does not move past events still queued
+		{"second done", second, 0},
+		{"first done", first, 2},
+		{"third done", third, 3},
+	}
+
+	for _, test := range testCases {
+		if err := tr.done(test.done); err != nil {
+			t.Fatal(err)
+		}
+
+		var got int32
+		if cp := tr.current(); cp != nil {
+			got = cp.LastEventKey
+		}
+		if got != test.want {
+			t.Errorf("%s: wanted: %d, got: %d", test.name, test.want, got)
+		}
+	}
+}
+
+func TestEventTypeIDs(t *testing.T) {
+	known := newKnownEventTypes([]string{
+		"VmPoweredOnEvent",
+		"VmPoweredOffEvent",
+		"com.vmware.vc.HA.DasHostFailedEvent",
+		"com.vmware.vc.vm.VmStateFailedToRevertToSnapshot",
+	})
+
+	var testCases = []struct {
+		name         string
+		topics       []string
+		known        knownEventTypes
+		want         []string
+		wantUnmapped string
+		wantNone     bool
+	}{
+		{"no topics", nil, nil, nil, "", false},
+		{"single topic", []string{"vm.powered.on"}, nil, []string{"VmPoweredOnEvent"}, "", false},
+		{"upper case segment", []string{"dv.portgroup.created"}, nil, []string{"DVPortgroupCreatedEvent"}, "", false},
+		{"sorted and unique", []string{"vm.powered.off", "drs.vm.powered.on", "vm.powered.off"}, nil, []string{"DrsVmPoweredOnEvent", "VmPoweredOffEvent"}, "", false},
+		// assert that no filter is applied if any topic is unknown, so no event is dropped
+		{"unknown topic", []string{"vm.powered.on", "my.custom.topic"}, known, nil, "my.custom.topic", false},
+		{"empty segment", []string{"vm..on"}, nil, nil, "vm..on", false},
+		// assert that task topics don't disable the filter
+		{"task topic", []string{"vm.powered.on", "task.clone.vm.success"}, nil, []string{"VmPoweredOnEvent"}, "", false},
+		// assert that no event is streamed for task and property topics only
+		{"task topic only", []string{"task.clone.vm.success"}, nil, nil, "", true},
+		{"task and property topics", []string{"task.clone.vm.success", "property.virtualmachine.name.changed"}, nil, nil, "", true},
+		{"extended event", []string{"vm.powered.on", "com.vmware.vc.ha.das.host.failed"}, known, []string{"VmPoweredOnEvent", "com.vmware.vc.HA.DasHostFailedEvent"}, "", false},
+		{"extended event unknown", []string{"com.vmware.vc.ha.das.host.failed"}, nil, nil, "com.vmware.vc.ha.das.host.failed", false},
+		{"pattern", []string{"vm.powered.*", "com.vmware.vc.#"}, known, []string{
+			"VmPoweredOffEvent", "VmPoweredOnEvent", "com.vmware.vc.HA.DasHostFailedEvent", "com.vmware.vc.vm.VmStateFailedToRevertToSnapshot",
+		}, "", false},
+		{"pattern without known types", []string{"vm.#"}, nil, nil, "vm.#", false},
+	}
+
+	for _, test := range testCases {
+		got, unmapped, none := eventTypeIDs(test.topics, test.known)
+		if eq := reflect.DeepEqual(test.want, got); !eq {
+			t.Errorf("%s: wanted: %v, got: %v", test.name, test.want, got)
+		}
+		if unmapped != test.wantUnmapped {
+			t.Errorf("%s: unmapped: wanted: %v, got: %v", test.name, test.wantUnmapped, unmapped)
+		}
+		if none != test.wantNone {
+			t.Errorf("%s: none: wanted: %v, got: %v", test.name, test.wantNone, none)
+		}
+	}
+}
+
+func TestIsMoref(t *testing.T) {
+	var testCases = []struct {
+		root string
+		want bool
+	}{
+		{"Datacenter:datacenter-2", true},
+		{"ClusterComputeResource:domain-c7", true},
+		{"/DC0/host/Cluster0", false},
+		{"DC0/vm/Team:A", false},
+		{"DC0", false},
+	}
+
+	for _, test := range testCases {
+		if got := isMoref(test.root); got != test.want {
+			t.Errorf("%s: wanted: %v, got: %v", test.root, test.want, got)
+		}
+	}
+}
+
+func TestTaskTopic(t *testing.T) {
+	var testCases = []struct {
+		name string
+		info vtypes.TaskInfo
+		want string
+	}{
+		{"queued clone", vtypes.TaskInfo{Name: "CloneVM_Task", DescriptionId: "VirtualMachine.clone", State: vtypes.TaskInfoStateQueued}, "task.clone.vm.queued"},
+		{"failed clone", vtypes.TaskInfo{Name: "CloneVM_Task", DescriptionId: "VirtualMachine.clone", State: vtypes.TaskInfoStateError}, "task.clone.vm.error"},
+		{"successful storage migration", vtypes.TaskInfo{Name: "RelocateVM_Task", DescriptionId: "VirtualMachine.relocate", State: vtypes.TaskInfoStateSuccess}, "task.relocate.vm.success"},
+		{"task without method name", vtypes.TaskInfo{DescriptionId: "Drm.ExecuteVMotionLRO", State: vtypes.TaskInfoStateRunning}, "task.drm.execute.v.motion.lro.running"},
+	}
+
+	for _, test := range testCases {
+		if got := taskTopic(test.info); got != test.want {
+			t.Errorf("%s: wanted: %v, got: %v", test.name, test.want, got)
+		}
+	}
+}
+
+func TestPropertyTopic(t *testing.T) {
+	var testCases = []struct {
+		name string
+		kind string
+		path string
+		want string
+	}{
+		{"guest ip", "VirtualMachine", "guest.ipAddress", "property.virtualmachine.guest.ipaddress.changed"},
+		{"datastore free space", "Datastore", "summary.freeSpace", "property.datastore.summary.freespace.changed"},
+		{"host connection state", "HostSystem", "runtime.connectionState", "property.hostsystem.runtime.connectionstate.changed"},
+	}
+
+	for _, test := range testCases {
+		if got := propertyTopic(test.kind, test.path); got != test.want {
+			t.Errorf("%s: wanted: %v, got: %v", test.name, test.want, got)
+		}
+	}
+}
+
+func TestParseTypeProperty(t *testing.T) {
+	var testCases = []struct {
+		name    string
+		values  []string
+		want    map[string][]string
+		wantErr bool
+	}{
+		{"single", []string{"VirtualMachine:guest.ipAddress"}, map[string][]string{"VirtualMachine": {"guest.ipAddress"}}, false},
+		{"multiple paths", []string{"VirtualMachine:guest.ipAddress", "VirtualMachine:runtime.powerState", "VirtualMachine:guest.ipAddress"}, map[string][]string{"VirtualMachine": {"guest.ipAddress", "runtime.powerState"}}, false},
+		{"missing path", []string{"VirtualMachine:"}, nil, true},
+		{"missing type", []string{"guest.ipAddress"}, nil, true},
+	}
+
+	for _, test := range testCases {
+		got := make(map[string][]string)
+		var err error
+		for _, value := range test.values {
+			if err = ParseTypeProperty(got, value); err != nil {
+				break
+			}
+		}
+
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s: wanted error: %v, got: %v", test.name, test.wantErr, err)
+			continue
+		}
+		if !test.wantErr && !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: wanted: %v, got: %v", test.name, test.want, got)
+		}
+	}
+}
+
+func TestEnrichmentCache(t *testing.T) {
+	now := time.Date(2019, 11, 4, 10, 0, 0, 0, time.UTC)
+	vm := vtypes.ManagedObjectReference{Type: "VirtualMachine", Value: "vm-42"}
+	values := map[string]interface{}{"runtime.powerState": "poweredOn"}
+
+	c := newEnrichmentCache(30 * time.Second)
+	c.put(vm, values, now)
+
+	var testCases = []struct {
+		name string
+		now  time.Time
+		want bool
+	}{
+		{"within ttl", now.Add(29 * time.Second), true},
+		{"expired", now.Add(30 * time.Second), false},
+		{"evicted", now, false},
+	}
+
+	for _, test := range testCases {
+		if _, got := c.get(vm, test.now); got != test.want {
+			t.Errorf("%s: wanted: %v, got: %v", test.name, test.want, got)
+		}
+	}
+
+	// a zero ttl disables caching
+	c = newEnrichmentCache(0)
+	c.put(vm, values, now)
+	if _, got := c.get(vm, now); got {
+		t.Errorf("zero ttl: wanted: %v, got: %v", false, got)
+	}
+}
+
+func TestOutboundEventData(t *testing.T) {
+	migrated := &vtypes.VmMigratedEvent{
+		VmEvent: vtypes.VmEvent{
+			Event: vtypes.Event{
+				Key:                  42,
+				ChainId:              41,
+				FullFormattedMessage: "Migration of Windows10-1234 completed",
+			},
+		},
+		SourceHost: vtypes.HostEventArgument{
+			EntityEventArgument: vtypes.EntityEventArgument{Name: "esx-01"},
+		},
+	}
+
+	var testCases = []struct {
+		name  string
+		event OutboundEvent
+		want  bool
+	}{
+		{"without data", OutboundEvent{EventType: "VmMigratedEvent"}, false},
+		{"with data", OutboundEvent{EventType: "VmMigratedEvent", Data: migrated}, true},
+	}
+
+	for _, test := range testCases {
+		b, err := json.Marshal(test.event)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+
+		var got struct {
+			EventType string                 `json:"eventType"`
+			Data      map[string]interface{} `json:"data"`
+		}
+		if err := json.Unmarshal(b, &got); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+
+		if got.EventType != test.event.EventType {
+			t.Errorf("%s: wanted: %v, got: %v", test.name, test.event.EventType, got.EventType)
+		}
+		if (got.Data != nil) != test.want {
+			t.Errorf("%s: wanted data: %v, got: %v", test.name, test.want, got.Data)
+		}
+		if test.want && got.Data["FullFormattedMessage"] != migrated.FullFormattedMessage {
+			t.Errorf("%s: wanted: %v, got: %v", test.name, migrated.FullFormattedMessage, got.Data["FullFormattedMessage"])
+		}
+	}
+}
+
+func TestConvertEventTypeIDToTopic(t *testing.T) {
+	var testCases = []struct {
+		name   string
+		typeID string
+		want   string
+	}{
+		{"HA event", "com.vmware.vc.HA.DasHostFailedEvent", "com.vmware.vc.ha.das.host.failed"},
+		{"certificate event", "vpxd.cert.CertExpirationEvent", "vpxd.cert.cert.expiration"},
+		{"content library event", "com.vmware.cl.CreateLibraryEvent", "com.vmware.cl.create.library"},
+		{"lower case id", "esx.problem.vob.vsan.lsom.diskerror", "esx.problem.vob.vsan.lsom.diskerror"},
+	}
+
+	for _, test := range testCases {
+		if got := convertEventTypeIDToTopic(test.typeID); got != test.want {
+			t.Errorf("%s: wanted: %v, got: %v", test.name, test.want, got)
+		}
+	}
+}
+
+func TestGetEventTypeIDAndArguments(t *testing.T) {
+	var testCases = []struct {
+		name       string
+		event      vtypes.BaseEvent
+		wantTypeID string
+		wantArgs   map[string]interface{}
+	}{
+		{"EventEx", &vtypes.EventEx{
+			EventTypeId: "com.vmware.vc.HA.DasHostFailedEvent",
+			Arguments:   []vtypes.KeyAnyValue{{Key: "hostName", Value: "esx-01"}},
+		}, "com.vmware.vc.HA.DasHostFailedEvent", map[string]interface{}{"hostName": "esx-01"}},
+		{"ExtendedEvent", &vtypes.ExtendedEvent{
+			EventTypeId: "com.example.backup.finished",
+			Data:        []vtypes.ExtendedEventPair{{Key: "job", Value: "nightly"}},
+		}, "com.example.backup.finished", map[string]interface{}{"job": "nightly"}},
+		{"VmEvent", vmEvent, "", nil},
+	}
+
+	for _, test := range testCases {
+		typeID, args := getEventTypeIDAndArguments(test.event)
+		if typeID != test.wantTypeID {
+			t.Errorf("%s: wanted: %v, got: %v", test.name, test.wantTypeID, typeID)
+		}
+		if eq := reflect.DeepEqual(test.wantArgs, args); !eq {
+			t.Errorf("%s: wanted: %v, got: %v", test.name, test.wantArgs, args)
+		}
+	}
+}
+
+// failingCategorizer fails to categorize the first failures events
+type failingCategorizer struct {
+	failures int
+}
+
+func (c *failingCategorizer) EventCategory(ctx context.Context, event vtypes.BaseEvent) (string, error) {
+	if c.failures > 0 {
+		c.failures--
+		return "", errors.New("not connected")
+	}
+	return "info", nil
+}
+
+func TestRecvDedupeAfterFailure(t *testing.T) {
+	controller := &recordingController{messages: make(map[string][]string)}
+	tr, err := newTracker(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := StreamConfig{Dedupe: dedupe.NewCache(10)}
+	d := newDispatcher(controller, tr, cfg.Dedupe, DispatchConfig{})
+
+	recv := makeRecv(context.Background(), d, &failingCategorizer{failures: 1}, eventSource{host: "vc01"}, tr, nil, cfg, false)
+
+	event := &vtypes.VmPoweredOnEvent{VmEvent: vtypes.VmEvent{Event: vmEvent.Event}}
+	event.Key = 42
+
+	// the first attempt fails, the replayed event must still be delivered
+	// once and its duplicates skipped
+	for i := 0; i < 3; i++ {
+		if err := recv(vtypes.ManagedObjectReference{}, []vtypes.BaseEvent{event}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	d.close()
+
+	if got := len(controller.messages["vm.powered.on"]); got != 1 {
+		t.Errorf("wanted: %v, got: %v (%v)", 1, got, controller.messages)
+	}
+}
+
+// blockingController blocks all invocations until it is released, like a
+// connector which stops before its queued events were handed over
+type blockingController struct {
+	recordingController
+	release chan struct{}
+}
+
+func (c *blockingController) InvokeWithContext(ctx context.Context, topic string, message *[]byte) {
+	<-c.release
+}
+
+func TestRecvDedupeAfterStop(t *testing.T) {
+	cache := dedupe.NewCache(10)
+	cfg := StreamConfig{Dedupe: cache}
+	source := eventSource{host: "vc01"}
+
+	event := &vtypes.VmPoweredOnEvent{VmEvent: vtypes.VmEvent{Event: vmEvent.Event}}
+	event.Key = 42
+
+	// the event is queued but the connector stops before it is handed over
+	stopped := &blockingController{release: make(chan struct{})}
+	tr, err := newTracker(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := newDispatcher(stopped, tr, cache, DispatchConfig{})
+	defer func() {
+		close(stopped.release)
+		d.close()
+	}()
+	recv := makeRecv(context.Background(), d, &failingCategorizer{}, source, tr, nil, cfg, false)
+	if err := recv(vtypes.ManagedObjectReference{}, []vtypes.BaseEvent{event}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the replayed event is delivered after the restart
+	controller := &recordingController{messages: make(map[string][]string)}
+	tr, err = newTracker(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restarted := newDispatcher(controller, tr, cache, DispatchConfig{})
+	recv = makeRecv(context.Background(), restarted, &failingCategorizer{}, source, tr, nil, cfg, false)
+	if err := recv(vtypes.ManagedObjectReference{}, []vtypes.BaseEvent{event}); err != nil {
+		t.Fatal(err)
+	}
+	restarted.close()
+
+	if got := len(controller.messages["vm.powered.on"]); got != 1 {
+		t.Errorf("wanted: %v, got: %v (%v)", 1, got, controller.messages)
+	}
+	if !cache.Contains(source.dedupeKey(event)) {
+		t.Errorf("wanted: event recorded after the hand-over")
+	}
+}
+
+// memoryStore is a dead letter store in memory
+type memoryStore struct {
+	entries []deadletter.Entry
+}
+
+func (s *memoryStore) Append(e deadletter.Entry) error {
+	s.entries = append(s.entries, e)
+	return nil
+}
+
+func (s *memoryStore) List() ([]deadletter.Entry, error) { return s.entries, nil }
+
+func (s *memoryStore) Replace(n int, entries []deadletter.Entry) error {
+	s.entries = append(entries, s.entries[n:]...)
+	return nil
+}
+
+func TestEventReceiverSetDeadLetters(t *testing.T) {
+	defer logging.SetDefault(logging.Default())
+	logger, err := logging.New(ioutil.Discard, logging.LevelInfo, logging.FormatLogfmt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logging.SetDefault(logger)
+
+	failed := ofsdk.InvokerResponse{Context: context.Background(), Topic: "vm.powered.on", Function: "fn1", Status: 502}
+
+	e := NewEventReceiver(nil)
+	e.Response(failed)
+
+	first, second := &memoryStore{}, &memoryStore{}
+	e.SetDeadLetters(first)
+	e.Response(failed)
+	e.SetDeadLetters(second)
+	e.Response(failed)
+	e.SetDeadLetters(nil)
+	e.Response(failed)
+
+	if len(first.entries) != 1 || len(second.entries) != 1 {
+		t.Errorf("wanted: 1 entry per store, got: %d, %d", len(first.entries), len(second.entries))
+	}
+}
+
+func TestScopeContains(t *testing.T) {
+	cluster := vtypes.ManagedObjectReference{Type: "ClusterComputeResource", Value: "domain-c7"}
+	vm := vtypes.ManagedObjectReference{Type: "VirtualMachine", Value: "vm-42"}
+	created := vtypes.ManagedObjectReference{Type: "VirtualMachine", Value: "vm-43"}
+	other := vtypes.ManagedObjectReference{Type: "VirtualMachine", Value: "vm-99"}
+
+	below := []vtypes.ManagedObjectReference{vm}
+	lists := 0
+	s := newListScope([]vtypes.ManagedObjectReference{cluster}, func(context.Context) ([]vtypes.ManagedObjectReference, error) {
+		lists++
+		return below, nil
+	})
+
+	var testCases = []struct {
+		name      string
+		entity    *vtypes.ManagedObjectReference
+		create    bool
+		want      bool
+		wantLists int
+	}{
+		{"root", &cluster, false, true, 0},
+		{"entity below root", &vm, false, true, 1},
+		{"cached entity", &vm, false, true, 1},
+		{"entity outside roots", &other, false, false, 2},
+		{"entity created below root", &created, true, true, 3},
+		{"no entity", nil, false, false, 3},
+	}
+
+	for _, test := range testCases {
+		if test.create {
+			below = append(below, created)
+		}
+		got, err := s.contains(context.Background(), test.entity)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", test.name, err)
+		}
+		if got != test.want {
+			t.Errorf("%s: wanted: %v, got: %v", test.name, test.want, got)
+		}
+		if lists != test.wantLists {
+			t.Errorf("%s: wanted lists: %d, got: %d", test.name, test.wantLists, lists)
+		}
+	}
+
+	var all *scope
+	if ok, _ := all.contains(context.Background(), &other); !ok {
+		t.Errorf("nil scope: wanted: true, got: false")
+	}
+}
@@ -0,0 +1,120 @@
+package events
+
+import (
+	"context"
+	"time"
+
+	"github.com/openfaas-incubator/vcenter-connector/pkg/logging"
+	"github.com/pkg/errors"
+	"github.com/vmware/govmomi/event"
+	vtypes "github.com/vmware/govmomi/vim25/types"
+)
+
+// heartbeatInterval is how often the newest event in vCenter is compared with
+// the newest event received
+const heartbeatInterval = time.Minute
+
+// heartbeat records a heartbeat on the session whenever vCenter holds no
+// event for the objects and kinds which the event stream did not receive yet.
+// Unlike the time of the last page of events this tells a quiet vCenter
+// Server apart from a stuck event collector. Events which existed at the first
+// comparison are not expected, the stream only tails newer ones. It runs until
+// ctx is done
+func heartbeat(ctx context.Context, m *event.Manager, objects []vtypes.ManagedObjectReference, kinds []string, s *Session, interval time.Duration) {
+	var collectors []*event.HistoryCollector
+	defer func() {
+		for _, c := range collectors {
+			_ = c.Destroy(context.Background())
+		}
+	}()
+
+	// the collectors use the filter of the collectors of the stream
+	for _, obj := range objects {
+		filter := vtypes.EventFilterSpec{
+			Entity: &vtypes.EventFilterSpecByEntity{
+				Entity:    obj,
+				Recursion: vtypes.EventFilterSpecRecursionOptionAll,
+			},
+			EventTypeId: kinds,
+		}
+
+		c, err := m.CreateCollectorForEvents(ctx, filter)
+		if err == nil {
+			collectors = append(collectors, c)
+			err = c.SetPageSize(ctx, 1)
+		}
+		if err != nil {
+			if ctx.Err() == nil {
+				logging.Warn("could not create event collector for heartbeats", "source", s.Name(), "error", err)
+			}
+			return
+		}
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	baseline := int32(-1)
+	for {
+		latest, err := latestEventKey(ctx, collectors)
+		switch {
+		case err != nil:
+			if ctx.Err() == nil {
+				logging.Warn("could not read the latest event for heartbeats", "source", s.Name(), "error", err)
+			}
+		case baseline < 0:
+			baseline = latest
+			s.heartbeat(time.Now())
+		case upToDate(latest, baseline, s.Status().LastEventKey):
+			s.heartbeat(time.Now())
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// idleHeartbeat records a heartbeat on the session every interval, as the
+// event stream is up to date while no event topic is subscribed and thus no
+// event collector exists. It runs until ctx is done
+func idleHeartbeat(ctx context.Context, s *Session, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		s.heartbeat(time.Now())
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// latestEventKey returns the key of the newest event of the collectors, 0 if
+// there is none
+func latestEventKey(ctx context.Context, collectors []*event.HistoryCollector) (int32, error) {
+	var latest int32
+	for _, c := range collectors {
+		events, err := c.LatestPage(ctx)
+		if err != nil {
+			return 0, errors.Wrap(err, "error reading latest events")
+		}
+		for _, e := range events {
+			if key := e.GetEvent().Key; key > latest {
+				latest = key
+			}
+		}
+	}
+	return latest, nil
+}
+
+// upToDate returns true if the newest event in vCenter was either there when
+// heartbeats started or was received already
+func upToDate(latest, baseline, received int32) bool {
+	return latest <= baseline || latest <= received
+}
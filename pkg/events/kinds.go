@@ -0,0 +1,217 @@
+package events
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	ofsdk "github.com/openfaas-incubator/connector-sdk/types"
+	"github.com/openfaas-incubator/vcenter-connector/pkg/logging"
+	"github.com/openfaas-incubator/vcenter-connector/pkg/topics"
+	"github.com/pkg/errors"
+	"github.com/vmware/govmomi/property"
+	"github.com/vmware/govmomi/vim25"
+	"github.com/vmware/govmomi/vim25/mo"
+	vtypes "github.com/vmware/govmomi/vim25/types"
+)
+
+// topicCheckInterval is the interval at which the subscribed topics are
+// checked for changes which require the event collectors to be rebuilt
+const topicCheckInterval = 10 * time.Second
+
+// maxTopicSegments limits the number of case variants tried when looking up
+// the event type for a topic
+const maxTopicSegments = 10
+
+var baseEventType = reflect.TypeOf((*vtypes.BaseEvent)(nil)).Elem()
+
+// knownEventTypes maps topics to the event type IDs of a vCenter Server
+// publishing on them, which includes the type IDs of extended events, e.g.
+// "com.vmware.vc.ha.das.host.failed" to "com.vmware.vc.HA.DasHostFailedEvent"
+type knownEventTypes map[string][]string
+
+// newKnownEventTypes maps the event type IDs to their topics like eventTopic
+func newKnownEventTypes(ids []string) knownEventTypes {
+	typeFunc := vtypes.TypeFunc()
+	known := make(knownEventTypes, len(ids))
+	for _, id := range ids {
+		topic := convertEventTypeIDToTopic(id)
+		if typ, ok := typeFunc(id); ok && reflect.PtrTo(typ).Implements(baseEventType) {
+			topic = convertToTopic(id)
+		}
+		known[topic] = append(known[topic], id)
+	}
+	return known
+}
+
+// retrieveEventTypes returns the event type IDs described by the event
+// manager of the vCenter Server
+func retrieveEventTypes(ctx context.Context, c *vim25.Client) ([]string, error) {
+	var m mo.EventManager
+	err := property.DefaultCollector(c).RetrieveOne(ctx, *c.ServiceContent.EventManager, []string{"description.eventInfo"}, &m)
+	if err != nil {
+		return nil, errors.Wrap(err, "error retrieving event types")
+	}
+
+	ids := make([]string, 0, len(m.Description.EventInfo))
+	for _, info := range m.Description.EventInfo {
+		ids = append(ids, info.Key)
+	}
+	return ids, nil
+}
+
+// eventTypeIDs returns the sorted vSphere event type IDs, e.g.
+// "VmPoweredOnEvent", for the given topics to be used as server-side filter
+// of the event collectors. Topics of extended events and patterns are looked
+// up in the known event types. If any topic cannot be mapped to an event type,
+// nil and that topic are returned so no event a function might be interested
+// in is filtered out.
+// Task and property topics are not published from events and thus ignored. If
+// only such topics are subscribed, none is returned true, as no event needs to
+// be streamed at all
+func eventTypeIDs(subscribed []string, known knownEventTypes) (ids []string, unmapped string, none bool) {
+	events := false
+	seen := make(map[string]bool)
+	add := func(id string) {
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+
+	for _, topic := range subscribed {
+		if strings.HasPrefix(topic, taskTopicPrefix) || strings.HasPrefix(topic, propertyTopicPrefix) {
+			continue
+		}
+		events = true
+
+		if topics.IsPattern(topic) {
+			matched := false
+			for t, typeIDs := range known {
+				if topics.Match(topic, t) {
+					matched = true
+					for _, id := range typeIDs {
+						add(id)
+					}
+				}
+			}
+			if !matched {
+				return nil, topic, false
+			}
+			continue
+		}
+
+		if id, ok := topicToEventType(topic); ok {
+			add(id)
+			continue
+		}
+		typeIDs, ok := known[topic]
+		if !ok {
+			return nil, topic, false
+		}
+		for _, id := range typeIDs {
+			add(id)
+		}
+	}
+
+	if len(subscribed) > 0 && !events {
+		return nil, "", true
+	}
+
+	sort.Strings(ids)
+	return ids, "", false
+}
+
+// subscribedEventTypeIDs returns the event type IDs of the subscribed topics
+// and whether no event topic is subscribed, logging if no server-side filter
+// can be applied
+func subscribedEventTypeIDs(controller ofsdk.Controller, known knownEventTypes, source string) ([]string, bool) {
+	kinds, unmapped, none := eventTypeIDs(controller.Topics(), known)
+	if len(unmapped) > 0 {
+		logging.Info("topic matches no known event type, not filtering events on the server", "source", source, "topic", unmapped)
+	}
+	return kinds, none
+}
+
+// topicToEventType reverses convertToTopic by trying all combinations of
+// capitalized and upper case segments, e.g. "dvs.port.created" resolves to
+// "DVSPortCreatedEvent" or "DvsPortCreatedEvent", whichever is a known event
+func topicToEventType(topic string) (string, bool) {
+	segments := strings.Split(topic, ".")
+	if len(segments) > maxTopicSegments {
+		return "", false
+	}
+	for _, s := range segments {
+		if len(s) == 0 {
+			return "", false
+		}
+	}
+
+	typeFunc := vtypes.TypeFunc()
+	for variant := 0; variant < 1<<uint(len(segments)); variant++ {
+		var name strings.Builder
+		for i, s := range segments {
+			if variant&(1<<uint(i)) != 0 {
+				name.WriteString(strings.ToUpper(s))
+			} else {
+				name.WriteString(strings.ToUpper(s[:1]) + s[1:])
+			}
+		}
+		name.WriteString("Event")
+
+		typ, ok := typeFunc(name.String())
+		if !ok || !reflect.PtrTo(typ).Implements(baseEventType) {
+			continue
+		}
+
+		// guard against ambiguous names which would not produce this topic
+		if convertToTopic(name.String()) == topic {
+			return name.String(), true
+		}
+	}
+
+	return "", false
+}
+
+// equalKinds compares two sorted lists of event type IDs
+func equalKinds(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// watchKinds calls cancel as soon as the event type IDs derived from the
+// subscribed topics differ from kinds, or event topics are subscribed or
+// unsubscribed, or when ctx is done
+func watchKinds(ctx context.Context, controller ofsdk.Controller, known knownEventTypes, kinds []string, none bool, cancel context.CancelFunc) {
+	ticker := time.NewTicker(topicCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if current, _, currentNone := eventTypeIDs(controller.Topics(), known); currentNone != none || !equalKinds(kinds, current) {
+				cancel()
+				return
+			}
+		}
+	}
+}
+
+// formatKinds returns a printable list of event type IDs
+func formatKinds(kinds []string) string {
+	if len(kinds) == 0 {
+		return "all"
+	}
+	return strings.Join(kinds, ", ")
+}
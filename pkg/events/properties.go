@@ -0,0 +1,202 @@
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/openfaas-incubator/vcenter-connector/pkg/logging"
+	"github.com/pkg/errors"
+	"github.com/vmware/govmomi/property"
+	"github.com/vmware/govmomi/view"
+	"github.com/vmware/govmomi/vim25"
+	vtypes "github.com/vmware/govmomi/vim25/types"
+)
+
+// OutboundPropertyChange is the JSON object sent to functions subscribed to
+// property topics. OldValue is nil when the property was not set before,
+// NewValue is nil when the property was removed
+type OutboundPropertyChange struct {
+	Topic              string `json:"topic,omitempty"`
+	Source             string `json:"source"`
+	SourceInstanceUUID string `json:"sourceInstanceUuid,omitempty"`
+
+	ObjectName             string                         `json:"objectName,omitempty"`
+	ManagedObjectReference *vtypes.ManagedObjectReference `json:"managedObjectReference"`
+	PropertyPath           string                         `json:"propertyPath"`
+	Operation              string                         `json:"operation"`
+	OldValue               vtypes.AnyType                 `json:"oldValue"`
+	NewValue               vtypes.AnyType                 `json:"newValue"`
+	ChangedTime            time.Time                      `json:"changedTime"`
+}
+
+// propertyTopicPrefix is the prefix of all property topics
+const propertyTopicPrefix = "property."
+
+// objectProperties holds the last known values of the watched properties of a
+// managed object
+type objectProperties map[string]vtypes.AnyType
+
+// streamProperties watches the given property paths per managed object type,
+// e.g. "VirtualMachine": {"guest.ipAddress"}, of all objects below the given
+// containers and dispatches a message for each change, until an error occurs
+// or ctx is cancelled. The values reported when the watch starts or an object
+// enters the containers are only remembered, not published
+func streamProperties(ctx context.Context, c *vim25.Client, d *dispatcher, source eventSource, roots []vtypes.ManagedObjectReference, watch map[string][]string) error {
+	kinds := make([]string, 0, len(watch))
+	for kind := range watch {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+
+	filter := new(property.WaitFilter)
+	m := view.NewManager(c)
+	for _, root := range roots {
+		v, err := m.CreateContainerView(ctx, root, kinds, true)
+		if err != nil {
+			return errors.Wrapf(err, "error creating container view for %s", root)
+		}
+		defer v.Destroy(context.Background())
+
+		filter.Spec.ObjectSet = append(filter.Spec.ObjectSet, vtypes.ObjectSpec{
+			Obj:       v.Reference(),
+			Skip:      vtypes.NewBool(true),
+			SelectSet: []vtypes.BaseSelectionSpec{v.TraversalSpec()},
+		})
+	}
+
+	watched := make(map[string]bool)
+	for _, kind := range kinds {
+		// the name is always retrieved to be included in the messages
+		paths := []string{"name"}
+		for _, path := range watch[kind] {
+			watched[kind+"."+path] = true
+			if path != "name" {
+				paths = append(paths, path)
+			}
+		}
+
+		filter.Spec.PropSet = append(filter.Spec.PropSet, vtypes.PropertySpec{
+			Type:    kind,
+			PathSet: paths,
+		})
+	}
+
+	objects := make(map[vtypes.ManagedObjectReference]objectProperties)
+
+	logging.Info("streaming property changes", "source", source.host, "properties", fmt.Sprint(watch))
+	err := property.WaitForUpdates(ctx, property.DefaultCollector(c), filter, func(updates []vtypes.ObjectUpdate) bool {
+		for _, update := range updates {
+			switch update.Kind {
+			case vtypes.ObjectUpdateKindLeave:
+				delete(objects, update.Obj)
+				continue
+			case vtypes.ObjectUpdateKindEnter:
+				props := make(objectProperties)
+				for _, change := range update.ChangeSet {
+					props[change.Name] = change.Val
+				}
+				objects[update.Obj] = props
+				continue
+			}
+
+			props, ok := objects[update.Obj]
+			if !ok {
+				props = make(objectProperties)
+				objects[update.Obj] = props
+			}
+
+			for _, change := range update.ChangeSet {
+				old := props[change.Name]
+				if change.Op == vtypes.PropertyChangeOpRemove || change.Op == vtypes.PropertyChangeOpIndirectRemove {
+					delete(props, change.Name)
+				} else {
+					props[change.Name] = change.Val
+				}
+
+				if !watched[update.Obj.Type+"."+change.Name] {
+					continue
+				}
+
+				ref := update.Obj
+				name, _ := props["name"].(string)
+				now := time.Now().UTC()
+				l := logging.With("source", source.host, "moref", ref, "property", change.Name)
+				topic, message, err := handlePropertyChange(ref, name, change, old, source, now)
+				if err != nil {
+					l.Error("error handling property change", "error", err)
+					continue
+				}
+				l = l.With("topic", topic)
+				l.Debug("message", "payload", string(message))
+
+				meta := messageMeta{
+					id:     fmt.Sprintf("%s-%s-%d", ref, change.Name, now.UnixNano()),
+					source: source.url,
+					time:   now,
+					log:    l,
+				}
+				d.dispatch(&ref, topic, message, meta, nil)
+			}
+		}
+		return false
+	})
+	if err != nil {
+		return errors.Wrap(err, "error connecting to property-stream")
+	}
+	return nil
+}
+
+func handlePropertyChange(ref vtypes.ManagedObjectReference, name string, change vtypes.PropertyChange, old vtypes.AnyType, source eventSource, changed time.Time) (string, []byte, error) {
+	topic := propertyTopic(ref.Type, change.Name)
+
+	msg := OutboundPropertyChange{
+		Topic:                  topic,
+		Source:                 source.host,
+		SourceInstanceUUID:     source.instanceUUID,
+		ObjectName:             name,
+		ManagedObjectReference: &ref,
+		PropertyPath:           change.Name,
+		Operation:              string(change.Op),
+		OldValue:               old,
+		NewValue:               change.Val,
+		ChangedTime:            changed,
+	}
+
+	message, err := json.Marshal(msg)
+	if err != nil {
+		return "", nil, errors.Wrap(err, "error marshaling outboundpropertychange")
+	}
+
+	return topic, message, nil
+}
+
+// propertyTopic converts a managed object type and property path to an
+// OpenFaaS subscriber topic, e.g. "VirtualMachine" and "guest.ipAddress" to
+// "property.virtualmachine.guest.ipaddress.changed"
+func propertyTopic(kind, path string) string {
+	return propertyTopicPrefix + strings.ToLower(kind+"."+path) + ".changed"
+}
+
+// ParseTypeProperty parses a property of a managed object type given as
+// "<type>:<path>", e.g. "VirtualMachine:guest.ipAddress", and adds it to
+// props. Unknown types and paths are only rejected by vCenter once the
+// properties are requested
+func ParseTypeProperty(props map[string][]string, value string) error {
+	parts := strings.SplitN(value, ":", 2)
+	if len(parts) != 2 || len(parts[0]) == 0 || len(parts[1]) == 0 {
+		return errors.Errorf("invalid property %q, expected <type>:<path>", value)
+	}
+
+	kind, path := parts[0], parts[1]
+	for _, p := range props[kind] {
+		if p == path {
+			return nil
+		}
+	}
+	props[kind] = append(props[kind], path)
+	return nil
+}
@@ -0,0 +1,143 @@
+package events
+
+import (
+	"context"
+	"time"
+
+	ofsdk "github.com/openfaas-incubator/connector-sdk/types"
+	"github.com/openfaas-incubator/vcenter-connector/pkg/logging"
+	"github.com/pkg/errors"
+	"github.com/vmware/govmomi/event"
+	vtypes "github.com/vmware/govmomi/vim25/types"
+)
+
+// topicSyncTimeout is the maximum time to wait for the controller to learn
+// about subscribed functions before replaying events
+const topicSyncTimeout = 30 * time.Second
+
+// replay reads all events created between begin and end from the vCenter event
+// history and passes them to recv. A nil end reads up to the latest event,
+// kinds optionally limits the event types. With multiple objects the events of
+// their collectors are merged so they are delivered oldest first
+func replay(ctx context.Context, m *event.Manager, objects []vtypes.ManagedObjectReference, begin, end *time.Time, kinds []string, pageSize int32, recv func(vtypes.ManagedObjectReference, []vtypes.BaseEvent) error) error {
+	var readers []*historyReader
+	defer func() {
+		for _, r := range readers {
+			_ = r.collector.Destroy(context.Background())
+		}
+	}()
+
+	for _, obj := range objects {
+		filter := vtypes.EventFilterSpec{
+			Entity: &vtypes.EventFilterSpecByEntity{
+				Entity:    obj,
+				Recursion: vtypes.EventFilterSpecRecursionOptionAll,
+			},
+			Time: &vtypes.EventFilterSpecByTime{
+				BeginTime: begin,
+				EndTime:   end,
+			},
+			EventTypeId: kinds,
+		}
+
+		collector, err := m.CreateCollectorForEvents(ctx, filter)
+		if err != nil {
+			return errors.Wrapf(err, "error creating event history collector for %s", obj)
+		}
+
+		readers = append(readers, &historyReader{
+			obj:       obj,
+			collector: collector,
+			pageSize:  pageSize,
+		})
+	}
+
+	for {
+		// pick the reader with the oldest pending event
+		var next *historyReader
+		for _, r := range readers {
+			e, err := r.peek(ctx)
+			if err != nil {
+				return err
+			}
+			if e == nil {
+				continue
+			}
+			if next == nil || e.GetEvent().Key < next.pending[0].GetEvent().Key {
+				next = r
+			}
+		}
+
+		if next == nil {
+			return nil
+		}
+
+		if err := recv(next.obj, []vtypes.BaseEvent{next.pop()}); err != nil {
+			return err
+		}
+	}
+}
+
+// historyReader buffers pages of events read from a history collector
+type historyReader struct {
+	obj       vtypes.ManagedObjectReference
+	collector *event.HistoryCollector
+	pageSize  int32
+	pending   []vtypes.BaseEvent
+	done      bool
+}
+
+// peek returns the oldest pending event, reading the next page if required. It
+// returns nil once the collector is exhausted
+func (r *historyReader) peek(ctx context.Context) (vtypes.BaseEvent, error) {
+	if len(r.pending) == 0 && !r.done {
+		events, err := r.collector.ReadNextEvents(ctx, r.pageSize)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error reading event history for %s", r.obj)
+		}
+
+		event.Sort(events)
+		r.pending = events
+		r.done = len(events) == 0
+	}
+
+	if len(r.pending) == 0 {
+		return nil, nil
+	}
+	return r.pending[0], nil
+}
+
+// pop removes and returns the oldest pending event
+func (r *historyReader) pop() vtypes.BaseEvent {
+	e := r.pending[0]
+	r.pending = r.pending[1:]
+	return e
+}
+
+// waitForTopics blocks until the controller has built its topic map, the
+// timeout expired or the context is cancelled. Replayed events would otherwise
+// not match any function while the connector is starting up
+func waitForTopics(ctx context.Context, controller ofsdk.Controller, timeout time.Duration) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	deadline := time.After(timeout)
+	for len(controller.Topics()) == 0 {
+		select {
+		case <-ctx.Done():
+			return
+		case <-deadline:
+			logging.Warn("no function subscribed to any topic, continuing", "timeout", timeout)
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// formatReplayEnd returns a printable end of the replay window
+func formatReplayEnd(end *time.Time) string {
+	if end == nil {
+		return "latest event"
+	}
+	return end.String()
+}
@@ -0,0 +1,154 @@
+package events
+
+import (
+	"context"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/vmware/govmomi/find"
+	"github.com/vmware/govmomi/property"
+	"github.com/vmware/govmomi/view"
+	"github.com/vmware/govmomi/vim25"
+	"github.com/vmware/govmomi/vim25/mo"
+	vtypes "github.com/vmware/govmomi/vim25/types"
+)
+
+// resolveRoots returns the inventory containers to stream events from. Each
+// root is either a managed object reference, e.g. "Datacenter:datacenter-2",
+// or an inventory path, e.g. "/DC0/host/Cluster0", which may contain globs
+// like "/DC*/host/Cluster-*" and then resolves to all matching containers.
+// Without roots, events for the whole inventory (i.e. RootFolder) are
+// streamed
+func resolveRoots(ctx context.Context, c *vim25.Client, roots []string) ([]vtypes.ManagedObjectReference, error) {
+	if len(roots) == 0 {
+		return []vtypes.ManagedObjectReference{c.ServiceContent.RootFolder}, nil
+	}
+
+	finder := find.NewFinder(c, false)
+	pc := property.DefaultCollector(c)
+
+	var refs []vtypes.ManagedObjectReference
+	for _, root := range roots {
+		if isMoref(root) {
+			var ref vtypes.ManagedObjectReference
+			ref.FromString(root)
+
+			// make sure the object exists, vCenter would silently not send
+			// any event otherwise
+			var entity mo.ManagedEntity
+			if err := pc.RetrieveOne(ctx, ref, []string{"name"}, &entity); err != nil {
+				return nil, errors.Wrapf(err, "error retrieving stream root %s", root)
+			}
+			refs = append(refs, ref)
+			continue
+		}
+
+		// the finder resolves paths without a datacenter from the root folder
+		elements, err := finder.ManagedObjectList(ctx, "/"+strings.TrimPrefix(root, "/"))
+		if err != nil {
+			if _, ok := err.(*find.NotFoundError); !ok {
+				return nil, errors.Wrapf(err, "error finding stream root %s", root)
+			}
+		}
+		if len(elements) == 0 {
+			return nil, errors.Errorf("stream root %s not found in inventory", root)
+		}
+		for _, e := range elements {
+			refs = append(refs, e.Object.Reference())
+		}
+	}
+
+	return refs, nil
+}
+
+// isMoref returns true if root is formatted as a managed object reference,
+// i.e. "Type:value", rather than an inventory path
+func isMoref(root string) bool {
+	return strings.Contains(root, ":") && !strings.Contains(root, "/")
+}
+
+// scope tells whether managed entities are below the stream roots. The
+// entities below the roots are cached and listed again when an unknown entity
+// is looked up, e.g. a VM created after the last listing
+type scope struct {
+	roots    map[vtypes.ManagedObjectReference]bool
+	entities map[vtypes.ManagedObjectReference]bool
+	list     func(ctx context.Context) ([]vtypes.ManagedObjectReference, error)
+}
+
+// newScope returns the scope of the given roots and a function releasing its
+// container views. A nil scope, which contains every entity, is returned if
+// the roots are just the inventory RootFolder
+func newScope(ctx context.Context, c *vim25.Client, roots []vtypes.ManagedObjectReference) (*scope, func(), error) {
+	if len(roots) == 1 && roots[0] == c.ServiceContent.RootFolder {
+		return nil, func() {}, nil
+	}
+
+	var views []*view.ContainerView
+	destroy := func() {
+		for _, v := range views {
+			v.Destroy(context.Background())
+		}
+	}
+
+	m := view.NewManager(c)
+	for _, root := range roots {
+		v, err := m.CreateContainerView(ctx, root, nil, true)
+		if err != nil {
+			destroy()
+			return nil, nil, errors.Wrapf(err, "error creating container view for %s", root)
+		}
+		views = append(views, v)
+	}
+
+	list := func(ctx context.Context) ([]vtypes.ManagedObjectReference, error) {
+		var refs []vtypes.ManagedObjectReference
+		for _, v := range views {
+			found, err := v.Find(ctx, nil, nil)
+			if err != nil {
+				return nil, errors.Wrapf(err, "error listing entities of %s", v.Reference())
+			}
+			refs = append(refs, found...)
+		}
+		return refs, nil
+	}
+
+	return newListScope(roots, list), destroy, nil
+}
+
+// newListScope returns the scope of the roots, with list returning the
+// entities below them
+func newListScope(roots []vtypes.ManagedObjectReference, list func(ctx context.Context) ([]vtypes.ManagedObjectReference, error)) *scope {
+	s := &scope{
+		roots: make(map[vtypes.ManagedObjectReference]bool),
+		list:  list,
+	}
+	for _, root := range roots {
+		s.roots[root] = true
+	}
+	return s
+}
+
+// contains returns true if the entity is one of the roots or below them. A
+// nil scope contains all entities, even nil ones
+func (s *scope) contains(ctx context.Context, entity *vtypes.ManagedObjectReference) (bool, error) {
+	if s == nil {
+		return true, nil
+	}
+	if entity == nil {
+		return false, nil
+	}
+	if s.roots[*entity] || s.entities[*entity] {
+		return true, nil
+	}
+
+	refs, err := s.list(ctx)
+	if err != nil {
+		return false, err
+	}
+	s.entities = make(map[vtypes.ManagedObjectReference]bool, len(refs))
+	for _, ref := range refs {
+		s.entities[ref] = true
+	}
+	return s.entities[*entity], nil
+}
@@ -0,0 +1,360 @@
+package events
+
+import (
+	"context"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/openfaas-incubator/vcenter-connector/pkg/logging"
+	"github.com/openfaas-incubator/vcenter-connector/pkg/metrics"
+	"github.com/pkg/errors"
+	"github.com/vmware/govmomi"
+	"github.com/vmware/govmomi/session"
+	"github.com/vmware/govmomi/vim25"
+	"github.com/vmware/govmomi/vim25/methods"
+	"github.com/vmware/govmomi/vim25/soap"
+	vtypes "github.com/vmware/govmomi/vim25/types"
+)
+
+// keepAliveIdleTime is the time after which an idle vCenter session is
+// refreshed by the keep-alive handler
+const keepAliveIdleTime = 5 * time.Minute
+
+// Endpoint describes a vCenter Server to stream events from
+type Endpoint struct {
+	// Name identifies the endpoint in logs and health reports, defaults to the
+	// host of URL
+	Name string `json:"name" yaml:"name"`
+
+	URL      string `json:"url" yaml:"url"`
+	User     string `json:"user" yaml:"user"`
+	Password string `json:"password" yaml:"password"`
+
+	// Insecure skips the verification of the server certificate
+	Insecure bool `json:"insecure" yaml:"insecure"`
+	// CAFile is a PEM file with the root certificate authorities to verify the
+	// server certificate against, instead of the host's root CA set
+	CAFile string `json:"caFile" yaml:"caFile"`
+	// Thumbprint is the SHA-1 thumbprint of the server certificate which is
+	// accepted if the certificate cannot be verified otherwise
+	Thumbprint string `json:"thumbprint" yaml:"thumbprint"`
+}
+
+// Session manages the connection to vCenter. It keeps the session alive while
+// idle and logs in again or reconnects when the session is lost
+type Session struct {
+	name       string
+	url        *url.URL
+	insecure   bool
+	caFile     string
+	thumbprint string
+
+	lock   sync.RWMutex
+	client *govmomi.Client
+	status Status
+}
+
+// Status is a snapshot of the state of a Session
+type Status struct {
+	Name         string `json:"name"`
+	Host         string `json:"host"`
+	InstanceUUID string `json:"instanceUuid,omitempty"`
+
+	// Connected is true while the session is logged in and the event stream
+	// did not fail since
+	Connected     bool      `json:"connected"`
+	LastLogin     time.Time `json:"lastLogin,omitempty"`
+	LastError     string    `json:"lastError,omitempty"`
+	LastErrorTime time.Time `json:"lastErrorTime,omitempty"`
+	Reconnects    int       `json:"reconnects"`
+	// LastEventPage is when the last page of events was received
+	LastEventPage time.Time `json:"lastEventPage,omitempty"`
+	// LastEventKey is the key of the newest event received
+	LastEventKey int32 `json:"lastEventKey,omitempty"`
+	// LastHeartbeat is when vCenter last had no event matching the
+	// subscription which was not received yet
+	LastHeartbeat time.Time `json:"lastHeartbeat,omitempty"`
+}
+
+// NewSession returns a Session for the given endpoint. No connection is made
+// until Login is called
+func NewSession(e Endpoint) (*Session, error) {
+	u, err := soap.ParseURL(e.URL)
+	if err != nil {
+		return nil, errors.Wrap(err, "error parsing URL")
+	}
+
+	name := e.Name
+	if len(name) == 0 {
+		name = u.Host
+	}
+
+	u.User = url.UserPassword(e.User, e.Password)
+	return &Session{
+		name:       name,
+		url:        u,
+		insecure:   e.Insecure,
+		caFile:     e.CAFile,
+		thumbprint: e.Thumbprint,
+		status: Status{
+			Name: name,
+			Host: u.Host,
+		},
+	}, nil
+}
+
+// Name returns the name of the endpoint
+func (s *Session) Name() string {
+	return s.name
+}
+
+// Client returns the current govmomi.Client, which is nil before the first
+// successful Login
+func (s *Session) Client() *govmomi.Client {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.client
+}
+
+// Status returns a snapshot of the state of the session
+func (s *Session) Status() Status {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.status
+}
+
+// SetCredentials replaces the credentials used to log in. The current session
+// is kept, the credentials take effect with the next login
+func (s *Session) SetCredentials(user, password string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	// the client of the current session shares the URL
+	u := *s.url
+	u.User = url.UserPassword(user, password)
+	s.url = &u
+}
+
+// pageReceived records the receipt of a page of events with key as its newest
+// event key, s may be nil
+func (s *Session) pageReceived(t time.Time, key int32) {
+	if s == nil {
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.status.LastEventPage = t
+	if key > s.status.LastEventKey {
+		s.status.LastEventKey = key
+	}
+}
+
+// heartbeat records that the event stream was up to date at t
+func (s *Session) heartbeat(t time.Time) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.status.LastHeartbeat = t
+}
+
+// Check returns an error unless the session is logged in and valid. If
+// maxEventAge is set, it also returns an error if the event stream was
+// neither up to date nor received events for longer than that since the last
+// login, which indicates a stuck event collector
+func (s *Session) Check(ctx context.Context, maxEventAge time.Duration) error {
+	status := s.Status()
+	if !status.Connected {
+		if len(status.LastError) > 0 {
+			return errors.Errorf("not connected: %s", status.LastError)
+		}
+		return errors.New("not connected")
+	}
+
+	c := s.Client()
+	if c == nil {
+		return errors.New("not connected")
+	}
+
+	us, err := session.NewManager(c.Client).UserSession(ctx)
+	if err != nil {
+		return errors.Wrap(err, "error checking session")
+	}
+	if us == nil {
+		return errors.New("session is not authenticated")
+	}
+
+	if maxEventAge > 0 {
+		last := status.LastLogin
+		for _, t := range []time.Time{status.LastEventPage, status.LastHeartbeat} {
+			if t.After(last) {
+				last = t
+			}
+		}
+		if age := time.Since(last); age > maxEventAge {
+			return errors.Errorf("event stream not up to date for %s", age.Round(time.Second))
+		}
+	}
+	return nil
+}
+
+// failed records an error of the event stream
+func (s *Session) failed(err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.status.Connected = false
+	s.status.LastError = err.Error()
+	s.status.LastErrorTime = time.Now()
+}
+
+// Login establishes a session with vCenter. An existing connection is reused
+// and only its session is renewed, unless reconnect is set in which case the
+// current client is logged out and a new one is created. The lock is not held
+// while talking to vCenter, so the status can be read meanwhile
+func (s *Session) Login(ctx context.Context, reconnect bool) error {
+	s.lock.Lock()
+	current, u := s.client, s.url
+	if current != nil {
+		s.status.Reconnects++
+		metrics.SessionReconnects.WithLabelValues(s.name).Inc()
+	}
+	s.lock.Unlock()
+
+	c, err := s.login(ctx, current, u, reconnect)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.client = c
+	if err != nil {
+		s.status.Connected = false
+		s.status.LastError = err.Error()
+		s.status.LastErrorTime = time.Now()
+		return err
+	}
+
+	s.status.Connected = true
+	s.status.LastLogin = time.Now()
+	s.status.InstanceUUID = c.ServiceContent.About.InstanceUuid
+	return nil
+}
+
+// login logs in with the credentials of u and returns the client to keep,
+// which is nil if the current one was logged out and no new one could be
+// created
+func (s *Session) login(ctx context.Context, current *govmomi.Client, u *url.URL, reconnect bool) (*govmomi.Client, error) {
+	if current != nil && !reconnect {
+		if err := current.Login(ctx, u.User); err != nil {
+			return current, errors.Wrap(err, "error logging in to vCenter")
+		}
+		return current, nil
+	}
+
+	if current != nil {
+		logoutCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		_ = current.Logout(logoutCtx)
+		cancel()
+	}
+
+	c, err := s.newClient(ctx, u)
+	if err != nil {
+		return nil, errors.Wrap(err, "error connecting to vCenter")
+	}
+	return c, nil
+}
+
+// newClient creates a client logged in with the credentials of u with a
+// keep-alive handler installed on its round tripper
+func (s *Session) newClient(ctx context.Context, u *url.URL) (*govmomi.Client, error) {
+	soapClient := soap.NewClient(u, s.insecure)
+	if len(s.caFile) > 0 {
+		if err := soapClient.SetRootCAs(s.caFile); err != nil {
+			return nil, errors.Wrap(err, "error loading CA file")
+		}
+	}
+	if len(s.thumbprint) > 0 {
+		soapClient.SetThumbprint(u.Host, s.thumbprint)
+	}
+
+	vimClient, err := vim25.NewClient(ctx, soapClient)
+	if err != nil {
+		return nil, err
+	}
+
+	vimClient.RoundTripper = session.KeepAliveHandler(vimClient.RoundTripper, keepAliveIdleTime, s.keepAlive(vimClient))
+
+	c := &govmomi.Client{
+		Client:         vimClient,
+		SessionManager: session.NewManager(vimClient),
+	}
+
+	if err := c.Login(ctx, u.User); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// keepAlive returns the keep-alive handler for the given client. Failures are
+// only logged, the event stream notices a lost session itself and triggers a
+// new login. The handler stops once the client was replaced
+func (s *Session) keepAlive(vimClient *vim25.Client) func(soap.RoundTripper) error {
+	return func(rt soap.RoundTripper) error {
+		if c := s.Client(); c == nil || c.Client != vimClient {
+			return errors.New("session replaced")
+		}
+
+		if _, err := methods.GetCurrentTime(context.Background(), rt); err != nil {
+			logging.Warn("vCenter session keep-alive failed", "vcenter", s.name, "error", err)
+		}
+		return nil
+	}
+}
+
+// isNotAuthenticated returns true if err was caused by an invalid or expired
+// vCenter session
+func isNotAuthenticated(err error) bool {
+	err = errors.Cause(err)
+
+	var fault vtypes.AnyType
+	switch {
+	case soap.IsSoapFault(err):
+		fault = soap.ToSoapFault(err).VimFault()
+	case soap.IsVimFault(err):
+		fault = soap.ToVimFault(err)
+	default:
+		return false
+	}
+
+	_, ok := fault.(vtypes.NotAuthenticated)
+	if !ok {
+		_, ok = fault.(*vtypes.NotAuthenticated)
+	}
+	return ok
+}
+
+// backoff computes exponentially growing delays between min and max
+type backoff struct {
+	min     time.Duration
+	max     time.Duration
+	current time.Duration
+}
+
+// next returns the delay to wait before the next attempt
+func (b *backoff) next() time.Duration {
+	if b.current == 0 {
+		b.current = b.min
+		return b.current
+	}
+
+	b.current *= 2
+	if b.current > b.max {
+		b.current = b.max
+	}
+	return b.current
+}
+
+// reset starts over with the minimum delay
+func (b *backoff) reset() {
+	b.current = 0
+}
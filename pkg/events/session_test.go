@@ -0,0 +1,141 @@
+package events
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	pkgerrors "github.com/pkg/errors"
+	"github.com/vmware/govmomi/vim25/soap"
+	vtypes "github.com/vmware/govmomi/vim25/types"
+)
+
+func TestBackoff(t *testing.T) {
+	b := backoff{min: time.Second, max: 5 * time.Second}
+
+	want := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second}
+	for i, w := range want {
+		if got := b.next(); got != w {
+			t.Errorf("attempt %d: wanted: %v, got: %v", i, w, got)
+		}
+	}
+
+	b.reset()
+	if got := b.next(); got != time.Second {
+		t.Errorf("after reset: wanted: %v, got: %v", time.Second, got)
+	}
+}
+
+func TestIsNotAuthenticated(t *testing.T) {
+	notAuthenticated := soap.WrapSoapFault(&soap.Fault{
+		Detail: struct {
+			Fault vtypes.AnyType `xml:",any,typeattr"`
+		}{Fault: vtypes.NotAuthenticated{}},
+	})
+
+	var testCases = []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"NotAuthenticated fault", notAuthenticated, true},
+		{"wrapped NotAuthenticated fault", pkgerrors.Wrap(notAuthenticated, "error connecting to event-stream"), true},
+		{"NotAuthenticated vim fault", soap.WrapVimFault(&vtypes.NotAuthenticated{}), true},
+		{"other vim fault", soap.WrapVimFault(&vtypes.InvalidLogin{}), false},
+		{"connection error", errors.New("connection refused"), false},
+	}
+
+	for _, test := range testCases {
+		if got := isNotAuthenticated(test.err); got != test.want {
+			t.Errorf("%s: wanted: %v, got: %v", test.name, test.want, got)
+		}
+	}
+}
+
+func TestSessionCheckNotConnected(t *testing.T) {
+	s, err := NewSession(Endpoint{URL: "https://vc01.local/sdk"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Check(context.Background(), 0); err == nil {
+		t.Errorf("wanted error before login")
+	}
+
+	s.failed(errors.New("connection refused"))
+	if err := s.Check(context.Background(), 0); err == nil || err.Error() != "not connected: connection refused" {
+		t.Errorf("wanted: not connected: connection refused, got: %v", err)
+	}
+}
+
+func TestSessionSetCredentials(t *testing.T) {
+	s, err := NewSession(Endpoint{URL: "https://vc01.local/sdk", User: "admin", Password: "old"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := s.url
+
+	s.SetCredentials("admin", "new")
+	if p, _ := s.url.User.Password(); s.url.User.Username() != "admin" || p != "new" {
+		t.Errorf("wanted: admin:new, got: %v", s.url.User)
+	}
+	if p, _ := previous.User.Password(); p != "old" {
+		t.Errorf("previous URL: wanted: old, got: %v", p)
+	}
+}
+
+func TestSessionLoginFailure(t *testing.T) {
+	s, err := NewSession(Endpoint{URL: "https://127.0.0.1:1/sdk"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.Login(ctx, false); err == nil {
+		t.Fatal("wanted error")
+	}
+
+	if status := s.Status(); status.Connected || len(status.LastError) == 0 {
+		t.Errorf("wanted: not connected with the error, got: %+v", status)
+	}
+	if s.Client() != nil {
+		t.Errorf("wanted: no client")
+	}
+}
+
+func TestSessionPageReceived(t *testing.T) {
+	s, err := NewSession(Endpoint{URL: "https://vc01.local/sdk"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// replayed events may be older than the newest one received
+	for _, key := range []int32{42, 7, 0} {
+		s.pageReceived(time.Now(), key)
+	}
+	if got := s.Status().LastEventKey; got != 42 {
+		t.Errorf("wanted: %v, got: %v", 42, got)
+	}
+}
+
+func TestUpToDate(t *testing.T) {
+	var testCases = []struct {
+		name                       string
+		latest, baseline, received int32
+		want                       bool
+	}{
+		{"no events", 0, 0, 0, true},
+		{"no new events", 100, 100, 0, true},
+		{"new event received", 101, 100, 101, true},
+		{"new event pending", 102, 100, 101, false},
+		{"new event never received", 101, 100, 0, false},
+	}
+
+	for _, test := range testCases {
+		if got := upToDate(test.latest, test.baseline, test.received); got != test.want {
+			t.Errorf("%s: wanted: %v, got: %v", test.name, test.want, got)
+		}
+	}
+}
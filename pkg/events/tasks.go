@@ -0,0 +1,214 @@
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/openfaas-incubator/vcenter-connector/pkg/logging"
+	"github.com/pkg/errors"
+	"github.com/vmware/govmomi/view"
+	"github.com/vmware/govmomi/vim25"
+	"github.com/vmware/govmomi/vim25/methods"
+	vtypes "github.com/vmware/govmomi/vim25/types"
+)
+
+// OutboundTask is the JSON object sent to functions subscribed to task topics.
+// ObjectName and ManagedObjectReference refer to the entity the task operates
+// on, just like for an OutboundEvent. Error is only set for failed tasks,
+// Result only for successful tasks which return a value, e.g. the
+// ManagedObjectReference of a cloned VM
+type OutboundTask struct {
+	Topic              string `json:"topic,omitempty"`
+	Source             string `json:"source"`
+	SourceInstanceUUID string `json:"sourceInstanceUuid,omitempty"`
+
+	Key                    string                         `json:"key"`
+	Task                   vtypes.ManagedObjectReference  `json:"task"`
+	Name                   string                         `json:"name,omitempty"`
+	DescriptionID          string                         `json:"descriptionId,omitempty"`
+	State                  string                         `json:"state"`
+	UserName               string                         `json:"userName,omitempty"`
+	ObjectName             string                         `json:"objectName,omitempty"`
+	ManagedObjectReference *vtypes.ManagedObjectReference `json:"managedObjectReference,omitempty"`
+	Error                  *vtypes.LocalizedMethodFault   `json:"error,omitempty"`
+	Result                 vtypes.AnyType                 `json:"result,omitempty"`
+	QueueTime              time.Time                      `json:"queueTime"`
+	StartTime              *time.Time                     `json:"startTime,omitempty"`
+	CompleteTime           *time.Time                     `json:"completeTime,omitempty"`
+	EventChainID           int32                          `json:"eventChainId,omitempty"`
+}
+
+// taskTopicPrefix is the prefix of all task topics
+const taskTopicPrefix = "task."
+
+// streamTasks follows the recent tasks of the vCenter TaskManager and
+// dispatches a message each time a task on an entity of the given containers
+// changes its state, until an error occurs or ctx is cancelled
+func streamTasks(ctx context.Context, c *vim25.Client, d *dispatcher, source eventSource, roots []vtypes.ManagedObjectReference) error {
+	// tasks which completed before the stream started were either published
+	// already or happened while the connector was not running
+	now, err := methods.GetCurrentTime(ctx, c)
+	if err != nil {
+		return errors.Wrap(err, "error retrieving vCenter time")
+	}
+
+	v, err := view.NewManager(c).CreateTaskView(ctx, c.ServiceContent.TaskManager)
+	if err != nil {
+		return errors.Wrap(err, "error creating task view")
+	}
+	defer v.Destroy(context.Background())
+
+	v.Follow = true
+
+	// the task view always covers the whole inventory
+	s, destroy, err := newScope(ctx, c, roots)
+	if err != nil {
+		return err
+	}
+	defer destroy()
+
+	// last published state per task key
+	states := make(map[string]vtypes.TaskInfoState)
+
+	logging.Info("streaming tasks", "source", source.host)
+	err = v.Collect(ctx, func(infos []vtypes.TaskInfo) {
+		for _, info := range infos {
+			if info.CompleteTime != nil && info.CompleteTime.Before(*now) {
+				continue
+			}
+
+			l := logging.With("source", source.host, "task", info.Key, "moref", info.Entity)
+			ok, err := s.contains(ctx, info.Entity)
+			if err != nil {
+				l.Error("error checking task entity", "error", err)
+				continue
+			}
+			if !ok {
+				continue
+			}
+
+			if states[info.Key] == info.State {
+				// progress update
+				continue
+			}
+
+			if isTaskComplete(info.State) {
+				delete(states, info.Key)
+			} else {
+				states[info.Key] = info.State
+			}
+
+			topic, message, err := handleTask(info, source)
+			if err != nil {
+				l.Error("error handling task", "error", err)
+				continue
+			}
+			l = l.With("topic", topic)
+			l.Debug("message", "payload", string(message))
+			meta := messageMeta{
+				id:     info.Key + "-" + string(info.State),
+				source: source.url,
+				time:   taskStateTime(info),
+				log:    l,
+			}
+			d.dispatch(info.Entity, topic, message, meta, nil)
+		}
+	})
+	if err != nil {
+		return errors.Wrap(err, "error connecting to task-stream")
+	}
+	return nil
+}
+
+func handleTask(info vtypes.TaskInfo, source eventSource) (string, []byte, error) {
+	topic := taskTopic(info)
+
+	task := OutboundTask{
+		Topic:                  topic,
+		Source:                 source.host,
+		SourceInstanceUUID:     source.instanceUUID,
+		Key:                    info.Key,
+		Task:                   info.Task,
+		Name:                   info.Name,
+		DescriptionID:          info.DescriptionId,
+		State:                  string(info.State),
+		ObjectName:             info.EntityName,
+		ManagedObjectReference: info.Entity,
+		Error:                  info.Error,
+		Result:                 info.Result,
+		QueueTime:              info.QueueTime,
+		StartTime:              info.StartTime,
+		CompleteTime:           info.CompleteTime,
+		EventChainID:           info.EventChainId,
+	}
+
+	if reason, ok := info.Reason.(*vtypes.TaskReasonUser); ok {
+		task.UserName = reason.UserName
+	}
+
+	message, err := json.Marshal(task)
+	if err != nil {
+		return "", nil, errors.Wrap(err, "error marshaling outboundtask")
+	}
+
+	return topic, message, nil
+}
+
+// taskTopic converts a task and its state to an OpenFaaS subscriber topic,
+// e.g. a queued "CloneVM_Task" to "task.clone.vm.queued". Tasks without a
+// method name are converted based on their description ID, e.g.
+// "Drm.ExecuteVMotionLRO" to "task.drm.execute.v.motion.lro.running"
+func taskTopic(info vtypes.TaskInfo) string {
+	name := strings.TrimSuffix(info.Name, "_Task")
+	if len(name) == 0 {
+		name = info.DescriptionId
+	}
+
+	var parts []string
+	for _, part := range strings.Split(name, ".") {
+		if len(part) > 0 {
+			parts = append(parts, camelCaseToLowerSeparated(part, "."))
+		}
+	}
+
+	return taskTopicPrefix + strings.Join(append(parts, string(info.State)), ".")
+}
+
+// taskStateTime returns when the task entered its current state
+func taskStateTime(info vtypes.TaskInfo) time.Time {
+	switch {
+	case info.CompleteTime != nil:
+		return *info.CompleteTime
+	case info.StartTime != nil:
+		return *info.StartTime
+	}
+	return info.QueueTime
+}
+
+// isTaskComplete returns true if the task will not change its state anymore
+func isTaskComplete(state vtypes.TaskInfoState) bool {
+	return state == vtypes.TaskInfoStateSuccess || state == vtypes.TaskInfoStateError
+}
+
+// runAll runs all functions concurrently until the first one returns. The
+// others are cancelled and awaited, the result of the first one is returned
+func runAll(ctx context.Context, fns ...func(context.Context) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	errCh := make(chan error, len(fns))
+	for _, fn := range fns {
+		go func(fn func(context.Context) error) {
+			errCh <- fn(ctx)
+		}(fn)
+	}
+
+	err := <-errCh
+	cancel()
+	for i := 1; i < len(fns); i++ {
+		<-errCh
+	}
+	return err
+}
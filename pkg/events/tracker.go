@@ -0,0 +1,146 @@
+package events
+
+import (
+	"sync"
+
+	"github.com/openfaas-incubator/vcenter-connector/pkg/checkpoint"
+	"github.com/pkg/errors"
+	vtypes "github.com/vmware/govmomi/vim25/types"
+)
+
+// tracker remembers the last event handed over to the controller so events
+// which were already delivered before the stream was (re)started, e.g. during
+// replay, are skipped. If a checkpoint store is configured the position is
+// persisted as events are handed over. Events are handed over asynchronously
+// by the dispatcher, so the position only moves past an event once all events
+// queued before it were handed over as well
+type tracker struct {
+	store checkpoint.Store
+
+	lock sync.Mutex
+	last *checkpoint.Checkpoint
+	// queued is the newest event queued for delivery
+	queued *checkpoint.Checkpoint
+	// floor is the position when the stream was last (re)started, events up to
+	// this position are skipped
+	floor *checkpoint.Checkpoint
+	// pending holds the queued events in the order they were queued
+	pending []*position
+}
+
+// position is a queued event tracked until it was handed over
+type position struct {
+	checkpoint.Checkpoint
+	done bool
+}
+
+// newTracker returns a tracker initialized from the given store which may be
+// nil to disable checkpointing
+func newTracker(store checkpoint.Store) (*tracker, error) {
+	t := tracker{
+		store: store,
+	}
+
+	if store == nil {
+		return &t, nil
+	}
+
+	last, err := store.Load()
+	if err != nil {
+		return nil, errors.Wrap(err, "error loading checkpoint")
+	}
+	t.last = last
+	t.floor = last
+
+	return &t, nil
+}
+
+// current returns the last position up to which all events were handed over
+func (t *tracker) current() *checkpoint.Checkpoint {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.last
+}
+
+// reset forgets the position so all events are delivered again
+func (t *tracker) reset() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.last = nil
+	t.queued = nil
+	t.floor = nil
+}
+
+// resume skips all events up to the newest queued one from now on. It is
+// called whenever the stream is (re)started since the collectors then deliver
+// events which were already queued or handed over to the controller
+func (t *tracker) resume() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.floor = t.last
+	if t.queued != nil && (t.floor == nil || t.queued.LastEventKey > t.floor.LastEventKey) {
+		t.floor = t.queued
+	}
+}
+
+// delivered returns true if the event is not newer than the position when the
+// stream was (re)started. Event keys are assigned in ascending order by vCenter
+func (t *tracker) delivered(e vtypes.BaseEvent) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.floor == nil {
+		return false
+	}
+	return e.GetEvent().Key <= t.floor.LastEventKey
+}
+
+// queue records the event as queued for delivery, the returned position must be
+// passed to done once the event was handed over to the controller
+func (t *tracker) queue(e vtypes.BaseEvent) *position {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	p := &position{
+		Checkpoint: checkpoint.Checkpoint{
+			LastEventKey:         e.GetEvent().Key,
+			LastEventCreatedTime: e.GetEvent().CreatedTime,
+		},
+	}
+	t.pending = append(t.pending, p)
+
+	if t.queued == nil || p.LastEventKey > t.queued.LastEventKey {
+		cp := p.Checkpoint
+		t.queued = &cp
+	}
+	return p
+}
+
+// done marks the queued event as handed over and moves the position forward
+// past all leading events which are done. Events from different collectors may
+// arrive out of order, so the position never moves backwards
+func (t *tracker) done(p *position) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	p.done = true
+
+	moved := false
+	for len(t.pending) > 0 && t.pending[0].done {
+		next := t.pending[0]
+		t.pending = t.pending[1:]
+
+		if t.last != nil && next.LastEventKey <= t.last.LastEventKey {
+			continue
+		}
+		cp := next.Checkpoint
+		t.last = &cp
+		moved = true
+	}
+
+	if !moved || t.store == nil {
+		return nil
+	}
+	return t.store.Save(*t.last)
+}
@@ -0,0 +1,453 @@
+package filter
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/pkg/errors"
+)
+
+// Expr is a parsed filter expression which is evaluated against a JSON
+// message, e.g.
+//
+//	objectName matches "^prod-" && userName != "svc-automation"
+//
+// Fields are dotted paths into the message, e.g.
+// "managedObjectReference.Value". Values are double quoted strings, numbers,
+// true, false or null. Supported operators are ==, !=, <, <=, >, >=,
+// matches (regular expression) and contains (substring or array element),
+// combined with &&, || and ! or their aliases and, or and not, and grouped
+// with parentheses
+type Expr struct {
+	src  string
+	root node
+}
+
+// Parse parses a filter expression
+func Parse(src string) (*Expr, error) {
+	tokens, err := tokenize(src)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid filter %q", src)
+	}
+
+	p := parser{tokens: tokens}
+	root, err := p.parseOr()
+	if err == nil && !p.done() {
+		err = errors.Errorf("unexpected %q", p.peek().text)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid filter %q", src)
+	}
+
+	return &Expr{src: src, root: root}, nil
+}
+
+// String returns the source of the expression
+func (e *Expr) String() string {
+	return e.src
+}
+
+// Match returns true if the decoded JSON document matches the expression
+func (e *Expr) Match(doc interface{}) bool {
+	return e.root.eval(doc)
+}
+
+// MatchJSON decodes the JSON message and returns true if it matches the
+// expression
+func (e *Expr) MatchJSON(message []byte) (bool, error) {
+	var doc interface{}
+	if err := json.Unmarshal(message, &doc); err != nil {
+		return false, errors.Wrap(err, "error decoding message")
+	}
+	return e.Match(doc), nil
+}
+
+type node interface {
+	eval(doc interface{}) bool
+}
+
+type andNode struct{ left, right node }
+
+func (n andNode) eval(doc interface{}) bool { return n.left.eval(doc) && n.right.eval(doc) }
+
+type orNode struct{ left, right node }
+
+func (n orNode) eval(doc interface{}) bool { return n.left.eval(doc) || n.right.eval(doc) }
+
+type notNode struct{ operand node }
+
+func (n notNode) eval(doc interface{}) bool { return !n.operand.eval(doc) }
+
+// compareNode compares the value of a field with a literal
+type compareNode struct {
+	field []string
+	op    string
+	value interface{}
+	re    *regexp.Regexp
+}
+
+func (n compareNode) eval(doc interface{}) bool {
+	v := lookup(doc, n.field)
+
+	switch n.op {
+	case "==":
+		return equal(v, n.value)
+	case "!=":
+		return !equal(v, n.value)
+	case "matches":
+		s, ok := v.(string)
+		return ok && n.re.MatchString(s)
+	case "contains":
+		switch v := v.(type) {
+		case string:
+			s, ok := n.value.(string)
+			return ok && strings.Contains(v, s)
+		case []interface{}:
+			for _, e := range v {
+				if equal(e, n.value) {
+					return true
+				}
+			}
+		}
+		return false
+	}
+
+	c, ok := compare(v, n.value)
+	if !ok {
+		return false
+	}
+	switch n.op {
+	case "<":
+		return c < 0
+	case "<=":
+		return c <= 0
+	case ">":
+		return c > 0
+	case ">=":
+		return c >= 0
+	}
+	return false
+}
+
+// lookup returns the value at the dotted path. Keys may contain dots
+// themselves, e.g. the property paths of the enrichment, so the longest
+// matching key is used at each level
+func lookup(doc interface{}, path []string) interface{} {
+	if len(path) == 0 {
+		return doc
+	}
+
+	m, ok := doc.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+
+	for i := len(path); i > 0; i-- {
+		if v, ok := m[strings.Join(path[:i], ".")]; ok {
+			if found := lookup(v, path[i:]); found != nil || i == len(path) {
+				return found
+			}
+		}
+	}
+	return nil
+}
+
+func equal(a, b interface{}) bool {
+	if c, ok := compare(a, b); ok {
+		return c == 0
+	}
+	return a == nil && b == nil
+}
+
+// compare compares two numbers, strings or booleans, ok is false if the values
+// are not comparable
+func compare(a, b interface{}) (int, bool) {
+	switch a := a.(type) {
+	case float64:
+		b, ok := b.(float64)
+		if !ok {
+			return 0, false
+		}
+		switch {
+		case a < b:
+			return -1, true
+		case a > b:
+			return 1, true
+		}
+		return 0, true
+	case string:
+		b, ok := b.(string)
+		if !ok {
+			return 0, false
+		}
+		return strings.Compare(a, b), true
+	case bool:
+		b, ok := b.(bool)
+		if !ok || a != b {
+			return 1, ok
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+type tokenKind int
+
+const (
+	tokenIdent tokenKind = iota
+	tokenString
+	tokenNumber
+	tokenOp
+	tokenLParen
+	tokenRParen
+)
+
+type token struct {
+	kind tokenKind
+	text string
+}
+
+var keywords = map[string]string{
+	"and":      "&&",
+	"or":       "||",
+	"not":      "!",
+	"matches":  "matches",
+	"contains": "contains",
+}
+
+func tokenize(src string) ([]token, error) {
+	var tokens []token
+	runes := []rune(src)
+
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+
+		case r == '(':
+			tokens = append(tokens, token{tokenLParen, "("})
+			i++
+
+		case r == ')':
+			tokens = append(tokens, token{tokenRParen, ")"})
+			i++
+
+		case r == '"':
+			j := i + 1
+			for ; j < len(runes) && runes[j] != '"'; j++ {
+				if runes[j] == '\\' {
+					j++
+				}
+			}
+			if j >= len(runes) {
+				return nil, errors.New("unterminated string")
+			}
+			s, err := strconv.Unquote(string(runes[i : j+1]))
+			if err != nil {
+				return nil, errors.Wrapf(err, "invalid string %s", string(runes[i:j+1]))
+			}
+			tokens = append(tokens, token{tokenString, s})
+			i = j + 1
+
+		case strings.ContainsRune("=!<>&|", r):
+			op := string(r)
+			if i+1 < len(runes) && strings.ContainsRune("=&|", runes[i+1]) {
+				op += string(runes[i+1])
+			}
+			switch op {
+			case "==", "!=", "<", "<=", ">", ">=", "&&", "||", "!":
+			default:
+				return nil, errors.Errorf("unknown operator %q", op)
+			}
+			tokens = append(tokens, token{tokenOp, op})
+			i += len(op)
+
+		case r == '-' || unicode.IsDigit(r):
+			j := i + 1
+			for j < len(runes) && (unicode.IsDigit(runes[j]) || runes[j] == '.') {
+				j++
+			}
+			tokens = append(tokens, token{tokenNumber, string(runes[i:j])})
+			i = j
+
+		case unicode.IsLetter(r) || r == '_':
+			j := i + 1
+			for j < len(runes) && (unicode.IsLetter(runes[j]) || unicode.IsDigit(runes[j]) || strings.ContainsRune("_.-", runes[j])) {
+				j++
+			}
+			word := string(runes[i:j])
+			if op, ok := keywords[word]; ok {
+				tokens = append(tokens, token{tokenOp, op})
+			} else {
+				tokens = append(tokens, token{tokenIdent, word})
+			}
+			i = j
+
+		default:
+			return nil, errors.Errorf("unexpected character %q", r)
+		}
+	}
+	return tokens, nil
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+func (p *parser) done() bool {
+	return p.pos >= len(p.tokens)
+}
+
+func (p *parser) peek() token {
+	if p.done() {
+		return token{kind: -1}
+	}
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() (token, error) {
+	if p.done() {
+		return token{}, errors.New("unexpected end of expression")
+	}
+	t := p.tokens[p.pos]
+	p.pos++
+	return t, nil
+}
+
+func (p *parser) isOp(op string) bool {
+	t := p.peek()
+	return t.kind == tokenOp && t.text == op
+}
+
+func (p *parser) parseOr() (node, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.isOp("||") {
+		p.pos++
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = orNode{left, right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseAnd() (node, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.isOp("&&") {
+		p.pos++
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = andNode{left, right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseUnary() (node, error) {
+	if p.isOp("!") {
+		p.pos++
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return notNode{operand}, nil
+	}
+
+	if p.peek().kind == tokenLParen {
+		p.pos++
+		n, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if t, err := p.next(); err != nil || t.kind != tokenRParen {
+			return nil, errors.New("missing closing parenthesis")
+		}
+		return n, nil
+	}
+
+	return p.parseComparison()
+}
+
+func (p *parser) parseComparison() (node, error) {
+	field, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	if field.kind != tokenIdent {
+		return nil, errors.Errorf("expected field, got %q", field.text)
+	}
+
+	op, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	switch op.text {
+	case "==", "!=", "<", "<=", ">", ">=", "matches", "contains":
+	default:
+		return nil, errors.Errorf("expected comparison after %s, got %q", field.text, op.text)
+	}
+
+	value, err := p.parseValue()
+	if err != nil {
+		return nil, err
+	}
+
+	n := compareNode{
+		field: strings.Split(field.text, "."),
+		op:    op.text,
+		value: value,
+	}
+
+	if op.text == "matches" {
+		s, ok := value.(string)
+		if !ok {
+			return nil, errors.Errorf("matches requires a string, got %v", value)
+		}
+		if n.re, err = regexp.Compile(s); err != nil {
+			return nil, errors.Wrapf(err, "invalid regular expression %q", s)
+		}
+	}
+	return n, nil
+}
+
+func (p *parser) parseValue() (interface{}, error) {
+	t, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+
+	switch t.kind {
+	case tokenString:
+		return t.text, nil
+	case tokenNumber:
+		f, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return nil, errors.Errorf("invalid number %q", t.text)
+		}
+		return f, nil
+	case tokenIdent:
+		switch t.text {
+		case "true":
+			return true, nil
+		case "false":
+			return false, nil
+		case "null":
+			return nil, nil
+		}
+	}
+	return nil, fmt.Errorf("expected value, got %q", t.text)
+}
@@ -0,0 +1,89 @@
+package filter
+
+import (
+	"testing"
+)
+
+const message = `{
+	"topic": "vm.powered.on",
+	"category": "info",
+	"userName": "VSPHERE.LOCAL\\Administrator",
+	"objectName": "prod-web-01",
+	"managedObjectReference": {"Type": "VirtualMachine", "Value": "vm-42"},
+	"host": {"name": "esx-01"},
+	"enrichment": {"guest.ipAddress": "10.0.0.1", "summary.config.numCpu": 4},
+	"tags": ["web", "prod"],
+	"data": {"Key": 1234, "Template": false}
+}`
+
+func TestMatchJSON(t *testing.T) {
+	var testCases = []struct {
+		name string
+		expr string
+		want bool
+	}{
+		{"equal", `category == "info"`, true},
+		{"not equal", `userName != "svc-automation"`, true},
+		{"regular expression", `objectName matches "^prod-"`, true},
+		{"regular expression mismatch", `objectName matches "^dev-"`, false},
+		{"nested field", `managedObjectReference.Type == "VirtualMachine"`, true},
+		{"entity", `host.name == "esx-01"`, true},
+		{"key containing dots", `enrichment.guest.ipAddress == "10.0.0.1"`, true},
+		{"number", `enrichment.summary.config.numCpu >= 4`, true},
+		{"number mismatch", `data.Key < 1000`, false},
+		{"boolean", `data.Template == false`, true},
+		{"substring", `userName contains "Admin"`, true},
+		{"array element", `tags contains "prod"`, true},
+		{"missing field is null", `datastore == null`, true},
+		{"missing field never matches", `datastore.name matches ".*"`, false},
+		{"missing field is not equal", `datastore.name != "ds-01"`, true},
+		{"type mismatch", `data.Key == "1234"`, false},
+		{"and", `category == "info" && objectName matches "^prod-"`, true},
+		{"or", `category == "error" || topic == "vm.powered.on"`, true},
+		{"not", `!(category == "info")`, false},
+		{"keywords", `category == "error" or not objectName matches "^dev-"`, true},
+		{"precedence", `category == "error" && topic == "x" || tags contains "web"`, true},
+		{"parentheses", `category == "error" && (topic == "x" || tags contains "web")`, false},
+	}
+
+	for _, test := range testCases {
+		f, err := Parse(test.expr)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+			continue
+		}
+
+		got, err := f.MatchJSON([]byte(message))
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("%s: wanted: %v, got: %v", test.name, test.want, got)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	var testCases = []struct {
+		name string
+		expr string
+	}{
+		{"empty", ``},
+		{"missing value", `category ==`},
+		{"missing operator", `category "info"`},
+		{"unknown operator", `category = "info"`},
+		{"unterminated string", `category == "info`},
+		{"invalid regular expression", `objectName matches "(prod"`},
+		{"regular expression not a string", `objectName matches 1`},
+		{"missing parenthesis", `(category == "info"`},
+		{"trailing tokens", `category == "info" "error"`},
+		{"value instead of field", `"info" == category`},
+	}
+
+	for _, test := range testCases {
+		if _, err := Parse(test.expr); err == nil {
+			t.Errorf("%s: wanted error for %q", test.name, test.expr)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Check returns an error if the checked component is unhealthy
+type Check func(ctx context.Context) error
+
+// Checker runs named checks, e.g. for the vCenter sessions and the gateway
+type Checker struct {
+	timeout time.Duration
+
+	lock   sync.RWMutex
+	checks map[string]Check
+}
+
+// Result is the outcome of all checks
+type Result struct {
+	Healthy bool                   `json:"healthy"`
+	Checks  map[string]CheckResult `json:"checks"`
+}
+
+// CheckResult is the outcome of a single check
+type CheckResult struct {
+	Healthy bool   `json:"healthy"`
+	Error   string `json:"error,omitempty"`
+}
+
+// NewChecker returns a Checker which cancels each check after timeout
+func NewChecker(timeout time.Duration) *Checker {
+	return &Checker{
+		timeout: timeout,
+		checks:  make(map[string]Check),
+	}
+}
+
+// Add adds or replaces the check with the given name
+func (c *Checker) Add(name string, check Check) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.checks[name] = check
+}
+
+// Run runs all checks concurrently and returns once all completed, the
+// timeout elapsed or ctx is done, whichever comes first
+func (c *Checker) Run(ctx context.Context) Result {
+	c.lock.RLock()
+	names := make([]string, 0, len(c.checks))
+	for name := range c.checks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	checks := make([]Check, len(names))
+	for i, name := range names {
+		checks[i] = c.checks[name]
+	}
+	c.lock.RUnlock()
+
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	type outcome struct {
+		i   int
+		err error
+	}
+	// buffered so checks which ignore ctx do not block once Run returned
+	outcomes := make(chan outcome, len(checks))
+	for i, check := range checks {
+		go func(i int, check Check) {
+			outcomes <- outcome{i, check(ctx)}
+		}(i, check)
+	}
+
+	errs := make([]error, len(checks))
+	done := make([]bool, len(checks))
+	for pending := len(checks); pending > 0 && ctx.Err() == nil; pending-- {
+		select {
+		case o := <-outcomes:
+			errs[o.i], done[o.i] = o.err, true
+		case <-ctx.Done():
+		}
+	}
+
+	// checks which did not complete in time fail with the error of ctx
+	for i := range errs {
+		if !done[i] {
+			errs[i] = ctx.Err()
+		}
+	}
+
+	res := Result{Healthy: true, Checks: make(map[string]CheckResult, len(names))}
+	for i, name := range names {
+		r := CheckResult{Healthy: errs[i] == nil}
+		if errs[i] != nil {
+			r.Error = errs[i].Error()
+			res.Healthy = false
+		}
+		res.Checks[name] = r
+	}
+	return res
+}
+
+// LivenessHandler returns an HTTP handler which always responds with status
+// 200 without running any check, as long as the connector serves requests it
+// is alive. Checks call remote services which must not restart the connector
+// when they are unavailable
+func (c *Checker) LivenessHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeResult(w, http.StatusOK, Result{Healthy: true, Checks: map[string]CheckResult{}})
+	})
+}
+
+// ReadinessHandler returns an HTTP handler which reports the result of all
+// checks and responds with status 503 if any failed
+func (c *Checker) ReadinessHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		res := c.Run(r.Context())
+
+		status := http.StatusOK
+		if !res.Healthy {
+			status = http.StatusServiceUnavailable
+		}
+		writeResult(w, status, res)
+	})
+}
+
+func writeResult(w http.ResponseWriter, status int, res Result) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(res)
+}
@@ -0,0 +1,113 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestChecker(t *testing.T) {
+	var testCases = []struct {
+		name          string
+		checks        map[string]Check
+		wantLiveness  int
+		wantReadiness int
+		want          Result
+	}{
+		{
+			"healthy",
+			map[string]Check{
+				"gateway": func(context.Context) error { return nil },
+			},
+			http.StatusOK,
+			http.StatusOK,
+			Result{Healthy: true, Checks: map[string]CheckResult{"gateway": {Healthy: true}}},
+		},
+		{
+			"unhealthy",
+			map[string]Check{
+				"gateway":     func(context.Context) error { return nil },
+				"vcenter/vc1": func(context.Context) error { return errors.New("not connected") },
+			},
+			http.StatusOK,
+			http.StatusServiceUnavailable,
+			Result{Healthy: false, Checks: map[string]CheckResult{
+				"gateway":     {Healthy: true},
+				"vcenter/vc1": {Healthy: false, Error: "not connected"},
+			}},
+		},
+		{
+			"timeout",
+			map[string]Check{
+				"gateway": func(ctx context.Context) error { <-ctx.Done(); return ctx.Err() },
+			},
+			http.StatusOK,
+			http.StatusServiceUnavailable,
+			Result{Healthy: false, Checks: map[string]CheckResult{"gateway": {Healthy: false, Error: context.DeadlineExceeded.Error()}}},
+		},
+	}
+
+	for _, test := range testCases {
+		c := NewChecker(10 * time.Millisecond)
+		for name, check := range test.checks {
+			c.Add(name, check)
+		}
+
+		// liveness does not run any check
+		alive := Result{Healthy: true, Checks: map[string]CheckResult{}}
+		handlers := []struct {
+			handler http.Handler
+			status  int
+			want    Result
+		}{
+			{c.LivenessHandler(), test.wantLiveness, alive},
+			{c.ReadinessHandler(), test.wantReadiness, test.want},
+		}
+		for _, h := range handlers {
+			rec := httptest.NewRecorder()
+			h.handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+
+			if rec.Code != h.status {
+				t.Errorf("%s: status: wanted: %d, got: %d", test.name, h.status, rec.Code)
+			}
+
+			var got Result
+			if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+				t.Fatalf("%s: %v", test.name, err)
+			}
+			if !reflect.DeepEqual(h.want, got) {
+				t.Errorf("%s: wanted: %+v, got: %+v", test.name, h.want, got)
+			}
+		}
+	}
+}
+
+func TestCheckerRunIgnoringContext(t *testing.T) {
+	c := NewChecker(time.Hour)
+	block := make(chan struct{})
+	defer close(block)
+	c.Add("gateway", func(context.Context) error { <-block; return nil })
+	c.Add("topics", func(context.Context) error { return nil })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	// assert that Run returns once ctx is done, even if a check ignores it
+	res := make(chan Result)
+	go func() { res <- c.Run(ctx) }()
+
+	select {
+	case got := <-res:
+		want := CheckResult{Healthy: false, Error: context.Canceled.Error()}
+		if got.Healthy || got.Checks["gateway"] != want {
+			t.Errorf("wanted: %+v, got: %+v", want, got.Checks["gateway"])
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run did not return after ctx was cancelled")
+	}
+}
@@ -0,0 +1,278 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode"
+
+	"github.com/pkg/errors"
+)
+
+// Level is the severity of a log entry
+type Level int32
+
+// Supported levels, entries below the configured level are discarded
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (l Level) String() string {
+	if l < LevelDebug || l > LevelError {
+		return fmt.Sprintf("level(%d)", int32(l))
+	}
+	return levelNames[l]
+}
+
+// ParseLevel parses the name of a level, e.g. "debug"
+func ParseLevel(name string) (Level, error) {
+	for i, n := range levelNames {
+		if strings.EqualFold(name, n) {
+			return Level(i), nil
+		}
+	}
+	if strings.EqualFold(name, "warning") {
+		return LevelWarn, nil
+	}
+	return LevelInfo, errors.Errorf("unknown log level %q", name)
+}
+
+// Output formats
+const (
+	// FormatLogfmt writes entries as key=value pairs
+	FormatLogfmt = "logfmt"
+	// FormatJSON writes entries as JSON objects
+	FormatJSON = "json"
+)
+
+// output is shared by a Logger and all loggers derived from it
+type output struct {
+	lock   sync.Mutex
+	w      io.Writer
+	json   bool
+	level  int32
+	now    func() time.Time
+	buffer bytes.Buffer
+}
+
+// Logger writes structured, leveled log entries. Each entry carries the
+// fields of the logger, see With. Logger is safe for concurrent use
+type Logger struct {
+	out    *output
+	fields []interface{}
+}
+
+// New returns a Logger writing entries at or above level to w in the given
+// format
+func New(w io.Writer, level Level, format string) (*Logger, error) {
+	out := output{w: w, level: int32(level), now: time.Now}
+
+	switch format {
+	case "", FormatLogfmt:
+	case FormatJSON:
+		out.json = true
+	default:
+		return nil, errors.Errorf("unknown log format %q", format)
+	}
+	return &Logger{out: &out}, nil
+}
+
+// With returns a logger which adds the given key value pairs to each entry
+func (l *Logger) With(kv ...interface{}) *Logger {
+	fields := make([]interface{}, 0, len(l.fields)+len(kv))
+	fields = append(fields, l.fields...)
+	fields = append(fields, kv...)
+	return &Logger{out: l.out, fields: fields}
+}
+
+// SetLevel changes the level of the logger and all loggers derived from it
+func (l *Logger) SetLevel(level Level) {
+	atomic.StoreInt32(&l.out.level, int32(level))
+}
+
+// Enabled returns true if entries of the level are written, e.g. to avoid
+// building expensive debug fields
+func (l *Logger) Enabled(level Level) bool {
+	return int32(level) >= atomic.LoadInt32(&l.out.level)
+}
+
+// Debug writes an entry at LevelDebug
+func (l *Logger) Debug(msg string, kv ...interface{}) { l.log(LevelDebug, msg, kv) }
+
+// Info writes an entry at LevelInfo
+func (l *Logger) Info(msg string, kv ...interface{}) { l.log(LevelInfo, msg, kv) }
+
+// Warn writes an entry at LevelWarn
+func (l *Logger) Warn(msg string, kv ...interface{}) { l.log(LevelWarn, msg, kv) }
+
+// Error writes an entry at LevelError
+func (l *Logger) Error(msg string, kv ...interface{}) { l.log(LevelError, msg, kv) }
+
+func (l *Logger) log(level Level, msg string, kv []interface{}) {
+	if !l.Enabled(level) {
+		return
+	}
+
+	o := l.out
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	b := &o.buffer
+	b.Reset()
+	if o.json {
+		b.WriteByte('{')
+	}
+	o.field(b, "time", o.now().UTC().Format(time.RFC3339Nano), true)
+	o.field(b, "level", level.String(), false)
+	o.field(b, "msg", msg, false)
+	o.fields(b, l.fields)
+	o.fields(b, kv)
+	if o.json {
+		b.WriteByte('}')
+	}
+	b.WriteByte('\n')
+
+	o.w.Write(b.Bytes())
+}
+
+func (o *output) fields(b *bytes.Buffer, kv []interface{}) {
+	for i := 0; i < len(kv); i += 2 {
+		key := fmt.Sprint(kv[i])
+		var value interface{} = "(missing)"
+		if i+1 < len(kv) {
+			value = kv[i+1]
+		}
+		o.field(b, key, value, false)
+	}
+}
+
+func (o *output) field(b *bytes.Buffer, key string, value interface{}, first bool) {
+	if rv := reflect.ValueOf(value); rv.Kind() == reflect.Ptr && rv.IsNil() {
+		value = nil
+	}
+	switch v := value.(type) {
+	case error:
+		value = v.Error()
+	case fmt.Stringer:
+		value = v.String()
+	}
+
+	if o.json {
+		if !first {
+			b.WriteByte(',')
+		}
+		k, _ := json.Marshal(key)
+		b.Write(k)
+		b.WriteByte(':')
+
+		v, err := json.Marshal(value)
+		if err != nil {
+			v, _ = json.Marshal(fmt.Sprint(value))
+		}
+		b.Write(v)
+		return
+	}
+
+	if !first {
+		b.WriteByte(' ')
+	}
+	b.WriteString(logfmtValue(key))
+	b.WriteByte('=')
+	b.WriteString(logfmtValue(fmt.Sprint(value)))
+}
+
+// logfmtValue quotes s if it is empty or contains spaces, quotes, equal signs
+// or control characters
+func logfmtValue(s string) string {
+	if len(s) == 0 {
+		return `""`
+	}
+	for _, r := range s {
+		if r <= ' ' || r == '=' || r == '"' || r == unicode.ReplacementChar || unicode.IsControl(r) {
+			return strconv.Quote(s)
+		}
+	}
+	return s
+}
+
+// Writer returns a writer which logs each written line as an entry at
+// LevelInfo, e.g. to route the standard logger through l
+func (l *Logger) Writer() io.Writer {
+	return writerFunc(func(p []byte) (int, error) {
+		for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+			l.Info(line)
+		}
+		return len(p), nil
+	})
+}
+
+type writerFunc func(p []byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) { return f(p) }
+
+var std atomic.Value
+
+func init() {
+	l, _ := New(os.Stderr, LevelInfo, FormatLogfmt)
+	std.Store(l)
+}
+
+// Default returns the default logger, which writes entries at LevelInfo and
+// above to stderr as logfmt unless replaced with SetDefault
+func Default() *Logger {
+	return std.Load().(*Logger)
+}
+
+// SetDefault replaces the default logger
+func SetDefault(l *Logger) {
+	std.Store(l)
+}
+
+// With returns a logger derived from the default logger, see Logger.With
+func With(kv ...interface{}) *Logger {
+	return Default().With(kv...)
+}
+
+// Debug writes an entry at LevelDebug to the default logger
+func Debug(msg string, kv ...interface{}) { Default().log(LevelDebug, msg, kv) }
+
+// Info writes an entry at LevelInfo to the default logger
+func Info(msg string, kv ...interface{}) { Default().log(LevelInfo, msg, kv) }
+
+// Warn writes an entry at LevelWarn to the default logger
+func Warn(msg string, kv ...interface{}) { Default().log(LevelWarn, msg, kv) }
+
+// Error writes an entry at LevelError to the default logger
+func Error(msg string, kv ...interface{}) { Default().log(LevelError, msg, kv) }
+
+type contextKey struct{}
+
+// NewContext returns a context carrying the logger, e.g. to log the
+// invocations of an event with its fields
+func NewContext(ctx context.Context, l *Logger) context.Context {
+	return context.WithValue(ctx, contextKey{}, l)
+}
+
+// FromContext returns the logger of the context or the default logger
+func FromContext(ctx context.Context) *Logger {
+	if ctx != nil {
+		if l, ok := ctx.Value(contextKey{}).(*Logger); ok {
+			return l
+		}
+	}
+	return Default()
+}
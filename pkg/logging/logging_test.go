@@ -0,0 +1,139 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log"
+	"testing"
+	"time"
+
+	vtypes "github.com/vmware/govmomi/vim25/types"
+)
+
+func newTestLogger(t *testing.T, buf *bytes.Buffer, level Level, format string) *Logger {
+	l, err := New(buf, level, format)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.out.now = func() time.Time { return time.Date(2019, 6, 1, 12, 0, 0, 0, time.UTC) }
+	return l
+}
+
+func TestLogger(t *testing.T) {
+	ref := &vtypes.ManagedObjectReference{Type: "VirtualMachine", Value: "vm-42"}
+	var nilRef *vtypes.ManagedObjectReference
+
+	var testCases = []struct {
+		name   string
+		format string
+		log    func(l *Logger)
+		want   string
+	}{
+		{
+			"logfmt",
+			FormatLogfmt,
+			func(l *Logger) {
+				l.With("source", "vc01.local", "moref", ref).Info("dispatching event", "eventKey", 42, "topic", "vm.powered.on")
+			},
+			"time=2019-06-01T12:00:00Z level=info msg=\"dispatching event\" source=vc01.local moref=VirtualMachine:vm-42 eventKey=42 topic=vm.powered.on\n",
+		},
+		{
+			"logfmt quoting",
+			FormatLogfmt,
+			func(l *Logger) {
+				l.Error("error handling event", "error", errors.New(`category "x" not found`), "user", "", "moref", nilRef)
+			},
+			"time=2019-06-01T12:00:00Z level=error msg=\"error handling event\" error=\"category \\\"x\\\" not found\" user=\"\" moref=<nil>\n",
+		},
+		{
+			"json",
+			FormatJSON,
+			func(l *Logger) {
+				l.With("eventKey", 42).Warn("error enriching event", "error", errors.New("not found"), "moref", ref, "redeliver", true)
+			},
+			`{"time":"2019-06-01T12:00:00Z","level":"warn","msg":"error enriching event","eventKey":42,"error":"not found","moref":"VirtualMachine:vm-42","redeliver":true}` + "\n",
+		},
+		{
+			"below level",
+			FormatLogfmt,
+			func(l *Logger) {
+				l.Debug("message", "payload", "{}")
+			},
+			"",
+		},
+		{
+			"missing value",
+			FormatLogfmt,
+			func(l *Logger) {
+				l.Info("odd", "key")
+			},
+			"time=2019-06-01T12:00:00Z level=info msg=odd key=(missing)\n",
+		},
+	}
+
+	for _, test := range testCases {
+		var buf bytes.Buffer
+		test.log(newTestLogger(t, &buf, LevelInfo, test.format))
+
+		if got := buf.String(); got != test.want {
+			t.Errorf("%s: wanted: %q, got: %q", test.name, test.want, got)
+		}
+	}
+}
+
+func TestParseLevel(t *testing.T) {
+	var testCases = []struct {
+		name    string
+		want    Level
+		wantErr bool
+	}{
+		{"debug", LevelDebug, false},
+		{"INFO", LevelInfo, false},
+		{"warning", LevelWarn, false},
+		{"error", LevelError, false},
+		{"verbose", LevelInfo, true},
+	}
+
+	for _, test := range testCases {
+		got, err := ParseLevel(test.name)
+		if (err != nil) != test.wantErr || got != test.want {
+			t.Errorf("%s: wanted: %v (error: %v), got: %v (%v)", test.name, test.want, test.wantErr, got, err)
+		}
+	}
+}
+
+func TestSetLevel(t *testing.T) {
+	var buf bytes.Buffer
+	l := newTestLogger(t, &buf, LevelInfo, FormatLogfmt)
+	derived := l.With("source", "vc01.local")
+
+	l.SetLevel(LevelDebug)
+	derived.Debug("message")
+	if buf.Len() == 0 {
+		t.Errorf("wanted: debug entry of derived logger after SetLevel")
+	}
+}
+
+func TestWriter(t *testing.T) {
+	var buf bytes.Buffer
+	std := log.New(newTestLogger(t, &buf, LevelInfo, FormatLogfmt).Writer(), "", 0)
+	std.Printf("could not connect to vCenter %s", "vc01.local")
+
+	want := "time=2019-06-01T12:00:00Z level=info msg=\"could not connect to vCenter vc01.local\"\n"
+	if got := buf.String(); got != want {
+		t.Errorf("wanted: %q, got: %q", want, got)
+	}
+}
+
+func TestContext(t *testing.T) {
+	var buf bytes.Buffer
+	l := newTestLogger(t, &buf, LevelInfo, FormatLogfmt).With("eventKey", 42)
+
+	if got := FromContext(NewContext(context.Background(), l)); got != l {
+		t.Errorf("wanted: logger of the context, got: %v", got)
+	}
+	if got := FromContext(context.Background()); got != Default() {
+		t.Errorf("wanted: default logger, got: %v", got)
+	}
+}
@@ -0,0 +1,122 @@
+package metrics
+
+import "github.com/prometheus/client_golang/prometheus"
+
+// Metrics exposed by the connector
+var (
+	// EventsReceived counts vCenter events handled by the connector, by topic
+	// and category
+	EventsReceived = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "vcenter_connector_events_received_total",
+		Help: "vCenter events received, by topic and category.",
+	}, []string{"topic", "category"})
+
+	// EventsDropped counts events which were not handed over to the
+	// controller, by reason, i.e. "already_delivered", "duplicate", "error"
+	// or "queue_full"
+	EventsDropped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "vcenter_connector_events_dropped_total",
+		Help: "Events not handed over for invocation, by reason.",
+	}, []string{"reason"})
+
+	// HandleEventErrors counts events which could not be converted to a
+	// message
+	HandleEventErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "vcenter_connector_handle_event_errors_total",
+		Help: "Events which could not be converted to a message.",
+	})
+
+	// StreamLag is the time between the creation of the last received event
+	// and its receipt, by vCenter Server
+	StreamLag = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "vcenter_connector_stream_lag_seconds",
+		Help: "Time between the creation and receipt of the last event, by vCenter Server.",
+	}, []string{"vcenter"})
+
+	// SessionReconnects counts logins after the first one, by vCenter Server
+	SessionReconnects = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "vcenter_connector_session_reconnects_total",
+		Help: "Logins to vCenter after the first one, by vCenter Server.",
+	}, []string{"vcenter"})
+
+	// Invocations counts the final outcome of function invocations, by
+	// function and HTTP status code. Invocations which did not reach the
+	// gateway have the status "error"
+	Invocations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "vcenter_connector_invocations_total",
+		Help: "Function invocations, by function and final status code.",
+	}, []string{"function", "status"})
+
+	// InvocationDuration is the duration of each attempt to invoke a
+	// function, by function
+	InvocationDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "vcenter_connector_invocation_duration_seconds",
+		Help:    "Duration of function invocation attempts, by function.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"function"})
+
+	// QueueDepth is the number of events waiting to be handed over to the
+	// OpenFaaS controller
+	QueueDepth = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "vcenter_connector_queue_depth",
+		Help: "Number of events waiting in the dispatch queue.",
+	})
+
+	// QueueCapacity is the maximum number of events in the dispatch queue
+	QueueCapacity = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "vcenter_connector_queue_capacity",
+		Help: "Maximum number of events in the dispatch queue.",
+	})
+
+	// QueueFull counts events which found the dispatch queue full, by the
+	// back-pressure action taken, i.e. "blocked" or "dropped"
+	QueueFull = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "vcenter_connector_queue_full_total",
+		Help: "Events which found the dispatch queue full, by back-pressure action.",
+	}, []string{"action"})
+
+	// QueueBlockedSeconds is the time the event stream was blocked waiting for
+	// space in the dispatch queue
+	QueueBlockedSeconds = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "vcenter_connector_queue_blocked_seconds_total",
+		Help: "Time the event stream was blocked waiting for space in the dispatch queue.",
+	})
+
+	// EventsDeduplicated counts events which were skipped because they were
+	// already handed over to the controller
+	EventsDeduplicated = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "vcenter_connector_events_deduplicated_total",
+		Help: "Events skipped because they were already delivered.",
+	})
+
+	// InvocationRetries counts retried function invocations, by function
+	InvocationRetries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "vcenter_connector_invocation_retries_total",
+		Help: "Retried function invocations, by function.",
+	}, []string{"function"})
+
+	// DeadLetters counts messages added to the dead letter store, by function
+	DeadLetters = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "vcenter_connector_dead_letters_total",
+		Help: "Messages which could not be delivered and were added to the dead letter store, by function.",
+	}, []string{"function"})
+)
+
+func init() {
+	prometheus.MustRegister(
+		EventsReceived,
+		EventsDropped,
+		HandleEventErrors,
+		StreamLag,
+		SessionReconnects,
+		Invocations,
+		InvocationDuration,
+		QueueDepth,
+		QueueCapacity,
+		QueueFull,
+		QueueBlockedSeconds,
+		EventsDeduplicated,
+		InvocationRetries,
+		DeadLetters,
+	)
+}
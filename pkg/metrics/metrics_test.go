@@ -0,0 +1,36 @@
+package metrics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+func TestHandler(t *testing.T) {
+	EventsDropped.WithLabelValues("queue_full").Inc()
+	InvocationDuration.WithLabelValues("tag-vm").Observe(0.5)
+	QueueDepth.Set(3)
+
+	rec := httptest.NewRecorder()
+	promhttp.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	body := rec.Body.String()
+	var testCases = []struct {
+		name string
+		line string
+	}{
+		{"counter", `vcenter_connector_events_dropped_total{reason="queue_full"} 1`},
+		{"histogram", `vcenter_connector_invocation_duration_seconds_bucket{function="tag-vm",le="0.5"} 1`},
+		{"gauge", `vcenter_connector_queue_depth 3`},
+		{"go collector", `# TYPE go_goroutines gauge`},
+	}
+
+	for _, test := range testCases {
+		if !strings.Contains(body, test.line+"\n") {
+			t.Errorf("%s: wanted: %s, got:\n%s", test.name, test.line, body)
+		}
+	}
+}
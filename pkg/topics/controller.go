@@ -0,0 +1,440 @@
+package topics
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	ofsdk "github.com/openfaas-incubator/connector-sdk/types"
+	"github.com/openfaas-incubator/vcenter-connector/pkg/filter"
+	"github.com/openfaas-incubator/vcenter-connector/pkg/logging"
+	"github.com/openfaas-incubator/vcenter-connector/pkg/metrics"
+	"github.com/openfaas-incubator/vcenter-connector/pkg/tracing"
+	"github.com/openfaas/faas-provider/auth"
+	"github.com/pkg/errors"
+)
+
+// HeaderInvoker is implemented by controllers which can send additional HTTP
+// headers when invoking functions
+type HeaderInvoker interface {
+	InvokeWithHeaders(ctx context.Context, topic string, message *[]byte, header http.Header)
+}
+
+// payloadKey is the context key of the payload filters are evaluated against
+type payloadKey struct{}
+
+// WithPayload returns a context carrying the payload function filters are
+// evaluated against if it differs from the invoked message, e.g. the data of a
+// CloudEvent
+func WithPayload(ctx context.Context, payload []byte) context.Context {
+	return context.WithValue(ctx, payloadKey{}, payload)
+}
+
+// FunctionInvoker is implemented by controllers which can invoke a single
+// function regardless of its subscriptions, e.g. to redrive messages which
+// could not be delivered
+type FunctionInvoker interface {
+	// InvokeFunction invokes the function, retrying according to its retry
+	// policy, and returns the final response which is also passed to the
+	// subscribers
+	InvokeFunction(ctx context.Context, topic, fn string, message []byte, header http.Header) ofsdk.InvokerResponse
+}
+
+// HealthChecker is implemented by controllers which report the state of the
+// connection to the gateway
+type HealthChecker interface {
+	// Ping returns an error unless the gateway is reachable and healthy
+	Ping(ctx context.Context) error
+	// Synced returns true once the subscriptions were read from the gateway
+	Synced() bool
+}
+
+// SettingsUpdater is implemented by controllers whose delivery defaults can
+// be changed while they are running
+type SettingsUpdater interface {
+	// UpdateSettings replaces the settings and rebuilds the subscriptions.
+	// Invocations in progress complete with the previous settings
+	UpdateSettings(settings Settings)
+}
+
+// controller implements the connector SDK Controller interface like the SDK's
+// default controller, but routes messages through a Map so functions can
+// subscribe to topic patterns
+type controller struct {
+	config      *ofsdk.ControllerConfig
+	credentials *auth.BasicAuthCredentials
+	client      *http.Client
+	gatewayURL  string
+	responses   chan ofsdk.InvokerResponse
+	topics      *Map
+
+	jitter  *jitter
+	refresh chan struct{}
+
+	filterLock sync.RWMutex
+	settings   Settings
+	filters    map[string]*filter.Expr
+	retries    map[string]RetryPolicy
+	synced     bool
+
+	lock        sync.RWMutex
+	subscribers []ofsdk.ResponseSubscriber
+}
+
+// NewController creates a controller which invokes all functions subscribed to
+// a topic or to a pattern matching it, unless the message does not match the
+// filter annotation of the function or else its filter in settings. Failed
+// invocations are retried according to the retry annotations of the function
+// or else the retry policy of settings. The topics of the topic annotation are
+// separated by the TopicDelimiter of settings, the one of config is ignored.
+// The controller implements HeaderInvoker, FunctionInvoker, HealthChecker and
+// SettingsUpdater
+func NewController(credentials *auth.BasicAuthCredentials, config *ofsdk.ControllerConfig, settings Settings) ofsdk.Controller {
+	// the timeout of the settings applies per invocation, so it can be
+	// changed while running
+	client := ofsdk.MakeClient(config.UpstreamTimeout)
+	client.Timeout = 0
+
+	c := controller{
+		config:      config,
+		credentials: credentials,
+		client:      client,
+		gatewayURL:  gatewayRoute(config),
+		responses:   make(chan ofsdk.InvokerResponse),
+		topics:      NewMap(),
+		settings:    settings,
+		jitter:      newJitter(),
+		refresh:     make(chan struct{}, 1),
+	}
+
+	if config.PrintResponse {
+		c.Subscribe(&ofsdk.ResponsePrinter{PrintResponseBody: config.PrintResponseBody})
+	}
+
+	go c.forwardResponses()
+
+	return &c
+}
+
+// Subscribe adds a ResponseSubscriber which receives the result of each
+// function invocation
+func (c *controller) Subscribe(subscriber ofsdk.ResponseSubscriber) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.subscribers = append(c.subscribers, subscriber)
+}
+
+// Invoke invokes all functions subscribed to the topic
+func (c *controller) Invoke(topic string, message *[]byte) {
+	c.InvokeWithContext(context.Background(), topic, message)
+}
+
+// InvokeWithContext invokes all functions subscribed to the topic while
+// propagating ctx
+func (c *controller) InvokeWithContext(ctx context.Context, topic string, message *[]byte) {
+	c.InvokeWithHeaders(ctx, topic, message, nil)
+}
+
+// InvokeWithHeaders invokes all functions subscribed to the topic with the
+// given additional HTTP headers
+func (c *controller) InvokeWithHeaders(ctx context.Context, topic string, message *[]byte, header http.Header) {
+	if len(*message) == 0 {
+		c.responses <- ofsdk.InvokerResponse{
+			Context: ctx,
+			Error:   fmt.Errorf("no message to send"),
+			Topic:   topic,
+		}
+		return
+	}
+
+	payload := *message
+	if p, ok := ctx.Value(payloadKey{}).([]byte); ok {
+		payload = p
+	}
+
+	var doc interface{}
+	var decodeErr error
+	decoded := false
+
+	for _, fn := range c.topics.Match(topic) {
+		f, filtered := c.filter(fn)
+		if filtered {
+			if f == nil {
+				continue
+			}
+			_, span := tracing.Start(ctx, "filter", tracing.KindInternal, tracing.AttrFaaSInvokedName, fn, "vcenter.filter", f.String())
+			if !decoded {
+				if decodeErr = json.Unmarshal(payload, &doc); decodeErr != nil {
+					logging.FromContext(ctx).Error("error decoding message for filters", "error", decodeErr)
+				}
+				decoded = true
+			}
+			matched := decodeErr == nil && f.Match(doc)
+			span.SetAttributes("vcenter.filter.matched", matched)
+			span.SetError(decodeErr)
+			span.End()
+			if !matched {
+				continue
+			}
+		}
+
+		c.responses <- c.invokeWithRetries(ctx, topic, fn, *message, header)
+	}
+}
+
+// InvokeFunction invokes the function directly
+func (c *controller) InvokeFunction(ctx context.Context, topic, fn string, message []byte, header http.Header) ofsdk.InvokerResponse {
+	res := c.invokeWithRetries(ctx, topic, fn, message, header)
+	c.responses <- res
+	return res
+}
+
+// invokeWithRetries invokes the function until it succeeds, fails with a
+// status which is not retried or the attempts of its retry policy are
+// exhausted, and returns the last response
+func (c *controller) invokeWithRetries(ctx context.Context, topic, fn string, message []byte, header http.Header) ofsdk.InvokerResponse {
+	policy := c.retryPolicy(fn)
+	l := logging.FromContext(ctx).With("function", fn)
+
+	var res ofsdk.InvokerResponse
+	for attempt := 1; ; attempt++ {
+		l.Debug("invoking function", "attempt", attempt)
+
+		res = ofsdk.InvokerResponse{
+			Context:  context.WithValue(ctx, invocationKey{}, invocation{attempt, message, header}),
+			Topic:    topic,
+			Function: fn,
+		}
+		actx, span := tracing.Start(ctx, "invoke", tracing.KindClient,
+			tracing.AttrFaaSInvokedName, fn,
+			tracing.AttrHTTPRequestMethod, http.MethodPost,
+			tracing.AttrURLFull, c.functionURL(fn),
+			"vcenter.topic", topic,
+		)
+		if attempt > 1 {
+			span.SetAttributes(tracing.AttrHTTPRequestResendCount, attempt-1)
+		}
+		res.Body, res.Status, res.Header, res.Error = c.invoke(actx, fn, message, header)
+		if res.Status > 0 {
+			span.SetAttributes(tracing.AttrHTTPResponseStatusCode, res.Status)
+		}
+		if res.Error != nil {
+			span.SetError(res.Error)
+		} else if !succeeded(res) {
+			span.SetError(errors.Errorf("function returned status %d", res.Status))
+		}
+		span.End()
+
+		if succeeded(res) || attempt >= policy.Attempts || !policy.retryable(res.Status, res.Error) {
+			return res
+		}
+
+		delay := policy.delay(attempt, c.jitter.int63n)
+		l.Warn("retrying function invocation", "delay", delay, "attempt", attempt, "maxAttempts", policy.Attempts, "status", res.Status, "error", res.Error)
+		metrics.InvocationRetries.WithLabelValues(fn).Inc()
+
+		if !sleep(ctx, delay) {
+			return res
+		}
+	}
+}
+
+// succeeded returns true if the invocation returned a 2xx status
+func succeeded(res ofsdk.InvokerResponse) bool {
+	return res.Error == nil && res.Status >= 200 && res.Status < 300
+}
+
+// retryPolicy returns the retry policy of the function
+func (c *controller) retryPolicy(fn string) RetryPolicy {
+	c.filterLock.RLock()
+	defer c.filterLock.RUnlock()
+	if p, ok := c.retries[fn]; ok {
+		return p
+	}
+	return c.settings.Retry
+}
+
+// filter returns the filter of the function and whether it has one. A nil
+// filter of a function which has one means it is invalid
+func (c *controller) filter(fn string) (*filter.Expr, bool) {
+	c.filterLock.RLock()
+	defer c.filterLock.RUnlock()
+	f, ok := c.filters[fn]
+	return f, ok
+}
+
+// timeout returns the timeout of an invocation, 0 if there is none
+func (c *controller) timeout() time.Duration {
+	if timeout := c.currentSettings().Timeout; timeout > 0 {
+		return timeout
+	}
+	if c.config != nil {
+		return c.config.UpstreamTimeout
+	}
+	return 0
+}
+
+// functionURL returns the URL of the function at the gateway
+func (c *controller) functionURL(fn string) string {
+	return fmt.Sprintf("%s/%s", c.gatewayURL, fn)
+}
+
+// invoke posts the message to the function via the gateway
+func (c *controller) invoke(ctx context.Context, fn string, message []byte, header http.Header) (*[]byte, int, *http.Header, error) {
+	req, err := http.NewRequest(http.MethodPost, c.functionURL(fn), bytes.NewReader(message))
+	if err != nil {
+		return nil, 0, nil, errors.Wrapf(err, "unable to invoke %s", fn)
+	}
+	if timeout := c.timeout(); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	req = req.WithContext(ctx)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	tracing.Inject(ctx, req.Header)
+
+	start := time.Now()
+	res, err := c.client.Do(req)
+	metrics.InvocationDuration.WithLabelValues(fn).Observe(time.Since(start).Seconds())
+	if err != nil {
+		// the gateway was not reached, there is no status
+		return nil, 0, nil, errors.Wrapf(err, "unable to invoke %s", fn)
+	}
+	defer res.Body.Close()
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, res.StatusCode, &res.Header, errors.Wrapf(err, "error reading response of %s", fn)
+	}
+	return &body, res.StatusCode, &res.Header, nil
+}
+
+// BeginMapBuilder starts rebuilding the subscriptions from the function
+// annotations of the gateway in the background
+func (c *controller) BeginMapBuilder() {
+	builder := lookupBuilder{
+		gatewayURL:  c.config.GatewayURL,
+		client:      ofsdk.MakeClient(c.config.UpstreamTimeout),
+		credentials: c.credentials,
+	}
+
+	go c.synchronizeLookups(time.NewTicker(c.config.RebuildInterval), &builder)
+}
+
+// Topics returns all subscribed topics and topic patterns
+func (c *controller) Topics() []string {
+	return c.topics.Topics()
+}
+
+// UpdateSettings replaces the settings and triggers a rebuild of the
+// subscriptions, which applies the filters of settings
+func (c *controller) UpdateSettings(settings Settings) {
+	c.filterLock.Lock()
+	c.settings = settings
+	c.filterLock.Unlock()
+
+	select {
+	case c.refresh <- struct{}{}:
+	default:
+		// a rebuild is pending already
+	}
+}
+
+// currentSettings returns the settings in effect
+func (c *controller) currentSettings() Settings {
+	c.filterLock.RLock()
+	defer c.filterLock.RUnlock()
+	return c.settings
+}
+
+// synchronizeLookups rebuilds the subscriptions at each tick of the ticker and
+// whenever the settings were updated
+func (c *controller) synchronizeLookups(ticker *time.Ticker, builder *lookupBuilder) {
+	for {
+		builder.settings = c.currentSettings()
+		s, err := builder.build()
+		if err != nil {
+			// keep the previous subscriptions until the gateway is reachable
+			logging.Error("error building topic map", "error", err)
+		} else {
+			if c.config.PrintSync {
+				logging.Debug("syncing topic map")
+			}
+			c.sync(s)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-c.refresh:
+		}
+	}
+}
+
+// sync replaces the subscriptions, filters and retry policies of the
+// functions
+func (c *controller) sync(s *subscriptions) {
+	c.filterLock.Lock()
+	c.filters = s.filters
+	c.retries = s.retries
+	c.synced = true
+	c.filterLock.Unlock()
+
+	c.topics.Sync(s.lookup)
+}
+
+// Synced returns true once the subscriptions were read from the gateway
+func (c *controller) Synced() bool {
+	c.filterLock.RLock()
+	defer c.filterLock.RUnlock()
+	return c.synced
+}
+
+// Ping checks the health endpoint of the gateway
+func (c *controller) Ping(ctx context.Context) error {
+	req, err := http.NewRequest(http.MethodGet, c.config.GatewayURL+"/healthz", nil)
+	if err != nil {
+		return errors.Wrap(err, "invalid gateway URL")
+	}
+	req = req.WithContext(ctx)
+	if c.credentials != nil {
+		req.SetBasicAuth(c.credentials.User, c.credentials.Password)
+	}
+
+	res, err := c.client.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "gateway not reachable")
+	}
+	defer res.Body.Close()
+	io.Copy(ioutil.Discard, res.Body)
+
+	if res.StatusCode != http.StatusOK {
+		return errors.Errorf("gateway returned status %d", res.StatusCode)
+	}
+	return nil
+}
+
+func (c *controller) forwardResponses() {
+	for res := range c.responses {
+		c.lock.RLock()
+		for _, sub := range c.subscribers {
+			sub.Response(res)
+		}
+		c.lock.RUnlock()
+	}
+}
+
+func gatewayRoute(config *ofsdk.ControllerConfig) string {
+	if config.AsyncFunctionInvocation {
+		return fmt.Sprintf("%s/%s", config.GatewayURL, "async-function")
+	}
+	return fmt.Sprintf("%s/%s", config.GatewayURL, "function")
+}
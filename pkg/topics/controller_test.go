@@ -0,0 +1,190 @@
+package topics
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	ofsdk "github.com/openfaas-incubator/connector-sdk/types"
+	"github.com/openfaas-incubator/vcenter-connector/pkg/filter"
+	"github.com/openfaas-incubator/vcenter-connector/pkg/tracing"
+	"github.com/openfaas/faas-provider/auth"
+)
+
+func TestControllerPing(t *testing.T) {
+	var testCases = []struct {
+		name    string
+		status  int
+		wantErr bool
+	}{
+		{"healthy", http.StatusOK, false},
+		{"unhealthy", http.StatusServiceUnavailable, true},
+	}
+
+	for _, test := range testCases {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if user, _, ok := r.BasicAuth(); r.URL.Path != "/healthz" || !ok || user != "admin" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			w.WriteHeader(test.status)
+		}))
+
+		c := controller{
+			config:      &ofsdk.ControllerConfig{GatewayURL: srv.URL},
+			credentials: &auth.BasicAuthCredentials{User: "admin", Password: "secret"},
+			client:      srv.Client(),
+		}
+
+		err := c.Ping(context.Background())
+		srv.Close()
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s: wanted error: %v, got: %v", test.name, test.wantErr, err)
+		}
+	}
+
+	// assert that an unreachable gateway is reported
+	c := controller{
+		config: &ofsdk.ControllerConfig{GatewayURL: "http://127.0.0.1:1"},
+		client: http.DefaultClient,
+	}
+	if err := c.Ping(context.Background()); err == nil {
+		t.Errorf("unreachable: wanted error")
+	}
+}
+
+func TestControllerSynced(t *testing.T) {
+	c := controller{topics: NewMap()}
+	if c.Synced() {
+		t.Errorf("wanted: not synced before the first sync")
+	}
+
+	c.sync(&subscriptions{lookup: map[string][]string{"vm.powered.on": {"tag-vm"}}})
+	if !c.Synced() {
+		t.Errorf("wanted: synced after the first sync")
+	}
+}
+
+func TestControllerInvokeTraceparent(t *testing.T) {
+	var got string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Get(tracing.TraceparentHeader)
+	}))
+	defer srv.Close()
+
+	c := controller{gatewayURL: srv.URL, client: srv.Client()}
+
+	// without a span no header is sent
+	if _, _, _, err := c.invoke(context.Background(), "fn1", []byte("{}"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if got != "" {
+		t.Errorf("no span: wanted: no traceparent, got: %v", got)
+	}
+
+	tracer := tracing.NewTracer(tracing.NewWriterExporter(ioutil.Discard), nil)
+	defer tracer.Shutdown(context.Background())
+	ctx, span := tracer.Start(context.Background(), "invoke", tracing.KindClient)
+	defer span.End()
+
+	if _, _, _, err := c.invoke(ctx, "fn1", []byte("{}"), http.Header{"Traceparent": {"stale"}}); err != nil {
+		t.Fatal(err)
+	}
+	if want := span.Context().Traceparent(); got != want {
+		t.Errorf("span: wanted: %v, got: %v", want, got)
+	}
+}
+
+func TestControllerInvokeTimeout(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	c := controller{
+		config:     &ofsdk.ControllerConfig{UpstreamTimeout: time.Minute},
+		gatewayURL: srv.URL,
+		client:     srv.Client(),
+		refresh:    make(chan struct{}, 1),
+	}
+
+	// the timeout of the settings replaces the one of the config
+	c.UpdateSettings(Settings{Timeout: 50 * time.Millisecond})
+	if got := c.timeout(); got != 50*time.Millisecond {
+		t.Errorf("timeout: wanted: %v, got: %v", 50*time.Millisecond, got)
+	}
+	if _, status, _, err := c.invoke(context.Background(), "fn1", []byte("{}"), nil); err == nil || status != 0 {
+		t.Errorf("wanted: status 0 and a timeout, got: %v, %v", status, err)
+	}
+
+	c.UpdateSettings(Settings{})
+	if got := c.timeout(); got != time.Minute {
+		t.Errorf("default timeout: wanted: %v, got: %v", time.Minute, got)
+	}
+}
+
+func TestControllerInvokeUnreachable(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	c := controller{gatewayURL: srv.URL, client: srv.Client()}
+	srv.Close()
+
+	// a gateway which was not reached has no status
+	_, status, _, err := c.invoke(context.Background(), "fn1", []byte("{}"), nil)
+	if err == nil || status != 0 {
+		t.Errorf("wanted: status 0 and an error, got: %v, %v", status, err)
+	}
+}
+
+func TestControllerUpdateSettings(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/system/functions" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(`[{"name": "tag-vm", "annotations": {"topic": "vm.powered.on;vm.powered.off"}}]`))
+	}))
+	defer srv.Close()
+
+	c := NewController(nil, &ofsdk.ControllerConfig{GatewayURL: srv.URL, UpstreamTimeout: time.Second}, Settings{TopicDelimiter: ","}).(*controller)
+	// only updates trigger a rebuild
+	go c.synchronizeLookups(time.NewTicker(time.Hour), &lookupBuilder{gatewayURL: srv.URL, client: srv.Client()})
+
+	// waitFor polls the subscriptions until they match
+	waitFor := func(topic string, want []string) {
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			got := c.topics.Match(topic)
+			if reflect.DeepEqual(want, got) {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("%s: wanted: %v, got: %v", topic, want, got)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	waitFor("vm.powered.on;vm.powered.off", []string{"tag-vm"})
+
+	f, err := filter.Parse(`category == "error"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.UpdateSettings(Settings{TopicDelimiter: ";", Filters: map[string]*filter.Expr{"tag-vm": f}, Retry: RetryPolicy{Attempts: 5}})
+	waitFor("vm.powered.off", []string{"tag-vm"})
+
+	if got, ok := c.filter("tag-vm"); !ok || got != f {
+		t.Errorf("filter: wanted: %v, got: %v", f, got)
+	}
+	if got := c.retryPolicy("unknown").Attempts; got != 5 {
+		t.Errorf("retry attempts: wanted: %v, got: %v", 5, got)
+	}
+}
@@ -0,0 +1,215 @@
+package topics
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/openfaas-incubator/vcenter-connector/pkg/filter"
+	"github.com/openfaas-incubator/vcenter-connector/pkg/logging"
+	"github.com/openfaas/faas-provider/auth"
+	"github.com/openfaas/faas-provider/types"
+	"github.com/pkg/errors"
+)
+
+// Function annotations read by the connector
+const (
+	// TopicAnnotation lists the topics a function is subscribed to
+	TopicAnnotation = "topic"
+	// FilterAnnotation holds a filter expression a message must match for
+	// the function to be invoked, see the filter package
+	FilterAnnotation = "vcenter.filter"
+)
+
+// subscriptions are the topics, filters and retry policies of the deployed
+// functions
+type subscriptions struct {
+	// lookup maps topics and topic patterns to function paths
+	lookup map[string][]string
+	// filters maps function paths to their filter. A nil filter means the
+	// function has an invalid filter and must not be invoked
+	filters map[string]*filter.Expr
+	// retries maps function paths to their retry policy
+	retries map[string]RetryPolicy
+}
+
+// lookupBuilder reads the subscriptions from the function annotations like
+// the connector SDK's FunctionLookupBuilder, which only reads topics
+type lookupBuilder struct {
+	gatewayURL  string
+	client      *http.Client
+	credentials *auth.BasicAuthCredentials
+	// settings apply to functions without the respective annotations
+	settings Settings
+}
+
+// Settings are the delivery defaults for functions which do not override them
+// with annotations
+type Settings struct {
+	// TopicDelimiter separates the topics of the topic annotation, which is a
+	// single topic if empty
+	TopicDelimiter string
+	// Retry is the retry policy of functions without retry annotations
+	Retry RetryPolicy
+	// Filters maps function names to the filter of functions without a filter
+	// annotation. Names qualified with the namespace, e.g. "fn.openfaas-fn",
+	// take precedence over plain names, which apply in all namespaces
+	Filters map[string]*filter.Expr
+	// Timeout is the timeout of each invocation, the UpstreamTimeout of the
+	// controller config if 0
+	Timeout time.Duration
+}
+
+// filter returns the filter configured for the function, if any
+func (s Settings) filter(name, path string) (*filter.Expr, bool) {
+	if f, ok := s.Filters[path]; ok {
+		return f, true
+	}
+	f, ok := s.Filters[name]
+	return f, ok
+}
+
+// build returns the subscriptions of the functions of all namespaces
+func (b *lookupBuilder) build() (*subscriptions, error) {
+	namespaces, err := b.namespaces()
+	if err != nil {
+		return nil, err
+	}
+	if len(namespaces) == 0 {
+		namespaces = []string{""}
+	}
+
+	s := subscriptions{
+		lookup:  make(map[string][]string),
+		filters: make(map[string]*filter.Expr),
+		retries: make(map[string]RetryPolicy),
+	}
+	for _, namespace := range namespaces {
+		functions, err := b.functions(namespace)
+		if err != nil {
+			return nil, err
+		}
+		for _, fn := range functions {
+			s.add(fn, namespace, b.settings)
+		}
+	}
+	return &s, nil
+}
+
+// add adds the subscriptions of the function
+func (s *subscriptions) add(fn types.FunctionStatus, namespace string, settings Settings) {
+	if fn.Annotations == nil {
+		return
+	}
+	annotations := *fn.Annotations
+
+	value, ok := annotations[TopicAnnotation]
+	if !ok {
+		return
+	}
+
+	path := fn.Name
+	if len(namespace) > 0 {
+		path = fn.Name + "." + namespace
+	}
+
+	topics := []string{value}
+	if len(settings.TopicDelimiter) > 0 {
+		topics = strings.Split(value, settings.TopicDelimiter)
+	}
+
+	subscribed := false
+	for _, topic := range topics {
+		topic = strings.TrimSpace(topic)
+		if len(topic) == 0 {
+			continue
+		}
+		s.lookup[topic] = append(s.lookup[topic], path)
+		subscribed = true
+	}
+
+	if !subscribed {
+		return
+	}
+
+	s.retries[path] = settings.Retry.override(path, annotations)
+
+	if expr, ok := annotations[FilterAnnotation]; ok {
+		f, err := filter.Parse(expr)
+		if err != nil {
+			logging.Error("invalid filter, not invoking function", "function", path, "error", err)
+		}
+		s.filters[path] = f
+	} else if f, ok := settings.filter(fn.Name, path); ok {
+		s.filters[path] = f
+	}
+}
+
+// namespaces returns the function namespaces, none if the provider does not
+// support namespaces
+func (b *lookupBuilder) namespaces() ([]string, error) {
+	res, err := b.get(b.gatewayURL + "/system/namespaces")
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to list namespaces")
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+
+	var namespaces []string
+	if err := decode(res, &namespaces); err != nil {
+		return nil, errors.Wrap(err, "unable to list namespaces")
+	}
+	return namespaces, nil
+}
+
+// functions returns the functions of the namespace
+func (b *lookupBuilder) functions(namespace string) ([]types.FunctionStatus, error) {
+	u, err := url.Parse(b.gatewayURL + "/system/functions")
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid gateway URL")
+	}
+	if len(namespace) > 0 {
+		u.RawQuery = url.Values{"namespace": []string{namespace}}.Encode()
+	}
+
+	res, err := b.get(u.String())
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to list functions")
+	}
+	defer res.Body.Close()
+
+	var functions []types.FunctionStatus
+	if err := decode(res, &functions); err != nil {
+		return nil, errors.Wrap(err, "unable to list functions")
+	}
+	return functions, nil
+}
+
+func (b *lookupBuilder) get(u string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	if b.credentials != nil {
+		req.SetBasicAuth(b.credentials.User, b.credentials.Password)
+	}
+	return b.client.Do(req)
+}
+
+func decode(res *http.Response, v interface{}) error {
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %d: %q", res.StatusCode, string(body))
+	}
+	return errors.Wrapf(json.Unmarshal(body, v), "unable to unmarshal %q", string(body))
+}
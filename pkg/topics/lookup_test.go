@@ -0,0 +1,112 @@
+package topics
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/openfaas-incubator/vcenter-connector/pkg/filter"
+	"github.com/openfaas/faas-provider/types"
+)
+
+func TestSubscriptionsAdd(t *testing.T) {
+	functions := []types.FunctionStatus{
+		{Name: "tag-vm", Annotations: &map[string]string{
+			TopicAnnotation:  "vm.powered.on, vm.powered.off",
+			FilterAnnotation: `objectName matches "^prod-"`,
+		}},
+		{Name: "audit", Annotations: &map[string]string{TopicAnnotation: "vm.#"}},
+		{Name: "broken", Annotations: &map[string]string{
+			TopicAnnotation:  "vm.powered.on",
+			FilterAnnotation: `objectName ~ "prod"`,
+		}},
+		{Name: "no-topic", Annotations: &map[string]string{FilterAnnotation: `category == "error"`}},
+		{Name: "no-annotations"},
+	}
+
+	s := subscriptions{
+		lookup:  make(map[string][]string),
+		filters: make(map[string]*filter.Expr),
+		retries: make(map[string]RetryPolicy),
+	}
+	for _, fn := range functions {
+		s.add(fn, "openfaas-fn", Settings{TopicDelimiter: ",", Retry: RetryPolicy{Attempts: 3}})
+	}
+
+	wantLookup := map[string][]string{
+		"vm.powered.on":  {"tag-vm.openfaas-fn", "broken.openfaas-fn"},
+		"vm.powered.off": {"tag-vm.openfaas-fn"},
+		"vm.#":           {"audit.openfaas-fn"},
+	}
+	if !reflect.DeepEqual(wantLookup, s.lookup) {
+		t.Errorf("lookup: wanted: %v, got: %v", wantLookup, s.lookup)
+	}
+
+	if f := s.filters["tag-vm.openfaas-fn"]; f == nil || f.String() != `objectName matches "^prod-"` {
+		t.Errorf("filter: wanted: %s, got: %v", `objectName matches "^prod-"`, f)
+	}
+	if f, ok := s.filters["broken.openfaas-fn"]; !ok || f != nil {
+		t.Errorf("invalid filter: wanted: nil, got: %v (present: %v)", f, ok)
+	}
+	if _, ok := s.filters["audit.openfaas-fn"]; ok {
+		t.Errorf("unfiltered function: wanted no filter")
+	}
+	if _, ok := s.filters["no-topic.openfaas-fn"]; ok {
+		t.Errorf("unsubscribed function: wanted no filter")
+	}
+}
+
+func TestSubscriptionsAddSettingsFilters(t *testing.T) {
+	parse := func(src string) *filter.Expr {
+		f, err := filter.Parse(src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return f
+	}
+	settings := Settings{Filters: map[string]*filter.Expr{
+		"audit":             parse(`category == "error"`),
+		"audit.openfaas-fn": parse(`category == "warning"`),
+		"tag-vm":            parse(`category == "info"`),
+	}}
+
+	functions := []types.FunctionStatus{
+		{Name: "tag-vm", Annotations: &map[string]string{
+			TopicAnnotation:  "vm.powered.on",
+			FilterAnnotation: `objectName matches "^prod-"`,
+		}},
+		{Name: "audit", Annotations: &map[string]string{TopicAnnotation: "vm.#"}},
+	}
+
+	var testCases = []struct {
+		namespace string
+		want      map[string]string
+	}{
+		{"openfaas-fn", map[string]string{
+			"tag-vm.openfaas-fn": `objectName matches "^prod-"`,
+			"audit.openfaas-fn":  `category == "warning"`,
+		}},
+		{"dev", map[string]string{
+			"tag-vm.dev": `objectName matches "^prod-"`,
+			"audit.dev":  `category == "error"`,
+		}},
+	}
+
+	for _, test := range testCases {
+		s := subscriptions{
+			lookup:  make(map[string][]string),
+			filters: make(map[string]*filter.Expr),
+			retries: make(map[string]RetryPolicy),
+		}
+		for _, fn := range functions {
+			s.add(fn, test.namespace, settings)
+		}
+
+		got := make(map[string]string)
+		for path, f := range s.filters {
+			got[path] = f.String()
+		}
+		if !reflect.DeepEqual(test.want, got) {
+			t.Errorf("%s: wanted: %v, got: %v", test.namespace, test.want, got)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package topics
+
+import (
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Wildcards supported in topic patterns. SingleWildcard matches exactly one
+// segment of a dotted topic, MultiWildcard and its alias
+// MultiWildcardAlias match any number of trailing segments, including none
+const (
+	SingleWildcard     = "*"
+	MultiWildcard      = "#"
+	MultiWildcardAlias = "**"
+)
+
+// IsPattern returns true if the topic contains a wildcard segment
+func IsPattern(topic string) bool {
+	for _, segment := range strings.Split(topic, ".") {
+		if isWildcard(segment) {
+			return true
+		}
+	}
+	return false
+}
+
+// Match returns true if the dotted topic matches the pattern, e.g.
+// "vm.powered.on" matches "vm.powered.on", "vm.*.on", "vm.#" and "**". A
+// multi-segment wildcard is only supported as the last segment of a pattern,
+// elsewhere it is treated like a single segment wildcard
+func Match(pattern, topic string) bool {
+	if pattern == topic {
+		return true
+	}
+
+	p := strings.Split(pattern, ".")
+	t := strings.Split(topic, ".")
+
+	for i, segment := range p {
+		if isMultiWildcard(segment) && i == len(p)-1 {
+			return true
+		}
+		if i >= len(t) {
+			return false
+		}
+		if segment != t[i] && !isWildcard(segment) {
+			return false
+		}
+	}
+	return len(p) == len(t)
+}
+
+func isWildcard(segment string) bool {
+	return segment == SingleWildcard || isMultiWildcard(segment)
+}
+
+func isMultiWildcard(segment string) bool {
+	return segment == MultiWildcard || segment == MultiWildcardAlias
+}
+
+// Map maps topics and topic patterns to the functions subscribed to them. It
+// replaces the exact matching TopicMap of the connector SDK
+type Map struct {
+	lock   sync.RWMutex
+	lookup map[string][]string
+}
+
+// NewMap returns an empty Map
+func NewMap() *Map {
+	return &Map{
+		lookup: make(map[string][]string),
+	}
+}
+
+// Sync replaces the subscriptions
+func (m *Map) Sync(lookup map[string][]string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.lookup = lookup
+}
+
+// Match returns the sorted functions subscribed to the topic, either directly
+// or through a pattern. A function subscribed through several matching
+// patterns is only returned once
+func (m *Map) Match(topic string) []string {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	seen := make(map[string]bool)
+	var functions []string
+	for pattern, subscribed := range m.lookup {
+		if !Match(pattern, topic) {
+			continue
+		}
+		for _, fn := range subscribed {
+			if !seen[fn] {
+				seen[fn] = true
+				functions = append(functions, fn)
+			}
+		}
+	}
+
+	sort.Strings(functions)
+	return functions
+}
+
+// Topics returns all subscribed topics and topic patterns
+func (m *Map) Topics() []string {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	topics := make([]string, 0, len(m.lookup))
+	for topic := range m.lookup {
+		topics = append(topics, topic)
+	}
+	return topics
+}
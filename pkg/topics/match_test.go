@@ -0,0 +1,61 @@
+package topics
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMatch(t *testing.T) {
+	var testCases = []struct {
+		name    string
+		pattern string
+		topic   string
+		want    bool
+	}{
+		{"exact", "vm.powered.on", "vm.powered.on", true},
+		{"exact mismatch", "vm.powered.on", "vm.powered.off", false},
+		{"single wildcard", "vm.powered.*", "vm.powered.on", true},
+		{"single wildcard in the middle", "vm.*.on", "vm.powered.on", true},
+		{"single wildcard matches one segment only", "vm.*", "vm.powered.on", false},
+		{"single wildcard requires a segment", "vm.powered.*", "vm.powered", false},
+		{"multi wildcard", "vm.#", "vm.powered.on", true},
+		{"multi wildcard alias", "vm.**", "vm.powered.on", true},
+		{"multi wildcard matches no segment", "vm.#", "vm", true},
+		{"multi wildcard prefix mismatch", "vm.#", "drs.vm.powered.on", false},
+		{"multi wildcard only", "#", "host.connected", true},
+		{"prefix is no match", "vm.powered", "vm.powered.on", false},
+		{"mixed wildcards", "*.vm.#", "drs.vm.powered.on", true},
+	}
+
+	for _, test := range testCases {
+		if got := Match(test.pattern, test.topic); got != test.want {
+			t.Errorf("%s: wanted: %v, got: %v", test.name, test.want, got)
+		}
+	}
+}
+
+func TestMapMatch(t *testing.T) {
+	m := NewMap()
+	m.Sync(map[string][]string{
+		"vm.powered.on": {"tag-vm"},
+		"vm.powered.*":  {"audit", "notify"},
+		"vm.#":          {"audit"},
+		"host.#":        {"host-check"},
+	})
+
+	var testCases = []struct {
+		name  string
+		topic string
+		want  []string
+	}{
+		{"exact and patterns, each function once", "vm.powered.on", []string{"audit", "notify", "tag-vm"}},
+		{"patterns only", "vm.powered.off", []string{"audit", "notify"}},
+		{"no subscriber", "datastore.destroyed", nil},
+	}
+
+	for _, test := range testCases {
+		if got := m.Match(test.topic); !reflect.DeepEqual(test.want, got) {
+			t.Errorf("%s: wanted: %v, got: %v", test.name, test.want, got)
+		}
+	}
+}
@@ -0,0 +1,193 @@
+package topics
+
+import (
+	"context"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/openfaas-incubator/vcenter-connector/pkg/logging"
+	"github.com/pkg/errors"
+)
+
+// Function annotations overriding the default retry policy
+const (
+	// RetryAttemptsAnnotation is the maximum number of invocations per message
+	RetryAttemptsAnnotation = "vcenter.retry.attempts"
+	// RetryStatusAnnotation lists the comma-delimited HTTP status codes which
+	// are retried
+	RetryStatusAnnotation = "vcenter.retry.status"
+	// RetryBackoffAnnotation is the delay before the first retry
+	RetryBackoffAnnotation = "vcenter.retry.backoff"
+	// RetryMaxBackoffAnnotation is the maximum delay between retries
+	RetryMaxBackoffAnnotation = "vcenter.retry.max-backoff"
+)
+
+// RetryPolicy configures how often and when a failed function invocation is
+// retried. The backoff before a retry doubles with each attempt up to
+// MaxBackoff, the actual delay is a random duration between half and all of
+// the backoff
+type RetryPolicy struct {
+	// Attempts is the maximum number of invocations, 1 or less disables
+	// retries
+	Attempts int
+	// Status lists the HTTP status codes which are retried. Errors reaching
+	// the gateway are always retried
+	Status []int
+	// Backoff is the delay before the first retry
+	Backoff time.Duration
+	// MaxBackoff limits the delay between retries, unlimited if zero
+	MaxBackoff time.Duration
+}
+
+// ParseStatusCodes parses a comma-delimited list of HTTP status codes
+func ParseStatusCodes(value string) ([]int, error) {
+	var codes []int
+	for _, s := range strings.Split(value, ",") {
+		s = strings.TrimSpace(s)
+		if len(s) == 0 {
+			continue
+		}
+		code, err := strconv.Atoi(s)
+		if err != nil || code < 100 || code > 599 {
+			return nil, errors.Errorf("invalid status code %q", s)
+		}
+		codes = append(codes, code)
+	}
+	return codes, nil
+}
+
+// retryable returns true if the outcome of an invocation should be retried
+func (p RetryPolicy) retryable(status int, err error) bool {
+	if err != nil {
+		return true
+	}
+	for _, code := range p.Status {
+		if code == status {
+			return true
+		}
+	}
+	return false
+}
+
+// delay returns the delay before the given retry, starting at 1. jitter
+// returns a random number in [0, n)
+func (p RetryPolicy) delay(retry int, jitter func(n int64) int64) time.Duration {
+	d := p.Backoff
+	for i := 1; i < retry && (p.MaxBackoff <= 0 || d < p.MaxBackoff); i++ {
+		d *= 2
+	}
+	if p.MaxBackoff > 0 && d > p.MaxBackoff {
+		d = p.MaxBackoff
+	}
+
+	half := int64(d / 2)
+	if half <= 0 {
+		return d
+	}
+	return time.Duration(half + jitter(half+1))
+}
+
+// override returns the policy with the retry annotations of a function
+// applied, invalid annotations are logged and ignored
+func (p RetryPolicy) override(fn string, annotations map[string]string) RetryPolicy {
+	if v, ok := annotations[RetryAttemptsAnnotation]; ok {
+		if attempts, err := strconv.Atoi(strings.TrimSpace(v)); err == nil {
+			p.Attempts = attempts
+		} else {
+			logging.Warn("invalid annotation", "function", fn, "annotation", RetryAttemptsAnnotation, "value", v)
+		}
+	}
+
+	if v, ok := annotations[RetryStatusAnnotation]; ok {
+		if codes, err := ParseStatusCodes(v); err == nil {
+			p.Status = codes
+		} else {
+			logging.Warn("invalid annotation", "function", fn, "annotation", RetryStatusAnnotation, "error", err)
+		}
+	}
+
+	durations := []struct {
+		key string
+		d   *time.Duration
+	}{
+		{RetryBackoffAnnotation, &p.Backoff},
+		{RetryMaxBackoffAnnotation, &p.MaxBackoff},
+	}
+	for _, a := range durations {
+		v, ok := annotations[a.key]
+		if !ok {
+			continue
+		}
+		if d, err := time.ParseDuration(strings.TrimSpace(v)); err == nil && d >= 0 {
+			*a.d = d
+		} else {
+			logging.Warn("invalid annotation", "function", fn, "annotation", a.key, "value", v)
+		}
+	}
+
+	return p
+}
+
+// jitter is a concurrency safe source of random jitter
+type jitter struct {
+	lock sync.Mutex
+	rand *rand.Rand
+}
+
+func newJitter() *jitter {
+	return &jitter{rand: rand.New(rand.NewSource(time.Now().UnixNano()))}
+}
+
+func (j *jitter) int63n(n int64) int64 {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	return j.rand.Int63n(n)
+}
+
+// invocationKey is the context key of the invocation a response belongs to
+type invocationKey struct{}
+
+// invocation describes the invocation of a function
+type invocation struct {
+	attempts int
+	message  []byte
+	header   http.Header
+}
+
+// Attempts returns the number of invocations which led to the response with
+// the given context, 0 if unknown
+func Attempts(ctx context.Context) int {
+	if ctx == nil {
+		return 0
+	}
+	i, _ := ctx.Value(invocationKey{}).(invocation)
+	return i.attempts
+}
+
+// Invocation returns the message and additional HTTP headers of the
+// invocation which led to the response with the given context
+func Invocation(ctx context.Context) ([]byte, http.Header) {
+	if ctx == nil {
+		return nil, nil
+	}
+	i, _ := ctx.Value(invocationKey{}).(invocation)
+	return i.message, i.header
+}
+
+// sleep waits for d or until ctx is done, whichever comes first. It returns
+// false if ctx is done
+func sleep(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
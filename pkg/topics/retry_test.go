@@ -0,0 +1,114 @@
+package topics
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRetryPolicyDelay(t *testing.T) {
+	p := RetryPolicy{Backoff: time.Second, MaxBackoff: 5 * time.Second}
+
+	var testCases = []struct {
+		name   string
+		retry  int
+		jitter func(int64) int64
+		want   time.Duration
+	}{
+		{"first retry without jitter", 1, func(int64) int64 { return 0 }, 500 * time.Millisecond},
+		{"first retry with full jitter", 1, func(n int64) int64 { return n - 1 }, time.Second},
+		{"doubled", 2, func(int64) int64 { return 0 }, time.Second},
+		{"limited", 5, func(n int64) int64 { return n - 1 }, 5 * time.Second},
+	}
+
+	for _, test := range testCases {
+		if got := p.delay(test.retry, test.jitter); got != test.want {
+			t.Errorf("%s: wanted: %v, got: %v", test.name, test.want, got)
+		}
+	}
+}
+
+func TestParseStatusCodes(t *testing.T) {
+	var testCases = []struct {
+		name    string
+		value   string
+		want    []int
+		wantErr bool
+	}{
+		{"list", "502, 503,504", []int{502, 503, 504}, false},
+		{"empty", "", nil, false},
+		{"not a number", "502,bad", nil, true},
+		{"out of range", "42", nil, true},
+	}
+
+	for _, test := range testCases {
+		got, err := ParseStatusCodes(test.value)
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s: wanted error: %v, got: %v", test.name, test.wantErr, err)
+		}
+		if !reflect.DeepEqual(test.want, got) {
+			t.Errorf("%s: wanted: %v, got: %v", test.name, test.want, got)
+		}
+	}
+}
+
+func TestRetryPolicyOverride(t *testing.T) {
+	p := RetryPolicy{Attempts: 3, Status: []int{502}, Backoff: time.Second, MaxBackoff: time.Minute}
+
+	got := p.override("fn", map[string]string{
+		RetryAttemptsAnnotation:   "5",
+		RetryStatusAnnotation:     "500,503",
+		RetryBackoffAnnotation:    "200ms",
+		RetryMaxBackoffAnnotation: "forever",
+	})
+
+	want := RetryPolicy{Attempts: 5, Status: []int{500, 503}, Backoff: 200 * time.Millisecond, MaxBackoff: time.Minute}
+	if !reflect.DeepEqual(want, got) {
+		t.Errorf("wanted: %+v, got: %+v", want, got)
+	}
+}
+
+func TestInvokeWithRetries(t *testing.T) {
+	var testCases = []struct {
+		name         string
+		statuses     []int
+		policy       RetryPolicy
+		wantStatus   int
+		wantAttempts int
+	}{
+		{"success", []int{200}, RetryPolicy{Attempts: 3, Status: []int{502}}, 200, 1},
+		{"retried until success", []int{502, 503, 202}, RetryPolicy{Attempts: 3, Status: []int{502, 503}}, 202, 3},
+		{"attempts exhausted", []int{502, 502, 502}, RetryPolicy{Attempts: 2, Status: []int{502}}, 502, 2},
+		{"status not retried", []int{500, 200}, RetryPolicy{Attempts: 3, Status: []int{502}}, 500, 1},
+		{"retries disabled", []int{502, 200}, RetryPolicy{Attempts: 1, Status: []int{502}}, 502, 1},
+	}
+
+	for _, test := range testCases {
+		var calls int32
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			n := atomic.AddInt32(&calls, 1)
+			w.WriteHeader(test.statuses[n-1])
+		}))
+
+		c := controller{
+			client:     srv.Client(),
+			gatewayURL: srv.URL,
+			settings:   Settings{Retry: test.policy},
+			jitter:     newJitter(),
+		}
+
+		res := c.invokeWithRetries(context.Background(), "vm.powered.on", "fn", []byte("{}"), nil)
+		srv.Close()
+
+		if res.Status != test.wantStatus {
+			t.Errorf("%s: status: wanted: %d, got: %d", test.name, test.wantStatus, res.Status)
+		}
+		if got := Attempts(res.Context); got != test.wantAttempts || int(calls) != test.wantAttempts {
+			t.Errorf("%s: attempts: wanted: %d, got: %d (calls: %d)", test.name, test.wantAttempts, got, calls)
+		}
+	}
+}
@@ -0,0 +1,258 @@
+package tracing
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Exporters
+const (
+	// ExporterStdout writes spans as JSON lines, e.g. for local testing
+	ExporterStdout = "stdout"
+	// ExporterOTLP sends spans to an OpenTelemetry collector using OTLP over
+	// HTTP with JSON encoding
+	ExporterOTLP = "otlp"
+)
+
+// DefaultOTLPEndpoint is the default traces endpoint of a local
+// OpenTelemetry collector
+const DefaultOTLPEndpoint = "http://localhost:4318/v1/traces"
+
+// Exporter sends batches of ended spans to a tracing backend
+type Exporter interface {
+	Export(spans []SpanData) error
+}
+
+// WriterExporter writes each span as JSON object on a line
+type WriterExporter struct {
+	lock sync.Mutex
+	w    io.Writer
+}
+
+// NewWriterExporter returns an exporter writing to w, e.g. os.Stdout
+func NewWriterExporter(w io.Writer) *WriterExporter {
+	return &WriterExporter{w: w}
+}
+
+// spanJSON is the JSON representation of a span written by WriterExporter
+type spanJSON struct {
+	Name         string                 `json:"name"`
+	Kind         string                 `json:"kind"`
+	TraceID      string                 `json:"traceId"`
+	SpanID       string                 `json:"spanId"`
+	ParentSpanID string                 `json:"parentSpanId,omitempty"`
+	Start        time.Time              `json:"start"`
+	End          time.Time              `json:"end"`
+	Duration     string                 `json:"duration"`
+	Attributes   map[string]interface{} `json:"attributes,omitempty"`
+	Error        string                 `json:"error,omitempty"`
+}
+
+// Export writes the spans
+func (e *WriterExporter) Export(spans []SpanData) error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, s := range spans {
+		out := spanJSON{
+			Name:     s.Name,
+			Kind:     s.Kind.String(),
+			TraceID:  s.Context.TraceID.String(),
+			SpanID:   s.Context.SpanID.String(),
+			Start:    s.Start.UTC(),
+			End:      s.End.UTC(),
+			Duration: s.End.Sub(s.Start).String(),
+			Error:    s.Error,
+		}
+		if s.Parent.IsValid() {
+			out.ParentSpanID = s.Parent.String()
+		}
+		if len(s.Attributes) > 0 {
+			out.Attributes = make(map[string]interface{}, len(s.Attributes))
+			for _, a := range s.Attributes {
+				out.Attributes[a.Key] = a.Value
+			}
+		}
+		if err := enc.Encode(out); err != nil {
+			return errors.Wrap(err, "error encoding span")
+		}
+	}
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	_, err := e.w.Write(buf.Bytes())
+	return errors.Wrap(err, "error writing spans")
+}
+
+// OTLPExporter posts spans to an OTLP/HTTP traces endpoint as JSON, see
+// https://github.com/open-telemetry/opentelemetry-proto/blob/main/docs/specification.md
+type OTLPExporter struct {
+	endpoint string
+	resource []Attribute
+	header   http.Header
+	client   *http.Client
+}
+
+// NewOTLPExporter returns an exporter posting to the traces endpoint, e.g.
+// DefaultOTLPEndpoint. The spans are reported with the resource attributes,
+// see Resource, and the requests carry the additional headers, e.g. for
+// authentication
+func NewOTLPExporter(endpoint string, resource []Attribute, header http.Header, timeout time.Duration) *OTLPExporter {
+	return &OTLPExporter{
+		endpoint: endpoint,
+		resource: resource,
+		header:   header,
+		client:   &http.Client{Timeout: timeout},
+	}
+}
+
+// Resource returns the resource attributes of the service running on this
+// host, the version is omitted if empty
+func Resource(service, version string) []Attribute {
+	attrs := []Attribute{
+		{Key: AttrServiceName, Value: service},
+		{Key: AttrTelemetrySDKLanguage, Value: "go"},
+	}
+	if len(version) > 0 {
+		attrs = append(attrs, Attribute{Key: AttrServiceVersion, Value: version})
+	}
+	if host, err := os.Hostname(); err == nil {
+		attrs = append(attrs, Attribute{Key: AttrHostName, Value: host})
+	}
+	return attrs
+}
+
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Status            otlpStatus     `json:"status"`
+}
+
+type otlpKeyValue struct {
+	Key   string                 `json:"key"`
+	Value map[string]interface{} `json:"value"`
+}
+
+type otlpStatus struct {
+	// Code is 0 for unset and 2 for error
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+// otlpScopeName is the instrumentation scope reported with all spans
+const otlpScopeName = "github.com/openfaas-incubator/vcenter-connector"
+
+// Export posts the spans in a single request
+func (e *OTLPExporter) Export(spans []SpanData) error {
+	out := make([]otlpSpan, len(spans))
+	for i, s := range spans {
+		out[i] = otlpSpan{
+			TraceID:           s.Context.TraceID.String(),
+			SpanID:            s.Context.SpanID.String(),
+			Name:              s.Name,
+			Kind:              int(s.Kind),
+			StartTimeUnixNano: strconv.FormatInt(s.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.End.UnixNano(), 10),
+			Attributes:        otlpAttributes(s.Attributes),
+		}
+		if s.Parent.IsValid() {
+			out[i].ParentSpanID = s.Parent.String()
+		}
+		if len(s.Error) > 0 {
+			out[i].Status = otlpStatus{Code: 2, Message: s.Error}
+		}
+	}
+
+	body, err := json.Marshal(otlpRequest{
+		ResourceSpans: []otlpResourceSpans{{
+			Resource: otlpResource{
+				Attributes: otlpAttributes(e.resource),
+			},
+			ScopeSpans: []otlpScopeSpans{{
+				Scope: otlpScope{Name: otlpScopeName},
+				Spans: out,
+			}},
+		}},
+	})
+	if err != nil {
+		return errors.Wrap(err, "error encoding spans")
+	}
+
+	req, err := http.NewRequest(http.MethodPost, e.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrap(err, "invalid OTLP endpoint")
+	}
+	for k, v := range e.header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := e.client.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "error sending spans")
+	}
+	defer res.Body.Close()
+	io.Copy(ioutil.Discard, res.Body)
+
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return errors.Errorf("OTLP endpoint returned status %d", res.StatusCode)
+	}
+	return nil
+}
+
+func otlpAttributes(attrs []Attribute) []otlpKeyValue {
+	kvs := make([]otlpKeyValue, 0, len(attrs))
+	for _, a := range attrs {
+		var value map[string]interface{}
+		switch v := a.Value.(type) {
+		case bool:
+			value = map[string]interface{}{"boolValue": v}
+		case int64:
+			// 64 bit integers are strings in the JSON encoding of protobuf
+			value = map[string]interface{}{"intValue": strconv.FormatInt(v, 10)}
+		case float64:
+			value = map[string]interface{}{"doubleValue": v}
+		default:
+			value = map[string]interface{}{"stringValue": fmt.Sprint(v)}
+		}
+		kvs = append(kvs, otlpKeyValue{Key: a.Key, Value: value})
+	}
+	return kvs
+}
@@ -0,0 +1,18 @@
+package tracing
+
+// Attribute keys of the OpenTelemetry semantic conventions, see
+// https://opentelemetry.io/docs/specs/semconv/
+const (
+	// resource attributes
+	AttrServiceName          = "service.name"
+	AttrServiceVersion       = "service.version"
+	AttrHostName             = "host.name"
+	AttrTelemetrySDKLanguage = "telemetry.sdk.language"
+
+	// attributes of function invocations
+	AttrFaaSInvokedName        = "faas.invoked_name"
+	AttrHTTPRequestMethod      = "http.request.method"
+	AttrHTTPResponseStatusCode = "http.response.status_code"
+	AttrHTTPRequestResendCount = "http.request.resend_count"
+	AttrURLFull                = "url.full"
+)
@@ -0,0 +1,469 @@
+// Package tracing is a small stand-in for the OpenTelemetry tracing API and
+// its stdout and OTLP/HTTP exporters. It only covers what the connector
+// reports and should be replaced by go.opentelemetry.io/otel once the images
+// are built with a Go release the SDK supports
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/openfaas-incubator/vcenter-connector/pkg/logging"
+	"github.com/pkg/errors"
+)
+
+// TraceparentHeader is the HTTP header propagating the span context, see
+// https://www.w3.org/TR/trace-context/
+const TraceparentHeader = "traceparent"
+
+// TraceID identifies a trace
+type TraceID [16]byte
+
+// SpanID identifies a span within a trace
+type SpanID [8]byte
+
+func (t TraceID) String() string { return hex.EncodeToString(t[:]) }
+
+func (s SpanID) String() string { return hex.EncodeToString(s[:]) }
+
+// IsValid returns false for the all-zero trace ID
+func (t TraceID) IsValid() bool { return t != TraceID{} }
+
+// IsValid returns false for the all-zero span ID
+func (s SpanID) IsValid() bool { return s != SpanID{} }
+
+// SpanContext identifies a span across process boundaries
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	Sampled bool
+}
+
+// IsValid returns true if both IDs are set
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID.IsValid() && sc.SpanID.IsValid()
+}
+
+// Traceparent returns the span context formatted as traceparent header value
+func (sc SpanContext) Traceparent() string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return fmt.Sprintf("00-%s-%s-%s", sc.TraceID, sc.SpanID, flags)
+}
+
+// ParseTraceparent parses a traceparent header value of version 00
+func ParseTraceparent(value string) (SpanContext, error) {
+	var sc SpanContext
+
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) != 4 || parts[0] != "00" {
+		return sc, errors.Errorf("unsupported traceparent %q", value)
+	}
+
+	var flags [1]byte
+	fields := []struct {
+		hex string
+		dst []byte
+	}{
+		{parts[1], sc.TraceID[:]},
+		{parts[2], sc.SpanID[:]},
+		{parts[3], flags[:]},
+	}
+	for _, f := range fields {
+		if len(f.hex) != 2*len(f.dst) || strings.ToLower(f.hex) != f.hex {
+			return sc, errors.Errorf("invalid traceparent %q", value)
+		}
+		if _, err := hex.Decode(f.dst, []byte(f.hex)); err != nil {
+			return sc, errors.Errorf("invalid traceparent %q", value)
+		}
+	}
+
+	if !sc.IsValid() {
+		return sc, errors.Errorf("invalid traceparent %q", value)
+	}
+	sc.Sampled = flags[0]&1 == 1
+	return sc, nil
+}
+
+// Kind describes the relationship of a span to its remote peers
+type Kind int
+
+// Span kinds, the values match the OTLP span kinds
+const (
+	KindInternal Kind = 1
+	KindClient   Kind = 3
+)
+
+func (k Kind) String() string {
+	if k == KindClient {
+		return "client"
+	}
+	return "internal"
+}
+
+// SpanData is the immutable record of an ended span passed to exporters
+type SpanData struct {
+	Name       string
+	Kind       Kind
+	Context    SpanContext
+	Parent     SpanID
+	Start      time.Time
+	End        time.Time
+	Attributes []Attribute
+	// Error is the error message of a failed operation, empty on success
+	Error string
+}
+
+// Attribute is a key value pair describing a span. Values are strings,
+// booleans, integers or floats, other values are converted to strings
+type Attribute struct {
+	Key   string
+	Value interface{}
+}
+
+// Span is an operation within a trace. All methods are safe for concurrent
+// use
+type Span interface {
+	// Context returns the span context, e.g. to propagate it to a function
+	Context() SpanContext
+	// SetAttributes adds or replaces attributes given as key value pairs
+	SetAttributes(kv ...interface{})
+	// SetError marks the operation of the span as failed, a nil error is
+	// ignored
+	SetError(err error)
+	// End records the end of the span, only the first call has an effect
+	End()
+}
+
+// Provider starts spans. Tracer is the Provider of this package, the
+// instrumented code only depends on the interface so it can be backed by the
+// OpenTelemetry SDK instead
+type Provider interface {
+	// Start starts a span as child of the span in ctx, if any, and returns a
+	// context carrying the new span
+	Start(ctx context.Context, name string, kind Kind, kv ...interface{}) (context.Context, Span)
+	// Shutdown exports the remaining spans
+	Shutdown(ctx context.Context) error
+}
+
+// noopSpan is returned while tracing is disabled
+type noopSpan struct{}
+
+func (noopSpan) Context() SpanContext            { return SpanContext{} }
+func (noopSpan) SetAttributes(kv ...interface{}) {}
+func (noopSpan) SetError(err error)              {}
+func (noopSpan) End()                            {}
+
+// span is the Span of a Tracer
+type span struct {
+	tracer *Tracer
+
+	lock sync.Mutex
+	data SpanData
+	done bool
+}
+
+func (s *span) Context() SpanContext {
+	return s.data.Context
+}
+
+func (s *span) SetAttributes(kv ...interface{}) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.data.Attributes = setAttributes(s.data.Attributes, kv)
+}
+
+func (s *span) SetError(err error) {
+	if err == nil {
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.data.Error = err.Error()
+}
+
+// End hands the span over to the exporter, unless it is not sampled
+func (s *span) End() {
+	s.lock.Lock()
+	if s.done {
+		s.lock.Unlock()
+		return
+	}
+	s.done = true
+	s.data.End = s.tracer.now()
+	data := s.data
+	data.Attributes = append([]Attribute(nil), s.data.Attributes...)
+	s.lock.Unlock()
+
+	if data.Context.Sampled {
+		s.tracer.export(data)
+	}
+}
+
+// attributes returns a copy of the attributes of the span
+func (s *span) attributes() []Attribute {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]Attribute(nil), s.data.Attributes...)
+}
+
+func setAttributes(attrs []Attribute, kv []interface{}) []Attribute {
+	for i := 0; i+1 < len(kv); i += 2 {
+		a := Attribute{Key: fmt.Sprint(kv[i]), Value: attributeValue(kv[i+1])}
+
+		replaced := false
+		for j := range attrs {
+			if attrs[j].Key == a.Key {
+				attrs[j] = a
+				replaced = true
+				break
+			}
+		}
+		if !replaced {
+			attrs = append(attrs, a)
+		}
+	}
+	return attrs
+}
+
+func attributeValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case string, bool, int64, float64:
+		return v
+	case int:
+		return int64(v)
+	case int32:
+		return int64(v)
+	case float32:
+		return float64(v)
+	case error:
+		return v.Error()
+	case nil:
+		return ""
+	}
+	return fmt.Sprint(v)
+}
+
+// Sampler decides whether a new trace is recorded and exported, spans of a
+// trace which is not sampled still propagate their context
+type Sampler func(id TraceID) bool
+
+// AlwaysSample samples all traces
+func AlwaysSample(id TraceID) bool { return true }
+
+// RatioSampler returns a Sampler which samples the given ratio of traces,
+// between 0 and 1, based on their trace ID like the TraceIDRatioBased
+// sampler of OpenTelemetry
+func RatioSampler(ratio float64) Sampler {
+	switch {
+	case ratio >= 1:
+		return AlwaysSample
+	case ratio <= 0:
+		return func(TraceID) bool { return false }
+	}
+
+	bound := uint64(ratio * (1 << 63))
+	return func(id TraceID) bool {
+		return binary.BigEndian.Uint64(id[8:])>>1 < bound
+	}
+}
+
+// Tracer is a Provider which creates spans and exports them in batches
+type Tracer struct {
+	exporter Exporter
+	sampler  Sampler
+	now      func() time.Time
+
+	lock   sync.RWMutex
+	closed bool
+	spans  chan SpanData
+	done   chan struct{}
+}
+
+// Tracer batching defaults
+const (
+	queueSize     = 2048
+	batchSize     = 512
+	batchInterval = 5 * time.Second
+)
+
+// NewTracer returns a Tracer exporting ended spans with the exporter in the
+// background until Shutdown is called. New traces are sampled by the sampler,
+// all of them if it is nil, spans with a parent follow the decision of the
+// parent
+func NewTracer(exporter Exporter, sampler Sampler) *Tracer {
+	if sampler == nil {
+		sampler = AlwaysSample
+	}
+
+	t := Tracer{
+		exporter: exporter,
+		sampler:  sampler,
+		now:      time.Now,
+		spans:    make(chan SpanData, queueSize),
+		done:     make(chan struct{}),
+	}
+	go t.run(time.NewTicker(batchInterval))
+	return &t
+}
+
+// Start starts a span as child of the span in ctx, if any, and returns a
+// context carrying the new span. The span inherits the attributes of its
+// parent, e.g. the event type and source of the event it belongs to
+func (t *Tracer) Start(ctx context.Context, name string, kind Kind, kv ...interface{}) (context.Context, Span) {
+	if t == nil {
+		return ctx, noopSpan{}
+	}
+
+	s := span{tracer: t}
+	s.data.Name = name
+	s.data.Kind = kind
+	s.data.Start = t.now()
+
+	if parent := FromContext(ctx); parent != nil && parent.Context().IsValid() {
+		pc := parent.Context()
+		s.data.Context.TraceID = pc.TraceID
+		s.data.Context.Sampled = pc.Sampled
+		s.data.Parent = pc.SpanID
+		if p, ok := parent.(*span); ok {
+			s.data.Attributes = p.attributes()
+		}
+	} else {
+		rand.Read(s.data.Context.TraceID[:])
+		s.data.Context.Sampled = t.sampler(s.data.Context.TraceID)
+	}
+	rand.Read(s.data.Context.SpanID[:])
+
+	s.data.Attributes = setAttributes(s.data.Attributes, kv)
+	return ContextWithSpan(ctx, &s), &s
+}
+
+// export queues the span for export, spans are dropped rather than delaying
+// events if the exporter does not keep up or after Shutdown
+func (t *Tracer) export(data SpanData) {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	if t.closed {
+		return
+	}
+
+	select {
+	case t.spans <- data:
+	default:
+	}
+}
+
+func (t *Tracer) run(ticker *time.Ticker) {
+	defer close(t.done)
+	defer ticker.Stop()
+
+	batch := make([]SpanData, 0, batchSize)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := t.exporter.Export(batch); err != nil {
+			logging.Error("error exporting spans", "error", err)
+		}
+		batch = make([]SpanData, 0, batchSize)
+	}
+
+	for {
+		select {
+		case s, ok := <-t.spans:
+			if !ok {
+				flush()
+				return
+			}
+			batch = append(batch, s)
+			if len(batch) >= batchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// Shutdown exports the remaining spans, spans ended afterwards are dropped
+func (t *Tracer) Shutdown(ctx context.Context) error {
+	if t == nil {
+		return nil
+	}
+
+	t.lock.Lock()
+	if !t.closed {
+		t.closed = true
+		close(t.spans)
+	}
+	t.lock.Unlock()
+
+	select {
+	case <-t.done:
+		return nil
+	case <-ctx.Done():
+		return errors.Wrap(ctx.Err(), "error exporting remaining spans")
+	}
+}
+
+var std atomic.Value
+
+// SetDefault replaces the default provider, nil disables tracing
+func SetDefault(p Provider) {
+	std.Store(&p)
+}
+
+// Default returns the default provider, nil if tracing is disabled
+func Default() Provider {
+	if p, ok := std.Load().(*Provider); ok {
+		return *p
+	}
+	return nil
+}
+
+// Start starts a span with the default provider, see Provider.Start. A span
+// which does nothing is returned while tracing is disabled
+func Start(ctx context.Context, name string, kind Kind, kv ...interface{}) (context.Context, Span) {
+	if p := Default(); p != nil {
+		return p.Start(ctx, name, kind, kv...)
+	}
+	return ctx, noopSpan{}
+}
+
+type spanKey struct{}
+
+// ContextWithSpan returns a context carrying the span, a nil span leaves ctx
+// as it is
+func ContextWithSpan(ctx context.Context, s Span) context.Context {
+	if s == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, spanKey{}, s)
+}
+
+// FromContext returns the span of the context, nil if there is none
+func FromContext(ctx context.Context) Span {
+	if ctx == nil {
+		return nil
+	}
+	s, _ := ctx.Value(spanKey{}).(Span)
+	return s
+}
+
+// Inject sets the traceparent header to the span of the context, if any
+func Inject(ctx context.Context, header http.Header) {
+	if s := FromContext(ctx); s != nil && s.Context().IsValid() {
+		header.Set(TraceparentHeader, s.Context().Traceparent())
+	}
+}
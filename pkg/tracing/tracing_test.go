@@ -0,0 +1,275 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	var testCases = []struct {
+		name    string
+		value   string
+		want    string
+		wantErr bool
+	}{
+		{"sampled", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", false},
+		{"not sampled", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00", false},
+		{"unknown version", "01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", "", true},
+		{"upper case", "00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01", "", true},
+		{"short span id", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902-01", "", true},
+		{"zero trace id", "00-00000000000000000000000000000000-00f067aa0ba902b7-01", "", true},
+		{"not hex", "00-4bf92f3577b34da6a3ce929d0e0e473x-00f067aa0ba902b7-01", "", true},
+		{"empty", "", "", true},
+	}
+
+	for _, test := range testCases {
+		sc, err := ParseTraceparent(test.value)
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s: wanted error: %v, got: %v", test.name, test.wantErr, err)
+			continue
+		}
+		if err == nil && sc.Traceparent() != test.want {
+			t.Errorf("%s: wanted: %v, got: %v", test.name, test.want, sc.Traceparent())
+		}
+	}
+}
+
+type recordingExporter struct {
+	spans []SpanData
+}
+
+func (e *recordingExporter) Export(spans []SpanData) error {
+	e.spans = append(e.spans, spans...)
+	return nil
+}
+
+func TestTracer(t *testing.T) {
+	exporter := &recordingExporter{}
+	tracer := NewTracer(exporter, nil)
+
+	ctx, root := tracer.Start(context.Background(), "vcenter.event", KindInternal, "vcenter.source", "vc1")
+	root.SetAttributes("vcenter.event_type", "VmPoweredOnEvent")
+	root.End()
+
+	_, child := tracer.Start(ctx, "invoke", KindClient, "faas.function", "fn1", "attempt", 2)
+	child.SetError(errors.New("status 502"))
+	child.End()
+	child.End()
+
+	header := http.Header{}
+	Inject(ctx, header)
+	if got, want := header.Get(TraceparentHeader), root.Context().Traceparent(); got != want {
+		t.Errorf("inject: wanted: %v, got: %v", want, got)
+	}
+
+	if err := tracer.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// spans ended after shutdown are dropped
+	_, late := tracer.Start(ctx, "invoke", KindClient)
+	late.End()
+	if err := tracer.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(exporter.spans) != 2 {
+		t.Fatalf("wanted: 2 spans, got: %d", len(exporter.spans))
+	}
+	r, c := exporter.spans[0], exporter.spans[1]
+
+	if c.Context.TraceID != r.Context.TraceID || c.Parent != r.Context.SpanID || r.Parent.IsValid() {
+		t.Errorf("parent: wanted child of %v, got: %v of %v", r.Context, c.Parent, c.Context)
+	}
+	if c.Kind != KindClient || c.Error != "status 502" {
+		t.Errorf("child: wanted: client span with error, got: %v %q", c.Kind, c.Error)
+	}
+
+	want := []Attribute{
+		{"vcenter.source", "vc1"},
+		{"vcenter.event_type", "VmPoweredOnEvent"},
+		{"faas.function", "fn1"},
+		{"attempt", int64(2)},
+	}
+	if !reflect.DeepEqual(c.Attributes, want) {
+		t.Errorf("attributes: wanted: %v, got: %v", want, c.Attributes)
+	}
+}
+
+func TestDisabled(t *testing.T) {
+	var tracer *Tracer
+
+	ctx, span := tracer.Start(context.Background(), "vcenter.event", KindInternal)
+	span.SetAttributes("key", "value")
+	span.SetError(errors.New("failed"))
+	span.End()
+
+	header := http.Header{}
+	Inject(ctx, header)
+	if len(header) != 0 {
+		t.Errorf("wanted: no headers, got: %v", header)
+	}
+}
+
+func TestSampling(t *testing.T) {
+	exporter := &recordingExporter{}
+	tracer := NewTracer(exporter, RatioSampler(0))
+
+	ctx, root := tracer.Start(context.Background(), "vcenter.event", KindInternal)
+	_, child := tracer.Start(ctx, "invoke", KindClient)
+	child.End()
+	root.End()
+
+	// the context of spans which are not sampled is still propagated
+	header := http.Header{}
+	Inject(ctx, header)
+	if got := header.Get(TraceparentHeader); len(got) == 0 || got[len(got)-2:] != "00" {
+		t.Errorf("inject: wanted: traceparent which is not sampled, got: %q", got)
+	}
+	if child.Context().Sampled || child.Context().TraceID != root.Context().TraceID {
+		t.Errorf("child: wanted: not sampled in trace %v, got: %v", root.Context().TraceID, child.Context())
+	}
+
+	if err := tracer.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(exporter.spans) != 0 {
+		t.Errorf("wanted: no spans, got: %v", exporter.spans)
+	}
+}
+
+func TestRatioSampler(t *testing.T) {
+	var low, high TraceID
+	low[15] = 0x01
+	high[8] = 0xff
+
+	var testCases = []struct {
+		name  string
+		ratio float64
+		id    TraceID
+		want  bool
+	}{
+		{"all", 1, high, true},
+		{"none", 0, low, false},
+		{"half low", 0.5, low, true},
+		{"half high", 0.5, high, false},
+	}
+
+	for _, test := range testCases {
+		if got := RatioSampler(test.ratio)(test.id); got != test.want {
+			t.Errorf("%s: wanted: %v, got: %v", test.name, test.want, got)
+		}
+	}
+}
+
+func TestResource(t *testing.T) {
+	got := map[string]interface{}{}
+	for _, a := range Resource("vcenter-connector", "0.5.0") {
+		got[a.Key] = a.Value
+	}
+
+	want := map[string]interface{}{
+		AttrServiceName:          "vcenter-connector",
+		AttrServiceVersion:       "0.5.0",
+		AttrTelemetrySDKLanguage: "go",
+	}
+	if host, err := os.Hostname(); err == nil {
+		want[AttrHostName] = host
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("wanted: %v, got: %v", want, got)
+	}
+}
+
+func testSpan() SpanData {
+	start := time.Date(2019, 6, 20, 8, 15, 4, 0, time.UTC)
+	sc, _ := ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	parent, _ := ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-b7ad6b7169203331-01")
+	return SpanData{
+		Name:       "invoke",
+		Kind:       KindClient,
+		Context:    sc,
+		Parent:     parent.SpanID,
+		Start:      start,
+		End:        start.Add(1500 * time.Millisecond),
+		Attributes: []Attribute{{"faas.function", "fn1"}, {"attempt", int64(1)}},
+		Error:      "status 502",
+	}
+}
+
+func TestWriterExporter(t *testing.T) {
+	var buf bytes.Buffer
+	if err := NewWriterExporter(&buf).Export([]SpanData{testSpan()}); err != nil {
+		t.Fatal(err)
+	}
+
+	want := `{"name":"invoke","kind":"client","traceId":"4bf92f3577b34da6a3ce929d0e0e4736","spanId":"00f067aa0ba902b7","parentSpanId":"b7ad6b7169203331","start":"2019-06-20T08:15:04Z","end":"2019-06-20T08:15:05.5Z","duration":"1.5s","attributes":{"attempt":1,"faas.function":"fn1"},"error":"status 502"}` + "\n"
+	if buf.String() != want {
+		t.Errorf("wanted: %s, got: %s", want, buf.String())
+	}
+}
+
+func TestOTLPExporter(t *testing.T) {
+	var got map[string]interface{}
+	var header http.Header
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header
+		body, _ := ioutil.ReadAll(r.Body)
+		json.Unmarshal(body, &got)
+	}))
+	defer srv.Close()
+
+	resource := []Attribute{{AttrServiceName, "vcenter-connector"}, {AttrHostName, "node1"}}
+	e := NewOTLPExporter(srv.URL, resource, http.Header{"Authorization": {"Bearer token"}}, time.Second)
+	if err := e.Export([]SpanData{testSpan()}); err != nil {
+		t.Fatal(err)
+	}
+
+	if header.Get("Content-Type") != "application/json" || header.Get("Authorization") != "Bearer token" {
+		t.Errorf("headers: wanted: JSON content type and authorization, got: %v", header)
+	}
+
+	var want map[string]interface{}
+	json.Unmarshal([]byte(`{"resourceSpans":[{
+		"resource":{"attributes":[
+			{"key":"service.name","value":{"stringValue":"vcenter-connector"}},
+			{"key":"host.name","value":{"stringValue":"node1"}}
+		]},
+		"scopeSpans":[{
+			"scope":{"name":"github.com/openfaas-incubator/vcenter-connector"},
+			"spans":[{
+				"traceId":"4bf92f3577b34da6a3ce929d0e0e4736",
+				"spanId":"00f067aa0ba902b7",
+				"parentSpanId":"b7ad6b7169203331",
+				"name":"invoke",
+				"kind":3,
+				"startTimeUnixNano":"1561018504000000000",
+				"endTimeUnixNano":"1561018505500000000",
+				"attributes":[
+					{"key":"faas.function","value":{"stringValue":"fn1"}},
+					{"key":"attempt","value":{"intValue":"1"}}
+				],
+				"status":{"code":2,"message":"status 502"}
+			}]
+		}]
+	}]}`), &want)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("wanted: %v, got: %v", want, got)
+	}
+
+	srv.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+	})
+	if err := e.Export([]SpanData{testSpan()}); err == nil {
+		t.Errorf("wanted: error for status 400, got: nil")
+	}
+}
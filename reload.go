@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	ofsdk "github.com/openfaas-incubator/connector-sdk/types"
+	"github.com/openfaas-incubator/vcenter-connector/pkg/config"
+	"github.com/openfaas-incubator/vcenter-connector/pkg/deadletter"
+	"github.com/openfaas-incubator/vcenter-connector/pkg/events"
+	"github.com/openfaas-incubator/vcenter-connector/pkg/logging"
+	"github.com/openfaas-incubator/vcenter-connector/pkg/topics"
+	"github.com/openfaas/openfaas-cloud/sdk"
+)
+
+// reloadable are the settings which are applied while running, all others
+// require a restart
+var reloadable = []string{
+	"filters",
+	"delivery.retry", "delivery.format", "delivery.cloudEventsMode", "delivery.deadLetterFile",
+	"gateway.timeout", "gateway.topicDelimiter",
+	"logging.level",
+}
+
+// reloadableCredentials are the settings of a vCenter Server which are
+// applied with its next login
+var reloadableCredentials = []string{"user", "password", "userSecret", "passwordSecret"}
+
+// isReloadable returns true if the setting with the key can be applied while
+// running
+func isReloadable(key string) bool {
+	if strings.HasPrefix(key, "vcenters[") {
+		i := strings.Index(key, "].")
+		if i < 0 {
+			return false
+		}
+		for _, name := range reloadableCredentials {
+			if key[i+2:] == name {
+				return true
+			}
+		}
+		return false
+	}
+
+	for _, prefix := range reloadable {
+		if key == prefix || strings.HasPrefix(key, prefix+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// reloader applies changes of the configuration and of the vCenter
+// credentials while the connector is running
+type reloader struct {
+	args       []string
+	running    config.Config
+	sessions   []*events.Session
+	controller ofsdk.Controller
+	format     *events.MessageFormat
+	receiver   *events.EventReceiver
+	watcher    *config.Watcher
+}
+
+// newReloader returns a reloader for the running configuration, sessions must
+// be in the order of its vCenter Servers. The format is the one the streams
+// dispatch messages in and the receiver the one subscribed to the controller
+func newReloader(args []string, running config.Config, opts options, sessions []*events.Session, controller ofsdk.Controller, format *events.MessageFormat, receiver *events.EventReceiver) *reloader {
+	return &reloader{
+		args:       args,
+		running:    running,
+		sessions:   sessions,
+		controller: controller,
+		format:     format,
+		receiver:   receiver,
+		watcher:    config.NewWatcher(watchedFiles(running, opts)...),
+	}
+}
+
+// run reloads the configuration on each signal and whenever a watched file
+// changed until ctx is cancelled, files are checked every interval unless it
+// is 0
+func (r *reloader) run(ctx context.Context, signals <-chan os.Signal, interval time.Duration) {
+	var tick <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case s := <-signals:
+			r.reload("signal", s.String())
+		case <-tick:
+			if changed := r.watcher.Changed(); len(changed) > 0 {
+				r.reload("files", strings.Join(changed, ","))
+			}
+		}
+	}
+}
+
+// reload reads the configuration, the environment and the secrets again and
+// applies the settings which do not require a restart. Messages in flight are
+// delivered with the previous settings. An invalid configuration is logged
+// and the running one is kept
+func (r *reloader) reload(kv ...interface{}) {
+	l := logging.With(kv...)
+
+	fs := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	cfg, opts, err := loadConfig(fs, r.args, os.Environ())
+	if err != nil {
+		l.Error("could not reload configuration, keeping the running one", "error", err)
+		return
+	}
+	r.watcher.SetFiles(watchedFiles(cfg, opts)...)
+
+	settings, err := cfg.Settings()
+	if err == nil {
+		err = events.ValidateFormat(r.controller, cfg.Delivery.Format, cfg.Delivery.CloudEventsMode)
+	}
+	if err != nil {
+		l.Error("could not reload configuration, keeping the running one", "error", err)
+		return
+	}
+
+	// secrets are read even if their names did not change, as their content
+	// may have
+	type update struct {
+		session        *events.Session
+		running        *config.VCenter
+		vcenter        config.VCenter
+		user, password string
+	}
+	var updates []update
+	for i := range r.running.VCenters {
+		running := &r.running.VCenters[i]
+		for _, v := range cfg.VCenters {
+			if v.URL != running.URL || v.Name != running.Name {
+				continue
+			}
+			user, password, err := readCredentials(v)
+			if err != nil {
+				l.Error("could not reload configuration, keeping the running one", "error", err)
+				return
+			}
+			updates = append(updates, update{r.sessions[i], running, v, user, password})
+		}
+	}
+
+	var applied, pending []string
+	for _, key := range config.Diff(r.running, cfg) {
+		if isReloadable(key) {
+			applied = append(applied, key)
+		} else {
+			pending = append(pending, key)
+		}
+	}
+
+	for _, u := range updates {
+		u.session.SetCredentials(u.user, u.password)
+		u.running.User, u.running.Password = u.vcenter.User, u.vcenter.Password
+		u.running.UserSecret, u.running.PasswordSecret = u.vcenter.UserSecret, u.vcenter.PasswordSecret
+	}
+
+	if su, ok := r.controller.(topics.SettingsUpdater); ok {
+		su.UpdateSettings(settings)
+	}
+	r.running.Filters = cfg.Filters
+	r.running.Delivery.Retry = cfg.Delivery.Retry
+	r.running.Gateway.Timeout = cfg.Gateway.Timeout
+	r.running.Gateway.TopicDelimiter = cfg.Gateway.TopicDelimiter
+
+	// messages already queued are encoded with the new format
+	if r.format != nil {
+		r.format.Set(cfg.Delivery.Format, cfg.Delivery.CloudEventsMode)
+		r.running.Delivery.Format = cfg.Delivery.Format
+		r.running.Delivery.CloudEventsMode = cfg.Delivery.CloudEventsMode
+	}
+
+	if r.receiver != nil && cfg.Delivery.DeadLetterFile != r.running.Delivery.DeadLetterFile {
+		var deadLetters deadletter.Store
+		if len(cfg.Delivery.DeadLetterFile) > 0 {
+			deadLetters = deadletter.NewFileStore(cfg.Delivery.DeadLetterFile)
+		}
+		r.receiver.SetDeadLetters(deadLetters)
+		r.running.Delivery.DeadLetterFile = cfg.Delivery.DeadLetterFile
+	}
+
+	// the level was validated
+	level, _ := logging.ParseLevel(cfg.Logging.Level)
+	logging.Default().SetLevel(level)
+	r.running.Logging.Level = cfg.Logging.Level
+
+	l.Info("configuration reloaded", "changed", strings.Join(applied, ","))
+	if len(pending) > 0 {
+		l.Warn("configuration changes require a restart", "settings", strings.Join(pending, ","))
+	}
+}
+
+// watchedFiles returns the configuration and secret files of cfg
+func watchedFiles(cfg config.Config, opts options) []string {
+	files := []string{opts.configFile, opts.vcentersFile}
+	for _, v := range cfg.VCenters {
+		if len(v.UserSecret) > 0 {
+			files = append(files, secretFile(v.UserSecret))
+		}
+		if len(v.PasswordSecret) > 0 {
+			files = append(files, secretFile(v.PasswordSecret))
+		}
+	}
+	return files
+}
+
+// secretFile returns the file of the secret like sdk.ReadSecret
+func secretFile(name string) string {
+	base := "/var/openfaas/secrets/"
+	if val := os.Getenv("secret_mount_path"); len(val) > 0 {
+		base = val
+	}
+	return path.Join(base, name)
+}
+
+// readCredentials returns the credentials of the vCenter Server, read from
+// its secrets if configured
+func readCredentials(v config.VCenter) (string, string, error) {
+	user, password := v.User, v.Password
+
+	var err error
+	if len(v.UserSecret) > 0 {
+		user, err = sdk.ReadSecret(v.UserSecret)
+		if err != nil {
+			return "", "", fmt.Errorf("could not read the user of %s: %v", v.URL, err)
+		}
+	}
+	if len(v.PasswordSecret) > 0 {
+		password, err = sdk.ReadSecret(v.PasswordSecret)
+		if err != nil {
+			return "", "", fmt.Errorf("could not read the password of %s: %v", v.URL, err)
+		}
+	}
+	return user, password, nil
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	ofsdk "github.com/openfaas-incubator/connector-sdk/types"
+	"github.com/openfaas-incubator/vcenter-connector/pkg/config"
+	"github.com/openfaas-incubator/vcenter-connector/pkg/deadletter"
+	"github.com/openfaas-incubator/vcenter-connector/pkg/events"
+	"github.com/openfaas-incubator/vcenter-connector/pkg/logging"
+	"github.com/openfaas-incubator/vcenter-connector/pkg/topics"
+)
+
+func TestIsReloadable(t *testing.T) {
+	var testCases = []struct {
+		key  string
+		want bool
+	}{
+		{"filters", true},
+		{"delivery.retry.status", true},
+		{"delivery.workers", false},
+		{"gateway.topicDelimiter", true},
+		{"gateway.url", false},
+		{"gateway.timeout", true},
+		{"delivery.format", true},
+		{"delivery.deadLetterFile", true},
+		{"logging.level", true},
+		{"logging.format", false},
+		{"vcenters[0].passwordSecret", true},
+		{"vcenters[1].user", true},
+		{"vcenters[0].url", false},
+		{"vcenters", false},
+	}
+
+	for _, test := range testCases {
+		if got := isReloadable(test.key); got != test.want {
+			t.Errorf("%s: wanted: %v, got: %v", test.key, test.want, got)
+		}
+	}
+}
+
+// settingsRecorder is a controller recording updates of its settings
+type settingsRecorder struct {
+	ofsdk.Controller
+	updates []topics.Settings
+}
+
+func (r *settingsRecorder) UpdateSettings(settings topics.Settings) {
+	r.updates = append(r.updates, settings)
+}
+
+func TestReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	defer os.Setenv("secret_mount_path", os.Getenv("secret_mount_path"))
+	os.Setenv("secret_mount_path", dir)
+
+	defer logging.SetDefault(logging.Default())
+	logger, err := logging.New(ioutil.Discard, logging.LevelInfo, logging.FormatLogfmt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logging.SetDefault(logger)
+
+	write := func(name, content string) {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("vcenter-password", "old")
+	write("connector.yaml", "version: 1\nvcenters:\n  - url: https://vc01/sdk\n    user: admin\n    passwordSecret: vcenter-password\n")
+
+	args := []string{"-config", filepath.Join(dir, "connector.yaml")}
+	cfg, opts, err := loadConfig(flag.NewFlagSet("test", flag.ContinueOnError), args, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session, err := events.NewSession(cfg.VCenters[0].Endpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	controller := &settingsRecorder{}
+	format := events.NewMessageFormat(cfg.Delivery.Format, cfg.Delivery.CloudEventsMode)
+	receiver := events.NewEventReceiver(nil)
+	r := newReloader(args, cfg, opts, []*events.Session{session}, controller, format, receiver)
+
+	write("vcenter-password", "new")
+	write("connector.yaml", `version: 1
+gateway:
+  url: http://gateway.openfaas:8080
+  timeout: 1m
+delivery:
+  format: cloudevents
+  cloudEventsMode: structured
+  deadLetterFile: `+filepath.Join(dir, "dead-letters.jsonl")+`
+vcenters:
+  - url: https://vc01/sdk
+    user: admin
+    passwordSecret: vcenter-password
+filters:
+  power-alert: category == "error"
+logging:
+  level: debug
+`)
+
+	wantChanged := []string{filepath.Join(dir, "connector.yaml"), filepath.Join(dir, "vcenter-password")}
+	if got := r.watcher.Changed(); !reflect.DeepEqual(wantChanged, got) {
+		t.Errorf("changed files: wanted: %v, got: %v", wantChanged, got)
+	}
+
+	r.reload()
+
+	if len(controller.updates) != 1 || controller.updates[0].Filters["power-alert"] == nil || controller.updates[0].Timeout != time.Minute {
+		t.Errorf("settings: wanted: an update with the filter of power-alert and a timeout of 1m, got: %v", controller.updates)
+	}
+	if f, mode := format.Get(); f != events.FormatCloudEvents || mode != "structured" {
+		t.Errorf("format: wanted: cloudevents structured, got: %v %v", f, mode)
+	}
+	if got := r.running.Delivery.DeadLetterFile; got != filepath.Join(dir, "dead-letters.jsonl") {
+		t.Errorf("running dead letter file: wanted: %v, got: %v", filepath.Join(dir, "dead-letters.jsonl"), got)
+	}
+	receiver.Response(ofsdk.InvokerResponse{Context: context.Background(), Topic: "vm.powered.on", Function: "fn1", Status: 502})
+	if entries, err := deadletter.NewFileStore(filepath.Join(dir, "dead-letters.jsonl")).List(); err != nil || len(entries) != 1 {
+		t.Errorf("dead letters: wanted: 1 entry, got: %v, %v", entries, err)
+	}
+	if !logger.Enabled(logging.LevelDebug) {
+		t.Errorf("logging: wanted: debug level")
+	}
+	if got := r.running.Filters["power-alert"]; got != `category == "error"` {
+		t.Errorf("running filters: wanted: %v, got: %v", `category == "error"`, got)
+	}
+	// the gateway requires a restart
+	if got := r.running.Gateway.URL; got != cfg.Gateway.URL {
+		t.Errorf("running gateway: wanted: %v, got: %v", cfg.Gateway.URL, got)
+	}
+
+	// assert that an invalid configuration is not applied
+	write("connector.yaml", "version: 1\nlogging:\n  level: verbose\n")
+	r.reload()
+	if len(controller.updates) != 1 {
+		t.Errorf("invalid configuration: wanted: no update, got: %v", controller.updates[1:])
+	}
+	if !logger.Enabled(logging.LevelDebug) {
+		t.Errorf("invalid configuration: wanted: debug level kept")
+	}
+}
+
+func TestReadCredentials(t *testing.T) {
+	dir, err := ioutil.TempDir("", "credentials")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	defer os.Setenv("secret_mount_path", os.Getenv("secret_mount_path"))
+	os.Setenv("secret_mount_path", dir)
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "vcenter-password"), []byte("secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	v := config.VCenter{Endpoint: events.Endpoint{URL: "https://vc01/sdk", User: "admin"}, PasswordSecret: "vcenter-password"}
+	user, password, err := readCredentials(v)
+	if err != nil || user != "admin" || password != "secret" {
+		t.Errorf("wanted: admin, secret, got: %v, %v, %v", user, password, err)
+	}
+
+	v = config.VCenter{Endpoint: events.Endpoint{URL: "https://vc01/sdk"}, UserSecret: "vcenter-username"}
+	if _, _, err := readCredentials(v); err == nil {
+		t.Errorf("missing secret: wanted error")
+	}
+
+	if got, want := secretFile("vcenter-password"), filepath.Join(dir, "vcenter-password"); got != want {
+		t.Errorf("secret file: wanted: %v, got: %v", want, got)
+	}
+}